@@ -0,0 +1,205 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+// Implements merging of the profiles stored in archives.
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ArchiveResult reports the entries of an archive merged by
+// MergeArchive.
+type ArchiveResult struct {
+	// Merged is the number of entries merged.
+	Merged int
+	// Errors holds the error for each entry that could not be parsed
+	// or merged, by entry name.
+	Errors map[string]error
+}
+
+// archiveBatchSize is the number of entries MergeArchive merges into
+// the merged profile of their group at once.
+const archiveBatchSize = 16
+
+// archiveGroup holds the entries with the same header merged by
+// MergeArchive so far.
+type archiveGroup struct {
+	header *Profile
+	merged *Profile
+	names  []string
+
+	// Entries not merged yet, and their names.
+	batch      []*Profile
+	batchNames []string
+}
+
+// flush merges the entries of the batch of g into its merged profile,
+// and records the entries that can't be merged in errs.
+func (g *archiveGroup) flush(errs map[string]error) {
+	if len(g.batch) == 0 {
+		return
+	}
+	srcs := g.batch
+	if g.merged != nil {
+		srcs = append([]*Profile{g.merged}, g.batch...)
+	}
+	if p, err := Merge(srcs); err == nil {
+		g.merged = p
+		g.names = append(g.names, g.batchNames...)
+	} else {
+		// Merge the entries of the batch one at a time to find those
+		// that can't be merged.
+		for i, p := range g.batch {
+			if g.merged != nil {
+				if p, err = Merge([]*Profile{g.merged, p}); err != nil {
+					errs[g.batchNames[i]] = err
+					continue
+				}
+			}
+			g.merged = p
+			g.names = append(g.names, g.batchNames[i])
+		}
+	}
+	g.batch, g.batchNames = nil, nil
+}
+
+// MergeArchive merges the profiles stored in the regular files of a tar
+// archive, optionally gzipped, or of a zip archive read from r. Entries
+// are grouped by their period and sample types, and the group with the
+// most entries, or the first one seen among those with as many, is
+// merged; the entries of the other groups are reported as incompatible
+// in the result. Entries are merged into the profile of their group in
+// batches of archiveBatchSize, so only that many of them per group are
+// held in memory besides the merged profiles, except for zip archives
+// which must be read in full. Entries that can't be parsed as profiles
+// or merged with the others of their group are skipped and reported in
+// the result too. Returns an error if the archive can't be read or has
+// no profile.
+func MergeArchive(r io.Reader) (*Profile, *ArchiveResult, error) {
+	res := &ArchiveResult{Errors: make(map[string]error)}
+	var groups []*archiveGroup
+	add := func(name string, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		p, err := ParseData(data)
+		if err != nil {
+			res.Errors[name] = err
+			return nil
+		}
+		var g *archiveGroup
+		for _, gg := range groups {
+			if gg.header.compatible(p) == nil {
+				g = gg
+				break
+			}
+		}
+		if g == nil {
+			g = &archiveGroup{header: &Profile{PeriodType: p.PeriodType, SampleType: p.SampleType}}
+			groups = append(groups, g)
+		}
+		g.batch = append(g.batch, p)
+		g.batchNames = append(g.batchNames, name)
+		if len(g.batch) == archiveBatchSize {
+			g.flush(res.Errors)
+		}
+		return nil
+	}
+
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		data, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				res.Errors[f.Name] = err
+				continue
+			}
+			err = add(f.Name, rc)
+			rc.Close()
+			if err != nil {
+				res.Errors[f.Name] = err
+			}
+		}
+	default:
+		var ar io.Reader = br
+		if bytes.HasPrefix(magic, []byte{0x1f, 0x8b}) {
+			gz, err := gzip.NewReader(br)
+			if err != nil {
+				return nil, nil, err
+			}
+			defer gz.Close()
+			ar = gz
+		}
+		tr := tar.NewReader(ar)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			if !h.FileInfo().Mode().IsRegular() {
+				continue
+			}
+			if err := add(h.Name, tr); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	var best *archiveGroup
+	for _, g := range groups {
+		g.flush(res.Errors)
+		if best == nil || len(g.names) > len(best.names) {
+			best = g
+		}
+	}
+	if best == nil || best.merged == nil {
+		return nil, res, fmt.Errorf("no profiles in archive")
+	}
+	for _, g := range groups {
+		if g == best {
+			continue
+		}
+		err := best.header.compatible(g.header)
+		for _, name := range g.names {
+			res.Errors[name] = err
+		}
+	}
+	res.Merged = len(best.names)
+	return best.merged, res, nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// archiveEntry is a file to store in a test archive.
+type archiveEntry struct {
+	name string
+	data []byte
+}
+
+func tarArchive(t *testing.T, w io.Writer, entries []archiveEntry) {
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(e.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeArchive(t *testing.T) {
+	encode := func(p *Profile) []byte {
+		var buf bytes.Buffer
+		if err := p.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	entries := []archiveEntry{
+		{"dir/a.pb.gz", encode(testProfile1)},
+		{"dir/readme.txt", []byte("not a profile")},
+		{"dir/b.pb.gz", encode(testProfile2)},
+		{"dir/heap.pb.gz", encode(testProfile3)},
+	}
+	want, err := Merge([]*Profile{testProfile1.Copy(), testProfile2.Copy()})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+
+	var tarData, tgzData, zipData bytes.Buffer
+	tarArchive(t, &tarData, entries)
+	gz := gzip.NewWriter(&tgzData)
+	tarArchive(t, gz, entries)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(&zipData)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc string
+		data []byte
+	}{
+		{"tar", tarData.Bytes()},
+		{"tar.gz", tgzData.Bytes()},
+		{"zip", zipData.Bytes()},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, res, err := MergeArchive(bytes.NewReader(tc.data))
+			if err != nil {
+				t.Fatalf("MergeArchive: %v", err)
+			}
+			if got, want := res.Merged, 2; got != want {
+				t.Errorf("MergeArchive merged %d entries, want %d", got, want)
+			}
+			var failed []string
+			for name := range res.Errors {
+				failed = append(failed, name)
+			}
+			sort.Strings(failed)
+			if got, want := failed, []string{"dir/heap.pb.gz", "dir/readme.txt"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("MergeArchive failed entries %v, want %v", got, want)
+			}
+			if got, want := p.String(), want.String(); got != want {
+				t.Errorf("MergeArchive got:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+
+	// Entries spanning several batches, one of which can't be merged.
+	var many []archiveEntry
+	var srcs []*Profile
+	for i := 0; i < 2*archiveBatchSize+1; i++ {
+		many = append(many, archiveEntry{fmt.Sprintf("cpu%d.pb.gz", i), encode(testProfile1)})
+		srcs = append(srcs, testProfile1.Copy())
+	}
+	many[archiveBatchSize+1] = archiveEntry{"heap.pb.gz", encode(testProfile3)}
+	srcs = append(srcs[:archiveBatchSize+1], srcs[archiveBatchSize+2:]...)
+	want, err = Merge(srcs)
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	var manyData bytes.Buffer
+	tarArchive(t, &manyData, many)
+	p, res, err := MergeArchive(&manyData)
+	if err != nil {
+		t.Fatalf("MergeArchive: %v", err)
+	}
+	if got, want := res.Merged, len(srcs); got != want {
+		t.Errorf("MergeArchive merged %d entries, want %d", got, want)
+	}
+	if _, ok := res.Errors["heap.pb.gz"]; !ok || len(res.Errors) != 1 {
+		t.Errorf("MergeArchive failed entries %v, want only heap.pb.gz", res.Errors)
+	}
+	if got, want := p.String(), want.String(); got != want {
+		t.Errorf("MergeArchive got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// An incompatible first entry doesn't keep the others from being
+	// merged.
+	want, err = Merge([]*Profile{testProfile1.Copy(), testProfile2.Copy()})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	var heapFirst bytes.Buffer
+	tarArchive(t, &heapFirst, []archiveEntry{
+		{"heap.pb.gz", encode(testProfile3)},
+		{"a.pb.gz", encode(testProfile1)},
+		{"b.pb.gz", encode(testProfile2)},
+	})
+	p, res, err = MergeArchive(&heapFirst)
+	if err != nil {
+		t.Fatalf("MergeArchive: %v", err)
+	}
+	if got, want := res.Merged, 2; got != want {
+		t.Errorf("MergeArchive merged %d entries, want %d", got, want)
+	}
+	if err := res.Errors["heap.pb.gz"]; err == nil || len(res.Errors) != 1 {
+		t.Errorf("MergeArchive failed entries %v, want only heap.pb.gz", res.Errors)
+	} else if msg := err.Error(); !strings.Contains(msg, "samples/count") || strings.Contains(msg, "0x") {
+		t.Errorf("MergeArchive error %q, want sample types formatted as type/unit", msg)
+	}
+	if got, want := p.String(), want.String(); got != want {
+		t.Errorf("MergeArchive got:\n%s\nwant:\n%s", got, want)
+	}
+
+	var empty bytes.Buffer
+	tarArchive(t, &empty, nil)
+	if _, _, err := MergeArchive(&empty); err == nil {
+		t.Errorf("MergeArchive without profiles: want error")
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+// Implements the merge of overlay profiles onto a shared base profile.
+
+import "fmt"
+
+// BaseMerger merges small overlay profiles onto a large base profile,
+// one at a time, without copying the base for each merge. The results
+// share the mappings, locations and functions of the base, and the
+// samples whose values the overlay doesn't change, by pointer. The
+// lookup tables of the base are shared too: each merge records the
+// entities it adds in tables of its own, looked up first, so its cost
+// only depends on the size of the overlay, besides a copy of the list
+// of samples of the base.
+//
+// The base is never modified: a BaseMerger holds a compacted copy of
+// it, and samples of the base are copied before their values change.
+// The symbolization flags of the mappings of the base are not updated
+// from the overlays. In exchange, the profiles returned by Merge must
+// not be modified in place, such as by Scale, Normalize or the
+// filtering methods, which would modify the base and other results
+// too; they can be read, encoded and merged with Merge, and Copy
+// returns a profile that can be modified.
+type BaseMerger struct {
+	base *Profile
+
+	// Lookup tables of the entities of base.
+	samples   map[sampleKey]*Sample
+	locations map[locationKey]*Location
+	functions map[functionKey]*Function
+	mappings  map[mappingKey]*Mapping
+
+	// Index of the samples of base and set of its mappings.
+	sampleIndex map[*Sample]int
+	mappingSet  map[*Mapping]bool
+}
+
+// NewBaseMerger returns a BaseMerger merging profiles onto base, which
+// it compacts. Returns an error if base can't be compacted.
+func NewBaseMerger(base *Profile) (*BaseMerger, error) {
+	b, err := Merge([]*Profile{base})
+	if err != nil {
+		return nil, err
+	}
+	pm := &profileMerger{
+		p:         b,
+		opts:      &ProfileMerger{},
+		samples:   make(map[sampleKey]*Sample, len(b.Sample)),
+		locations: make(map[locationKey]*Location, len(b.Location)),
+		functions: make(map[functionKey]*Function, len(b.Function)),
+		mappings:  make(map[mappingKey]*Mapping, len(b.Mapping)),
+	}
+	if !pm.index() {
+		return nil, fmt.Errorf("compacted base profile has duplicate entities")
+	}
+	bm := &BaseMerger{
+		base:        b,
+		samples:     pm.samples,
+		locations:   pm.locations,
+		functions:   pm.functions,
+		mappings:    pm.mappings,
+		sampleIndex: make(map[*Sample]int, len(b.Sample)),
+		mappingSet:  make(map[*Mapping]bool, len(b.Mapping)),
+	}
+	for _, m := range b.Mapping {
+		bm.mappings[pm.mappingKey(m)] = m
+		bm.mappingSet[m] = true
+	}
+	for i, s := range b.Sample {
+		bm.sampleIndex[s] = i
+	}
+	return bm, nil
+}
+
+// Merge returns the merge of the base profile of bm and overlay, as
+// returned by the package level Merge, sharing the entities of the base
+// as described for BaseMerger.
+func (bm *BaseMerger) Merge(overlay *Profile) (*Profile, error) {
+	b := bm.base
+	p, err := (&ProfileMerger{}).combineHeaders([]*Profile{b, overlay})
+	if err != nil {
+		return nil, err
+	}
+	// Full slice expressions make appends copy rather than write to the
+	// arrays of the base.
+	p.Mapping = b.Mapping[:len(b.Mapping):len(b.Mapping)]
+	p.Location = b.Location[:len(b.Location):len(b.Location)]
+	p.Function = b.Function[:len(b.Function):len(b.Function)]
+	p.Sample = append([]*Sample(nil), b.Sample...)
+
+	pm := &profileMerger{
+		p:              p,
+		opts:           &ProfileMerger{},
+		samples:        make(map[sampleKey]*Sample, len(overlay.Sample)),
+		locations:      make(map[locationKey]*Location, len(overlay.Location)),
+		functions:      make(map[functionKey]*Function, len(overlay.Function)),
+		mappings:       make(map[mappingKey]*Mapping, len(overlay.Mapping)),
+		baseSamples:    bm.samples,
+		baseLocations:  bm.locations,
+		baseFunctions:  bm.functions,
+		baseMappings:   bm.mappings,
+		locationsByID:  make(map[uint64]*Location, len(overlay.Location)),
+		functionsByID:  make(map[uint64]*Function, len(overlay.Function)),
+		mappingsByID:   make(map[uint64]mapInfo, len(overlay.Mapping)),
+		sharedSamples:  bm.sampleIndex,
+		sharedMappings: bm.mappingSet,
+	}
+
+	if len(bm.mappings) == 0 && len(overlay.Mapping) > 0 {
+		pm.mapMapping(overlay.Mapping[0])
+	}
+	for _, s := range overlay.Sample {
+		if !isZeroSample(s) {
+			pm.mapSample(s)
+		}
+	}
+	for _, s := range p.Sample {
+		if isZeroSample(s) {
+			// Re-merge to GC the zero samples and the entities only
+			// they used, which doesn't share anything with the base.
+			return Merge([]*Profile{p})
+		}
+	}
+	return p, nil
+}
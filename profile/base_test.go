@@ -0,0 +1,83 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/pprof/internal/proftest"
+)
+
+func TestBaseMerger(t *testing.T) {
+	base := testProfile1.Copy()
+	bm, err := NewBaseMerger(base)
+	if err != nil {
+		t.Fatalf("NewBaseMerger: %v", err)
+	}
+	orig := bm.base.String()
+	tables := func() []int {
+		return []int{len(bm.samples), len(bm.locations), len(bm.functions), len(bm.mappings)}
+	}
+	origTables := fmt.Sprint(tables())
+
+	extra := testProfile1.Copy()
+	extra.Sample = extra.Sample[1:3]
+	newFunc := &Function{ID: 100, Name: "extra", SystemName: "extra", Filename: "extra.c"}
+	newLoc := &Location{ID: 100, Mapping: extra.Mapping[0], Address: 0x1234, Line: []Line{{Function: newFunc, Line: 1}}}
+	extra.Function = append(extra.Function, newFunc)
+	extra.Location = append(extra.Location, newLoc)
+	extra.Sample = append(extra.Sample, &Sample{Location: []*Location{newLoc}, Value: []int64{5, 50}})
+
+	negated := testProfile1.Copy()
+	negated.Sample = negated.Sample[:1]
+	negated.Scale(-1)
+
+	for _, tc := range []struct {
+		desc    string
+		overlay *Profile
+	}{
+		{"empty overlay", &Profile{SampleType: testProfile1.SampleType, PeriodType: testProfile1.PeriodType}},
+		{"overlay with new entities", extra},
+		{"overlay cancelling samples", negated},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := bm.Merge(tc.overlay)
+			if err != nil {
+				t.Fatalf("Merge: %v", err)
+			}
+			if err := got.CheckValid(); err != nil {
+				t.Fatalf("Merge produced an invalid profile: %v", err)
+			}
+			want, err := Merge([]*Profile{base, tc.overlay})
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if got, want := got.String(), want.String(); got != want {
+				diff, err := proftest.Diff([]byte(want), []byte(got))
+				if err != nil {
+					t.Fatalf("failed to get diff: %v", err)
+				}
+				t.Errorf("Merge got diff(want->got):\n%s", diff)
+			}
+			if got := bm.base.String(); got != orig {
+				t.Errorf("Merge modified the base profile")
+			}
+			if got := fmt.Sprint(tables()); got != origTables {
+				t.Errorf("Merge lookup tables of the base got %s, want %s", got, origTables)
+			}
+		})
+	}
+}
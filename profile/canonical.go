@@ -0,0 +1,168 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+// Implements a byte-stable encoding of profiles.
+
+import (
+	"io"
+	"sort"
+)
+
+// EncodeDeterministic writes the profile as an uncompressed marshaled
+// protobuf whose bytes only depend on its logical contents, so that it
+// can be hashed to address it in content-addressable storage. It
+// doesn't modify p. The encoding of a copy of p is canonicalized by:
+//   - compacting it, merging identical samples, locations, functions
+//     and mappings, and dropping unused ones and samples with only zero
+//     values;
+//   - keeping the main binary mapping first, and sorting the other
+//     mappings by start, limit, offset, file, build ID and flags;
+//   - sorting functions by name, system name, filename and start line;
+//   - sorting locations by mapping, address, lines and folding;
+//   - sorting samples by locations, labels, numeric labels and values;
+//   - assigning IDs sequentially from 1 in each of these orders.
+//
+// Labels are encoded in the order of their keys, and strings in the
+// order of their first use. The output isn't compressed, as the output
+// of the compressor may change across Go versions.
+func (p *Profile) EncodeDeterministic(w io.Writer) error {
+	return p.Compact().canonicalize().WriteUncompressed(w)
+}
+
+// canonicalize sorts the entities of p and renumbers their IDs, as
+// documented by EncodeDeterministic, and returns p.
+func (p *Profile) canonicalize() *Profile {
+	if len(p.Mapping) > 1 {
+		rest := p.Mapping[1:]
+		sort.SliceStable(rest, func(i, j int) bool {
+			return mappingLess(rest[i], rest[j])
+		})
+	}
+	for i, m := range p.Mapping {
+		m.ID = uint64(i + 1)
+	}
+
+	sort.SliceStable(p.Function, func(i, j int) bool {
+		return functionLess(p.Function[i], p.Function[j])
+	})
+	for i, f := range p.Function {
+		f.ID = uint64(i + 1)
+	}
+
+	sort.SliceStable(p.Location, func(i, j int) bool {
+		return locationLess(p.Location[i], p.Location[j])
+	})
+	for i, l := range p.Location {
+		l.ID = uint64(i + 1)
+	}
+
+	keys := make(map[*Sample]sampleKey, len(p.Sample))
+	for _, s := range p.Sample {
+		keys[s] = s.key()
+	}
+	sort.SliceStable(p.Sample, func(i, j int) bool {
+		a, b := p.Sample[i], p.Sample[j]
+		if ka, kb := keys[a], keys[b]; ka != kb {
+			return ka.less(kb)
+		}
+		return int64sLess(a.Value, b.Value)
+	})
+	return p
+}
+
+func mappingLess(a, b *Mapping) bool {
+	switch {
+	case a.Start != b.Start:
+		return a.Start < b.Start
+	case a.Limit != b.Limit:
+		return a.Limit < b.Limit
+	case a.Offset != b.Offset:
+		return a.Offset < b.Offset
+	case a.File != b.File:
+		return a.File < b.File
+	case a.BuildID != b.BuildID:
+		return a.BuildID < b.BuildID
+	}
+	return mappingFlags(a) < mappingFlags(b)
+}
+
+func mappingFlags(m *Mapping) int {
+	flags := 0
+	for i, f := range []bool{m.HasFunctions, m.HasFilenames, m.HasLineNumbers, m.HasInlineFrames} {
+		if f {
+			flags |= 1 << uint(i)
+		}
+	}
+	return flags
+}
+
+func functionLess(a, b *Function) bool {
+	switch {
+	case a.Name != b.Name:
+		return a.Name < b.Name
+	case a.SystemName != b.SystemName:
+		return a.SystemName < b.SystemName
+	case a.Filename != b.Filename:
+		return a.Filename < b.Filename
+	}
+	return a.StartLine < b.StartLine
+}
+
+// locationLess orders locations by their contents. It must be called
+// after the IDs of mappings and functions are canonicalized.
+func locationLess(a, b *Location) bool {
+	var ma, mb uint64
+	if a.Mapping != nil {
+		ma = a.Mapping.ID
+	}
+	if b.Mapping != nil {
+		mb = b.Mapping.ID
+	}
+	switch {
+	case ma != mb:
+		return ma < mb
+	case a.Address != b.Address:
+		return a.Address < b.Address
+	case a.IsFolded != b.IsFolded:
+		return !a.IsFolded
+	}
+	for i := 0; i < len(a.Line) && i < len(b.Line); i++ {
+		la, lb := a.Line[i], b.Line[i]
+		var fa, fb uint64
+		if la.Function != nil {
+			fa = la.Function.ID
+		}
+		if lb.Function != nil {
+			fb = lb.Function.ID
+		}
+		switch {
+		case fa != fb:
+			return fa < fb
+		case la.Line != lb.Line:
+			return la.Line < lb.Line
+		}
+	}
+	return len(a.Line) < len(b.Line)
+}
+
+func int64sLess(a, b []int64) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeDeterministic(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		prof *Profile
+	}{
+		{desc: "test profile", prof: testProfile1},
+		{desc: "inlines", prof: inlinesProfile},
+		{desc: "recursion", prof: recursionProfile},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			var want bytes.Buffer
+			orig := tc.prof.String()
+			if err := tc.prof.EncodeDeterministic(&want); err != nil {
+				t.Fatalf("EncodeDeterministic: %v", err)
+			}
+			if got := tc.prof.String(); got != orig {
+				t.Errorf("EncodeDeterministic modified the profile, got:\n%s\nwant:\n%s", got, orig)
+			}
+
+			// Reorder and renumber everything but the main mapping, and
+			// split the first sample in two.
+			shuffled := tc.prof.Copy()
+			for i, j := 1, len(shuffled.Mapping)-1; i < j; i, j = i+1, j-1 {
+				shuffled.Mapping[i], shuffled.Mapping[j] = shuffled.Mapping[j], shuffled.Mapping[i]
+			}
+			for i, m := range shuffled.Mapping {
+				m.ID = uint64(100 + i)
+			}
+			reverseFunctions(shuffled.Function)
+			for i, f := range shuffled.Function {
+				f.ID = uint64(100 + i)
+			}
+			reverseLocations(shuffled.Location)
+			for i, l := range shuffled.Location {
+				l.ID = uint64(100 + i)
+			}
+			s := shuffled.Sample[0]
+			half := &Sample{Location: s.Location, Label: s.Label, NumLabel: s.NumLabel, NumUnit: s.NumUnit}
+			for i, v := range s.Value {
+				half.Value = append(half.Value, v/2)
+				s.Value[i] = v - v/2
+			}
+			shuffled.Sample = append([]*Sample{half}, shuffled.Sample...)
+			for i, j := 0, len(shuffled.Sample)-1; i < j; i, j = i+1, j-1 {
+				shuffled.Sample[i], shuffled.Sample[j] = shuffled.Sample[j], shuffled.Sample[i]
+			}
+
+			var got bytes.Buffer
+			if err := shuffled.EncodeDeterministic(&got); err != nil {
+				t.Fatalf("EncodeDeterministic: %v", err)
+			}
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Errorf("EncodeDeterministic of reordered profile got %x, want %x", got.Bytes(), want.Bytes())
+			}
+
+			p, err := ParseData(want.Bytes())
+			if err != nil {
+				t.Fatalf("ParseData: %v", err)
+			}
+			if got, want := len(p.Sample), len(tc.prof.Compact().Sample); got != want {
+				t.Errorf("decoded profile got %d samples, want %d", got, want)
+			}
+			if err := p.CheckValid(); err != nil {
+				t.Errorf("decoded profile is invalid: %v", err)
+			}
+		})
+	}
+}
+
+func reverseFunctions(fs []*Function) {
+	for i, j := 0, len(fs)-1; i < j; i, j = i+1, j-1 {
+		fs[i], fs[j] = fs[j], fs[i]
+	}
+}
+
+func reverseLocations(ls []*Location) {
+	for i, j := 0, len(ls)-1; i < j; i, j = i+1, j-1 {
+		ls[i], ls[j] = ls[j], ls[i]
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+// Implements a cursor to scan the samples of profiles.
+
+// SampleCursor iterates over the samples of a profile without
+// allocating for each sample. When the cursor is created, the first
+// values of the label keys given to Cursor and the leaf functions of
+// all the samples are flattened into columns, so that scans read them
+// by index rather than through the label maps and locations of the
+// samples. Labels are resolved eagerly rather than on first access, as
+// this pays off when the samples are scanned several times, rewinding
+// the cursor with Reset, at the cost of resolving labels of samples that
+// a single partial scan doesn't reach.
+//
+//	c := p.Cursor("thread")
+//	for c.Next() {
+//		total[c.Label("thread")] += c.Value(idx)
+//	}
+type SampleCursor struct {
+	samples []*Sample
+	s       *Sample
+	i       int
+
+	keys []string
+
+	// labels holds the first value of each of keys for each sample, in
+	// sample order.
+	labels []string
+
+	// leaves holds the leaf function of each sample.
+	leaves []*Function
+}
+
+// Cursor returns a cursor over the samples of p, positioned before the
+// first one, which flattens the label keys in keys. The samples of p
+// must not be changed while the cursor is in use.
+func (p *Profile) Cursor(keys ...string) *SampleCursor {
+	c := &SampleCursor{
+		samples: p.Sample,
+		i:       -1,
+		keys:    keys,
+		labels:  make([]string, len(p.Sample)*len(keys)),
+		leaves:  make([]*Function, len(p.Sample)),
+	}
+	for i, s := range p.Sample {
+		for j, k := range keys {
+			c.labels[i*len(keys)+j] = firstLabel(s, k)
+		}
+		if len(s.Location) > 0 && len(s.Location[0].Line) > 0 {
+			c.leaves[i] = s.Location[0].Line[0].Function
+		}
+	}
+	return c
+}
+
+// Reset positions the cursor before the first sample again.
+func (c *SampleCursor) Reset() {
+	c.i, c.s = -1, nil
+}
+
+// Next advances the cursor to the next sample, and returns false once
+// all the samples have been visited.
+func (c *SampleCursor) Next() bool {
+	if c.i+1 >= len(c.samples) {
+		c.i, c.s = len(c.samples), nil
+		return false
+	}
+	c.i++
+	c.s = c.samples[c.i]
+	return true
+}
+
+// Sample returns the current sample, or nil if the cursor is not
+// positioned on a sample.
+func (c *SampleCursor) Sample() *Sample {
+	return c.s
+}
+
+// Value returns the value of the current sample for the sample type at
+// idx, which must be a valid index.
+func (c *SampleCursor) Value(idx int) int64 {
+	return c.s.Value[idx]
+}
+
+// Label returns the first value of the label key of the current
+// sample, or "" if it has none or the cursor is not positioned on a
+// sample. Keys not given to Cursor are looked up in the labels of the
+// sample at each call.
+func (c *SampleCursor) Label(key string) string {
+	if c.s == nil {
+		return ""
+	}
+	for j, k := range c.keys {
+		if k == key {
+			return c.labels[c.i*len(c.keys)+j]
+		}
+	}
+	return firstLabel(c.s, key)
+}
+
+// LeafFunction returns the innermost function of the leaf location of
+// the current sample, or nil if it has no location, its leaf location
+// has no function, or the cursor is not positioned on a sample.
+func (c *SampleCursor) LeafFunction() *Function {
+	if c.s == nil {
+		return nil
+	}
+	return c.leaves[c.i]
+}
+
+// firstLabel returns the first value of the label key of s, or "" if it
+// has none.
+func firstLabel(s *Sample, key string) string {
+	if vs := s.Label[key]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
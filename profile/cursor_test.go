@@ -0,0 +1,123 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCursor(t *testing.T) {
+	p := testProfile1.Copy()
+	p.Sample[0].Label = map[string][]string{"key1": {"a", "b"}, "key2": {"c"}}
+	p.Sample = append(p.Sample, &Sample{Value: []int64{1, 2}})
+
+	var got []string
+	c := p.Cursor("key1", "missing")
+	if c.Label("key1") != "" || c.Label("key2") != "" || c.LeafFunction() != nil {
+		t.Errorf("cursor got a label or leaf function before the first sample")
+	}
+	for c.Next() {
+		leaf := "<none>"
+		if f := c.LeafFunction(); f != nil {
+			leaf = f.Name
+		}
+		got = append(got, fmt.Sprintf("%d %q %q %q %s", c.Value(1), c.Label("key1"), c.Label("key2"), c.Label("missing"), leaf))
+	}
+	var want []string
+	for _, s := range p.Sample {
+		leaf := "<none>"
+		if len(s.Location) > 0 {
+			leaf = s.Location[0].Line[0].Function.Name
+		}
+		var key1, key2 string
+		if s.Label["key1"] != nil {
+			key1 = s.Label["key1"][0]
+		}
+		if s.Label["key2"] != nil {
+			key2 = s.Label["key2"][0]
+		}
+		want = append(want, fmt.Sprintf("%d %q %q %q %s", s.Value[1], key1, key2, "", leaf))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("cursor got samples %q, want %q", got, want)
+	}
+	if c.Next() || c.Sample() != nil || c.Label("key1") != "" || c.LeafFunction() != nil {
+		t.Errorf("cursor got a sample after the last one")
+	}
+	c.Reset()
+	if !c.Next() || c.Sample() != p.Sample[0] {
+		t.Errorf("cursor got %v after Reset, want the first sample", c.Sample())
+	}
+}
+
+// cursorBenchProfile returns a profile with n samples, labeled with one
+// of a few threads.
+func cursorBenchProfile(n int) *Profile {
+	p := testProfile1.Copy()
+	samples := p.Sample
+	p.Sample = make([]*Sample, n)
+	for i := range p.Sample {
+		src := samples[i%len(samples)]
+		p.Sample[i] = &Sample{
+			Location: src.Location,
+			Value:    src.Value,
+			Label: map[string][]string{
+				"thread": {fmt.Sprint(i % 8)},
+				"host":   {"h"},
+			},
+		}
+	}
+	return p
+}
+
+func BenchmarkCursor(b *testing.B) {
+	p := cursorBenchProfile(1 << 20)
+	leaf := p.Sample[0].Location[0].Line[0].Function
+	c := p.Cursor("thread")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var threadTotal, leafTotal int64
+		c.Reset()
+		for c.Next() {
+			if c.Label("thread") == "3" {
+				threadTotal += c.Value(1)
+			}
+			if c.LeafFunction() == leaf {
+				leafTotal += c.Value(1)
+			}
+		}
+	}
+}
+
+func BenchmarkSampleLoop(b *testing.B) {
+	p := cursorBenchProfile(1 << 20)
+	leaf := p.Sample[0].Location[0].Line[0].Function
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var threadTotal, leafTotal int64
+		for _, s := range p.Sample {
+			if vs := s.Label["thread"]; len(vs) > 0 && vs[0] == "3" {
+				threadTotal += s.Value[1]
+			}
+			if len(s.Location) > 0 && len(s.Location[0].Line) > 0 && s.Location[0].Line[0].Function == leaf {
+				leafTotal += s.Value[1]
+			}
+		}
+	}
+}
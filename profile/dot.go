@@ -0,0 +1,215 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+// Implements a minimal graphviz export of the call graph of profiles.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DOTOptions controls the graph written by WriteDOT.
+type DOTOptions struct {
+	// NodeThreshold is the minimum cumulative value of the functions
+	// included in the graph. Edges to or from excluded functions are
+	// dropped.
+	NodeThreshold int64
+	// EdgeThreshold is the minimum value of the calls included in the
+	// graph.
+	EdgeThreshold int64
+}
+
+// dotKey identifies a node of the graph written by WriteDOT: a
+// function, or for frames without one, their location.
+type dotKey struct {
+	f *Function
+	l *Location
+}
+
+// id returns the ID of the function or location of k.
+func (k dotKey) id() uint64 {
+	if k.f != nil {
+		return k.f.ID
+	}
+	return k.l.ID
+}
+
+// dotNode is a node of the graph written by WriteDOT.
+type dotNode struct {
+	key       dotKey
+	name      string
+	flat, cum int64
+}
+
+// dotEdge is a call between two functions of the graph written by
+// WriteDOT.
+type dotEdge struct {
+	caller, callee dotKey
+}
+
+// WriteDOT writes the call graph of p to w in graphviz DOT format, using
+// the values of the sample type at idx. Each function is a node, labeled
+// with its flat and cumulative values and sized by its flat value, and
+// each call is an edge from caller to callee weighted by the value of the
+// samples through it. Inlined functions are separate nodes, and frames
+// without symbol information are nodes of their own, named after their
+// address. Distinct functions with the same name are distinct nodes.
+func (p *Profile) WriteDOT(w io.Writer, idx int, opts DOTOptions) error {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return err
+	}
+	nodes := make(map[dotKey]*dotNode)
+	edges := make(map[dotEdge]int64)
+	for _, s := range p.Sample {
+		v := s.Value[idx]
+		var frames []dotKey
+		for _, l := range s.Location {
+			if len(l.Line) == 0 {
+				frames = append(frames, dotKey{l: l})
+			}
+			for _, ln := range l.Line {
+				if ln.Function != nil {
+					frames = append(frames, dotKey{f: ln.Function})
+				} else {
+					frames = append(frames, dotKey{l: l})
+				}
+			}
+		}
+		// Count each function and call once per sample, even if the
+		// stack is recursive.
+		seenNodes := make(map[dotKey]bool)
+		seenEdges := make(map[dotEdge]bool)
+		for i, k := range frames {
+			n := nodes[k]
+			if n == nil {
+				n = &dotNode{key: k, name: dotName(k)}
+				nodes[k] = n
+			}
+			if i == 0 {
+				n.flat += v
+			}
+			if !seenNodes[k] {
+				seenNodes[k] = true
+				n.cum += v
+			}
+			if i > 0 {
+				e := dotEdge{caller: k, callee: frames[i-1]}
+				if !seenEdges[e] {
+					seenEdges[e] = true
+					edges[e] += v
+				}
+			}
+		}
+	}
+
+	var kept []*dotNode
+	ids := make(map[dotKey]int)
+	var maxFlat int64
+	for _, n := range nodes {
+		if abs64(n.cum) >= opts.NodeThreshold {
+			kept = append(kept, n)
+			if f := abs64(n.flat); f > maxFlat {
+				maxFlat = f
+			}
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		if kept[i].cum != kept[j].cum {
+			return kept[i].cum > kept[j].cum
+		}
+		if kept[i].name != kept[j].name {
+			return kept[i].name < kept[j].name
+		}
+		return kept[i].key.id() < kept[j].key.id()
+	})
+	for i, n := range kept {
+		ids[n.key] = i + 1
+	}
+
+	var calls []dotEdge
+	var maxEdge int64
+	for e, v := range edges {
+		if ids[e.caller] == 0 || ids[e.callee] == 0 || abs64(v) < opts.EdgeThreshold {
+			continue
+		}
+		calls = append(calls, e)
+		if abs64(v) > maxEdge {
+			maxEdge = abs64(v)
+		}
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		ci, cj := calls[i], calls[j]
+		if ids[ci.caller] != ids[cj.caller] {
+			return ids[ci.caller] < ids[cj.caller]
+		}
+		return ids[ci.callee] < ids[cj.callee]
+	})
+
+	unit := p.SampleType[idx].Unit
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph %s {\n", dotQuote(p.SampleType[idx].Type))
+	fmt.Fprintln(bw, "node [shape=box];")
+	for i, n := range kept {
+		size := 8.0
+		if maxFlat > 0 {
+			size += 16 * float64(abs64(n.flat)) / float64(maxFlat)
+		}
+		label := fmt.Sprintf("%s\\nflat: %d %s\\ncum: %d %s", dotEscape(n.name), n.flat, unit, n.cum, unit)
+		fmt.Fprintf(bw, "N%d [label=\"%s\" fontsize=%.1f];\n", i+1, label, size)
+	}
+	for _, e := range calls {
+		v := edges[e]
+		width := 1.0
+		if maxEdge > 0 {
+			width += 4 * float64(abs64(v)) / float64(maxEdge)
+		}
+		fmt.Fprintf(bw, "N%d -> N%d [label=\"%d\" penwidth=%.1f];\n", ids[e.caller], ids[e.callee], v, width)
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// dotName returns the label of the node with key k: the name of its
+// function, or the address of its location if it has no line, or "?".
+func dotName(k dotKey) string {
+	switch {
+	case k.f != nil:
+		return k.f.Name
+	case len(k.l.Line) == 0:
+		return fmt.Sprintf("%#x", k.l.Address)
+	}
+	return "?"
+}
+
+// dotEscape escapes s for use within a quoted DOT string.
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// dotQuote returns s as a quoted DOT string.
+func dotQuote(s string) string {
+	return `"` + dotEscape(s) + `"`
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
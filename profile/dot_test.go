@@ -0,0 +1,97 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/pprof/internal/proftest"
+)
+
+func TestWriteDOT(t *testing.T) {
+	// Two distinct functions named "init", both called by main.
+	m := &Mapping{ID: 1, Start: 0x1000, Limit: 0x2000, File: "bin"}
+	mainF := &Function{ID: 1, Name: "main", Filename: "main.go"}
+	initA := &Function{ID: 2, Name: "init", Filename: "a.go"}
+	initB := &Function{ID: 3, Name: "init", Filename: "b.go"}
+	mainL := &Location{ID: 1, Mapping: m, Address: 0x1001, Line: []Line{{Function: mainF, Line: 1}}}
+	initAL := &Location{ID: 2, Mapping: m, Address: 0x1002, Line: []Line{{Function: initA, Line: 1}}}
+	initBL := &Location{ID: 3, Mapping: m, Address: 0x1003, Line: []Line{{Function: initB, Line: 1}}}
+	sameNames := &Profile{
+		SampleType: []*ValueType{{Type: "samples", Unit: "count"}},
+		Mapping:    []*Mapping{m},
+		Function:   []*Function{mainF, initA, initB},
+		Location:   []*Location{mainL, initAL, initBL},
+		Sample: []*Sample{
+			{Location: []*Location{initAL, mainL}, Value: []int64{1}},
+			{Location: []*Location{initBL, mainL}, Value: []int64{1}},
+		},
+	}
+
+	for _, tc := range []struct {
+		desc string
+		prof *Profile
+		opts DOTOptions
+		want string
+	}{
+		{
+			desc: "thresholds",
+			prof: noInlinesProfile,
+			opts: DOTOptions{NodeThreshold: 4, EdgeThreshold: 4},
+			want: `digraph "samples" {
+node [shape=box];
+N1 [label="fun7\nflat: 3 count\ncum: 7 count" fontsize=20.0];
+N2 [label="fun4\nflat: 2 count\ncum: 6 count" fontsize=16.0];
+N3 [label="fun10\nflat: 0 count\ncum: 4 count" fontsize=8.0];
+N4 [label="fun9\nflat: 4 count\ncum: 4 count" fontsize=24.0];
+N1 -> N3 [label="4" penwidth=5.0];
+N2 -> N4 [label="4" penwidth=5.0];
+N3 -> N2 [label="4" penwidth=5.0];
+}
+`,
+		},
+		{
+			desc: "functions with the same name",
+			prof: sameNames,
+			want: `digraph "samples" {
+node [shape=box];
+N1 [label="main\nflat: 0 count\ncum: 2 count" fontsize=8.0];
+N2 [label="init\nflat: 1 count\ncum: 1 count" fontsize=24.0];
+N3 [label="init\nflat: 1 count\ncum: 1 count" fontsize=24.0];
+N1 -> N2 [label="1" penwidth=5.0];
+N1 -> N3 [label="1" penwidth=5.0];
+}
+`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tc.prof.WriteDOT(&buf, 0, tc.opts); err != nil {
+				t.Fatalf("WriteDOT: %v", err)
+			}
+			if got := buf.String(); got != tc.want {
+				diff, err := proftest.Diff([]byte(tc.want), []byte(got))
+				if err != nil {
+					t.Fatalf("failed to get diff: %v", err)
+				}
+				t.Errorf("WriteDOT: got diff(want->got):\n%s", diff)
+			}
+		})
+	}
+	if err := noInlinesProfile.WriteDOT(&bytes.Buffer{}, 1, DOTOptions{}); err == nil {
+		t.Errorf("WriteDOT with invalid index: want error")
+	}
+}
@@ -74,6 +74,22 @@ func (p *Profile) FilterSamplesByName(focus, ignore, hide, show *regexp.Regexp)
 	return
 }
 
+// Show removes from the call stacks of all samples the frames, including
+// inlined ones, of functions not matching re, and compacts the profile
+// to merge the samples whose remaining stacks are identical. Unlike
+// focusing, which keeps or drops whole samples, it keeps the values of
+// all the samples with at least one matching frame; samples left without
+// frames are removed. Returns whether re matched any frame. If re is nil
+// it returns false and does not modify the profile.
+func (p *Profile) Show(re *regexp.Regexp) bool {
+	if re == nil {
+		return false
+	}
+	_, _, _, matched := p.FilterSamplesByName(nil, nil, nil, re)
+	p.compact()
+	return matched
+}
+
 // ShowFrom drops all stack frames above the highest matching frame and returns
 // whether a match was found. If showFrom is nil it returns false and does not
 // modify the profile.
@@ -268,3 +284,292 @@ func (p *Profile) FilterSamplesByTag(focus, ignore TagMatch) (fm, im bool) {
 	p.Sample = samples
 	return
 }
+
+// FilterByTimeRange keeps only the samples carrying a numeric label
+// key with a value in the inclusive range [lo, hi]. Values are
+// compared raw, regardless of their NumUnit. Returns whether any
+// sample carried the key; if none did, the profile is left unchanged.
+func (p *Profile) FilterByTimeRange(key string, lo, hi int64) bool {
+	found := false
+	samples := make([]*Sample, 0, len(p.Sample))
+	for _, s := range p.Sample {
+		vals, ok := s.NumLabel[key]
+		if !ok {
+			continue
+		}
+		found = true
+		for _, v := range vals {
+			if v >= lo && v <= hi {
+				samples = append(samples, s)
+				break
+			}
+		}
+	}
+	if found {
+		p.Sample = samples
+	}
+	return found
+}
+
+// FilterByNumUnit keeps only the samples with a value of the numeric
+// label key in unit, as set in their NumUnit, and compacts the profile.
+// Samples without units for key don't match. Returns whether any sample
+// matched.
+func (p *Profile) FilterByNumUnit(key, unit string) bool {
+	samples := make([]*Sample, 0, len(p.Sample))
+	for _, s := range p.Sample {
+		for _, u := range s.NumUnit[key] {
+			if u == unit {
+				samples = append(samples, s)
+				break
+			}
+		}
+	}
+	p.Sample = samples
+	p.compact()
+	return len(samples) > 0
+}
+
+// FilterBuilder accumulates name filters to be applied to the samples
+// of a profile in a single pass. It is created by Profile.FilterBuilder
+// and its filters are applied by Apply.
+type FilterBuilder struct {
+	p                         *Profile
+	focus, ignore, hide, show []*regexp.Regexp
+}
+
+// FilterMatches reports, for each expression added to a FilterBuilder,
+// whether it matched, in the order they were added.
+type FilterMatches struct {
+	Focus, Ignore, Hide, Show []bool
+}
+
+// FilterBuilder returns a FilterBuilder for p. The filters added to it
+// are applied in a single traversal of the profile, in the order
+// described for Apply.
+func (p *Profile) FilterBuilder() *FilterBuilder {
+	return &FilterBuilder{p: p}
+}
+
+// Focus keeps only the samples with a frame matching re. Samples must
+// match all the expressions passed to Focus.
+func (b *FilterBuilder) Focus(re *regexp.Regexp) *FilterBuilder {
+	b.focus = append(b.focus, re)
+	return b
+}
+
+// Ignore drops the samples with a frame matching re.
+func (b *FilterBuilder) Ignore(re *regexp.Regexp) *FilterBuilder {
+	b.ignore = append(b.ignore, re)
+	return b
+}
+
+// Hide removes the frames matching re from all samples.
+func (b *FilterBuilder) Hide(re *regexp.Regexp) *FilterBuilder {
+	b.hide = append(b.hide, re)
+	return b
+}
+
+// Show keeps only the frames matching re in all samples. Frames must
+// match all the expressions passed to Show.
+func (b *FilterBuilder) Show(re *regexp.Regexp) *FilterBuilder {
+	b.show = append(b.show, re)
+	return b
+}
+
+// Apply filters the samples of the profile with all the expressions
+// added to b and compacts it. All focus and ignore expressions are
+// matched against the frames first, as they were before any filtering.
+// Then the hide expressions, and after them the show expressions,
+// remove frames, each in the order they were added. Finally, the
+// samples that are ignored, not focused, or left without frames are
+// removed.
+func (b *FilterBuilder) Apply() FilterMatches {
+	m := FilterMatches{
+		Focus:  make([]bool, len(b.focus)),
+		Ignore: make([]bool, len(b.ignore)),
+		Hide:   make([]bool, len(b.hide)),
+		Show:   make([]bool, len(b.show)),
+	}
+	p := b.p
+
+	// focused holds the focus expressions matched by each location that
+	// is not ignored, ignored the locations that are.
+	focused := make(map[uint64][]bool)
+	ignored := make(map[uint64]bool)
+	hidden := make(map[uint64]bool)
+	for _, l := range p.Location {
+		for i, re := range b.ignore {
+			if l.matchesName(re) {
+				m.Ignore[i] = true
+				ignored[l.ID] = true
+			}
+		}
+		if !ignored[l.ID] {
+			matched := make([]bool, len(b.focus))
+			for i, re := range b.focus {
+				if l.matchesName(re) {
+					m.Focus[i] = true
+					matched[i] = true
+				}
+			}
+			focused[l.ID] = matched
+		}
+
+		for i, re := range b.hide {
+			if l.matchesName(re) {
+				m.Hide[i] = true
+				l.Line = l.unmatchedLines(re)
+				if len(l.Line) == 0 {
+					hidden[l.ID] = true
+				}
+			}
+		}
+		for i, re := range b.show {
+			l.Line = l.matchedLines(re)
+			if len(l.Line) == 0 {
+				hidden[l.ID] = true
+			} else {
+				m.Show[i] = true
+			}
+		}
+	}
+
+	s := make([]*Sample, 0, len(p.Sample))
+	for _, sample := range p.Sample {
+		if !b.focusedAndNotIgnored(sample.Location, focused, ignored) {
+			continue
+		}
+		if len(hidden) > 0 {
+			var locs []*Location
+			for _, loc := range sample.Location {
+				if !hidden[loc.ID] {
+					locs = append(locs, loc)
+				}
+			}
+			if len(locs) == 0 {
+				continue
+			}
+			sample.Location = locs
+		}
+		s = append(s, sample)
+	}
+	p.Sample = s
+	p.compact()
+	return m
+}
+
+// focusedAndNotIgnored returns whether locs has no ignored location and
+// has, for each focus expression of b, a location matching it. Without
+// focus expressions, locs must have at least one location.
+func (b *FilterBuilder) focusedAndNotIgnored(locs []*Location, focused map[uint64][]bool, ignored map[uint64]bool) bool {
+	if len(locs) == 0 {
+		return false
+	}
+	found := make([]bool, len(b.focus))
+	n := len(found)
+	for _, loc := range locs {
+		if ignored[loc.ID] {
+			return false
+		}
+		for i, ok := range focused[loc.ID] {
+			if ok && !found[i] {
+				found[i] = true
+				n--
+			}
+		}
+	}
+	return n == 0
+}
+
+// Query selects samples of a profile for Profile.Query. A sample must
+// satisfy all the conditions set in the query to be selected.
+type Query struct {
+	// Function, if set, requires a frame of the sample to match it, by
+	// function name, file name or mapping file, as focus does in
+	// FilterSamplesByName.
+	Function *regexp.Regexp
+	// Labels requires the sample to have each label with the given
+	// value among its values.
+	Labels map[string]string
+	// NumLabels requires the sample to have each numeric label with a
+	// value in the given range.
+	NumLabels map[string]NumRange
+	// MinValue, if set, requires the value of the sample type at
+	// ValueIndex to be at least *MinValue.
+	MinValue   *int64
+	ValueIndex int
+}
+
+// NumRange is an inclusive range of numeric label values.
+type NumRange struct {
+	Min, Max int64
+}
+
+// Query returns the samples of p matching q, in the order of p.Sample,
+// without modifying the profile. Samples are checked in a single pass,
+// evaluating the conditions from the cheapest to the most expensive:
+// the value first, then labels, numeric labels and finally frames, whose
+// match against q.Function is computed once per location. Returns an
+// error if q.MinValue is set and q.ValueIndex is out of range.
+func (p *Profile) Query(q Query) ([]*Sample, error) {
+	if q.MinValue != nil {
+		if err := p.checkSampleIndex(q.ValueIndex); err != nil {
+			return nil, err
+		}
+	}
+	matched := make(map[*Location]bool)
+	var samples []*Sample
+	for _, s := range p.Sample {
+		if q.MinValue != nil && s.Value[q.ValueIndex] < *q.MinValue {
+			continue
+		}
+		if !q.matchesLabels(s) {
+			continue
+		}
+		if q.Function != nil && !q.matchesFunction(s, matched) {
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// matchesLabels returns whether s has the labels and numeric labels
+// required by q.
+func (q Query) matchesLabels(s *Sample) bool {
+	for key, value := range q.Labels {
+		if !s.HasLabel(key, value) {
+			return false
+		}
+	}
+	for key, r := range q.NumLabels {
+		found := false
+		for _, v := range s.NumLabel[key] {
+			if v >= r.Min && v <= r.Max {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesFunction returns whether a location of s matches q.Function,
+// memoizing the match of each location in matched.
+func (q Query) matchesFunction(s *Sample, matched map[*Location]bool) bool {
+	for _, l := range s.Location {
+		m, ok := matched[l]
+		if !ok {
+			m = l.matchesName(q.Function)
+			matched[l] = m
+		}
+		if m {
+			return true
+		}
+	}
+	return false
+}
@@ -16,6 +16,7 @@ package profile
 
 import (
 	"fmt"
+	"reflect"
 	"regexp"
 	"strings"
 	"testing"
@@ -541,6 +542,93 @@ func TestShowFrom(t *testing.T) {
 // sampleFuncs returns a slice of strings where each string represents one
 // profile sample in the format "<fun1> <fun2> <fun3>: <value>". This allows
 // the expected values for test cases to be specifed in human-readable strings.
+func TestFilterBuilder(t *testing.T) {
+	for _, tc := range []struct {
+		desc            string
+		filter          func(b *FilterBuilder)
+		wantMatches     FilterMatches
+		wantSampleFuncs []string
+	}{
+		{
+			desc:   "all focused",
+			filter: func(b *FilterBuilder) { b.Focus(regexp.MustCompile("fun1")).Focus(regexp.MustCompile("fun6")) },
+			wantMatches: FilterMatches{
+				Focus: []bool{true, true}, Ignore: []bool{}, Hide: []bool{}, Show: []bool{},
+			},
+			wantSampleFuncs: []string{
+				"fun4 fun5 fun1 fun6: 2",
+			},
+		},
+		{
+			desc:   "focus and ignore",
+			filter: func(b *FilterBuilder) { b.Focus(regexp.MustCompile("fun4")).Ignore(regexp.MustCompile("fun9")) },
+			wantMatches: FilterMatches{
+				Focus: []bool{true}, Ignore: []bool{true}, Hide: []bool{}, Show: []bool{},
+			},
+			wantSampleFuncs: []string{
+				"fun4 fun5 fun1 fun6: 2",
+			},
+		},
+		{
+			desc:   "any ignored",
+			filter: func(b *FilterBuilder) { b.Ignore(regexp.MustCompile("fun0")).Ignore(regexp.MustCompile("fun7")) },
+			wantMatches: FilterMatches{
+				Focus: []bool{}, Ignore: []bool{true, true}, Hide: []bool{}, Show: []bool{},
+			},
+			wantSampleFuncs: []string{
+				"fun4 fun5 fun1 fun6: 2",
+			},
+		},
+		{
+			desc: "focus before hide",
+			filter: func(b *FilterBuilder) {
+				b.Hide(regexp.MustCompile("fun1")).Hide(regexp.MustCompile("fun4")).Focus(regexp.MustCompile("fun4"))
+			},
+			wantMatches: FilterMatches{
+				Focus: []bool{true}, Ignore: []bool{}, Hide: []bool{true, true}, Show: []bool{},
+			},
+			wantSampleFuncs: []string{
+				"fun5 fun6: 2",
+				"fun9 fun7: 4",
+			},
+		},
+		{
+			desc:   "all shown",
+			filter: func(b *FilterBuilder) { b.Show(regexp.MustCompile("fun[0-4]")).Show(regexp.MustCompile("fun[3-9]")) },
+			wantMatches: FilterMatches{
+				Focus: []bool{}, Ignore: []bool{}, Hide: []bool{}, Show: []bool{true, true},
+			},
+			wantSampleFuncs: []string{
+				"fun3: 1",
+				"fun4: 6",
+			},
+		},
+		{
+			desc:   "no match",
+			filter: func(b *FilterBuilder) { b.Focus(regexp.MustCompile("nomatch")) },
+			wantMatches: FilterMatches{
+				Focus: []bool{false}, Ignore: []bool{}, Hide: []bool{}, Show: []bool{},
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := noInlinesProfile.Copy()
+			b := p.FilterBuilder()
+			tc.filter(b)
+			if got, want := b.Apply(), tc.wantMatches; !reflect.DeepEqual(got, want) {
+				t.Errorf("Apply got matches %+v, want %+v", got, want)
+			}
+			if got, want := strings.Join(sampleFuncs(p), "\n")+"\n", strings.Join(tc.wantSampleFuncs, "\n")+"\n"; got != want {
+				diff, err := proftest.Diff([]byte(want), []byte(got))
+				if err != nil {
+					t.Fatalf("failed to get diff: %v", err)
+				}
+				t.Errorf("FilterBuilder: got diff(want->got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func sampleFuncs(p *Profile) []string {
 	var ret []string
 	for _, s := range p.Sample {
@@ -597,3 +685,244 @@ func TestTagFilter(t *testing.T) {
 		}
 	}
 }
+
+func TestFilterByTimeRange(t *testing.T) {
+	timeProfile := func() *Profile {
+		p := noInlinesProfile.Copy()
+		for i, s := range p.Sample[:3] {
+			s.NumLabel = map[string][]int64{"time": {int64(i+1) * 100}}
+			s.NumUnit = map[string][]string{"time": {"nanoseconds"}}
+		}
+		return p
+	}
+
+	for _, tc := range []struct {
+		desc      string
+		key       string
+		lo, hi    int64
+		wantFound bool
+		wantFuncs []string
+	}{
+		{
+			desc:      "range covers all timestamps",
+			key:       "time",
+			lo:        100,
+			hi:        300,
+			wantFound: true,
+			wantFuncs: allNoInlinesSampleFuncs[:3],
+		},
+		{
+			desc:      "range bounds are inclusive",
+			key:       "time",
+			lo:        200,
+			hi:        300,
+			wantFound: true,
+			wantFuncs: allNoInlinesSampleFuncs[1:3],
+		},
+		{
+			desc:      "range matches nothing",
+			key:       "time",
+			lo:        400,
+			hi:        500,
+			wantFound: true,
+		},
+		{
+			desc:      "missing key leaves profile unchanged",
+			key:       "missing",
+			lo:        100,
+			hi:        300,
+			wantFuncs: allNoInlinesSampleFuncs,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := timeProfile()
+			if found := p.FilterByTimeRange(tc.key, tc.lo, tc.hi); found != tc.wantFound {
+				t.Errorf("FilterByTimeRange got found %v, want %v", found, tc.wantFound)
+			}
+			if got, want := strings.Join(sampleFuncs(p), "\n"), strings.Join(tc.wantFuncs, "\n"); got != want {
+				t.Errorf("FilterByTimeRange got samples:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestShow(t *testing.T) {
+	for _, tc := range []struct {
+		desc        string
+		re          *regexp.Regexp
+		wantMatched bool
+		wantFuncs   []string
+	}{
+		{
+			desc:        "frames of some samples",
+			re:          regexp.MustCompile("fun1$|fun5"),
+			wantMatched: true,
+			wantFuncs: []string{
+				"fun1: 1",
+				"fun5 fun1: 2",
+			},
+		},
+		{
+			desc:        "identical remaining stacks merge",
+			re:          regexp.MustCompile("fun1$"),
+			wantMatched: true,
+			wantFuncs: []string{
+				"fun1: 3",
+			},
+		},
+		{
+			desc:      "no frame",
+			re:        regexp.MustCompile("unknown"),
+			wantFuncs: nil,
+		},
+		{
+			desc:      "nil",
+			wantFuncs: allNoInlinesSampleFuncs,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := noInlinesProfile.Copy()
+			if matched := p.Show(tc.re); matched != tc.wantMatched {
+				t.Errorf("Show got matched %v, want %v", matched, tc.wantMatched)
+			}
+			if got, want := strings.Join(sampleFuncs(p), "\n"), strings.Join(tc.wantFuncs, "\n"); got != want {
+				t.Errorf("Show got samples:\n%s\nwant:\n%s", got, want)
+			}
+			if err := p.CheckValid(); err != nil {
+				t.Errorf("Show left an invalid profile: %v", err)
+			}
+		})
+	}
+
+	// Unlike Show, focusing keeps whole stacks, of matching samples only.
+	p := noInlinesProfile.Copy()
+	p.FilterSamplesByName(regexp.MustCompile("fun1$|fun5"), nil, nil, nil)
+	want := []string{
+		"fun0 fun1 fun2 fun3: 1",
+		"fun4 fun5 fun1 fun6: 2",
+	}
+	if got, want := strings.Join(sampleFuncs(p), "\n"), strings.Join(want, "\n"); got != want {
+		t.Errorf("focus got samples:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestFilterByNumUnit(t *testing.T) {
+	unitProfile := func() *Profile {
+		p := noInlinesProfile.Copy()
+		for i, u := range []string{"bytes", "kilobytes", "bytes"} {
+			p.Sample[i].NumLabel = map[string][]int64{"size": {int64(i)}}
+			p.Sample[i].NumUnit = map[string][]string{"size": {u}}
+		}
+		return p
+	}
+
+	for _, tc := range []struct {
+		desc      string
+		key, unit string
+		wantFound bool
+		wantFuncs []string
+	}{
+		{
+			desc:      "unit of some samples",
+			key:       "size",
+			unit:      "bytes",
+			wantFound: true,
+			wantFuncs: []string{allNoInlinesSampleFuncs[0], allNoInlinesSampleFuncs[2]},
+		},
+		{
+			desc: "unit of no sample",
+			key:  "size",
+			unit: "megabytes",
+		},
+		{
+			desc: "missing key",
+			key:  "missing",
+			unit: "bytes",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := unitProfile()
+			if found := p.FilterByNumUnit(tc.key, tc.unit); found != tc.wantFound {
+				t.Errorf("FilterByNumUnit got found %v, want %v", found, tc.wantFound)
+			}
+			if got, want := strings.Join(sampleFuncs(p), "\n"), strings.Join(tc.wantFuncs, "\n"); got != want {
+				t.Errorf("FilterByNumUnit got samples:\n%s\nwant:\n%s", got, want)
+			}
+			if err := p.CheckValid(); err != nil {
+				t.Errorf("FilterByNumUnit left an invalid profile: %v", err)
+			}
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	p := noInlinesProfile.Copy()
+	for i, l := range []struct {
+		status string
+		bytes  int64
+	}{{"200", 100}, {"500", 2000}, {"200", 5000}} {
+		p.Sample[i].Label = map[string][]string{"status": {l.status}}
+		p.Sample[i].NumLabel = map[string][]int64{"bytes": {l.bytes}}
+	}
+	min := func(v int64) *int64 { return &v }
+	for _, tc := range []struct {
+		desc       string
+		q          Query
+		wantValues []int64
+		wantErr    bool
+	}{
+		{
+			desc:       "empty query",
+			wantValues: []int64{1, 2, 3, 4},
+		},
+		{
+			desc:       "function",
+			q:          Query{Function: regexp.MustCompile("fun1$")},
+			wantValues: []int64{1, 2},
+		},
+		{
+			desc:       "label",
+			q:          Query{Labels: map[string]string{"status": "200"}},
+			wantValues: []int64{1, 3},
+		},
+		{
+			desc:       "numeric label range",
+			q:          Query{NumLabels: map[string]NumRange{"bytes": {Min: 1000, Max: 5000}}},
+			wantValues: []int64{2, 3},
+		},
+		{
+			desc:       "minimum value",
+			q:          Query{MinValue: min(3)},
+			wantValues: []int64{3, 4},
+		},
+		{
+			desc: "all conditions",
+			q: Query{
+				Function:  regexp.MustCompile("fun[78]"),
+				Labels:    map[string]string{"status": "200"},
+				NumLabels: map[string]NumRange{"bytes": {Min: 0, Max: 10000}},
+				MinValue:  min(2),
+			},
+			wantValues: []int64{3},
+		},
+		{
+			desc:    "invalid value index",
+			q:       Query{MinValue: min(0), ValueIndex: 1},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			samples, err := p.Query(tc.q)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Query got error %v, want error %v", err, tc.wantErr)
+			}
+			var got []int64
+			for _, s := range samples {
+				got = append(got, s.Value[0])
+			}
+			if !reflect.DeepEqual(got, tc.wantValues) {
+				t.Errorf("Query got sample values %v, want %v", got, tc.wantValues)
+			}
+		})
+	}
+}
@@ -62,3 +62,110 @@ func sampleTypes(p *Profile) []string {
 	}
 	return types
 }
+
+// LocationByID returns the location of the profile with the given ID,
+// or nil if there is none. Lookups use a table built on first use.
+// The table is rebuilt when p.Location is replaced or resized, or when a
+// lookup finds a location whose ID has changed. RebuildIndex must be
+// called after other changes to the locations of p, such as replacing
+// an element of p.Location or renumbering locations.
+func (p *Profile) LocationByID(id uint64) *Location {
+	p.indexMu.Lock()
+	defer p.indexMu.Unlock()
+	x := &p.index
+	if l := x.locations[id]; (l != nil && l.ID != id) || x.locations == nil || !sameLocationSlice(x.location, p.Location) {
+		x.indexLocations(p.Location)
+	}
+	return x.locations[id]
+}
+
+// FunctionByID returns the function of the profile with the given ID,
+// or nil if there is none. The lookup table is maintained as described
+// for LocationByID.
+func (p *Profile) FunctionByID(id uint64) *Function {
+	p.indexMu.Lock()
+	defer p.indexMu.Unlock()
+	x := &p.index
+	if f := x.functions[id]; (f != nil && f.ID != id) || x.functions == nil || !sameFunctionSlice(x.function, p.Function) {
+		x.indexFunctions(p.Function)
+	}
+	return x.functions[id]
+}
+
+// MappingByID returns the mapping of the profile with the given ID, or
+// nil if there is none. The lookup table is maintained as described for
+// LocationByID.
+func (p *Profile) MappingByID(id uint64) *Mapping {
+	p.indexMu.Lock()
+	defer p.indexMu.Unlock()
+	x := &p.index
+	if m := x.mappings[id]; (m != nil && m.ID != id) || x.mappings == nil || !sameMappingSlice(x.mapping, p.Mapping) {
+		x.indexMappings(p.Mapping)
+	}
+	return x.mappings[id]
+}
+
+// RebuildIndex rebuilds the tables used by LocationByID, FunctionByID
+// and MappingByID. It must be called after modifying the locations,
+// functions or mappings of the profile in place.
+func (p *Profile) RebuildIndex() {
+	p.indexMu.Lock()
+	defer p.indexMu.Unlock()
+	p.index.indexLocations(p.Location)
+	p.index.indexFunctions(p.Function)
+	p.index.indexMappings(p.Mapping)
+}
+
+// idIndex holds tables of profile entities by ID, along with the slices
+// they were built from.
+type idIndex struct {
+	locations map[uint64]*Location
+	functions map[uint64]*Function
+	mappings  map[uint64]*Mapping
+
+	location []*Location
+	function []*Function
+	mapping  []*Mapping
+}
+
+func (x *idIndex) indexLocations(locs []*Location) {
+	x.location = locs
+	x.locations = make(map[uint64]*Location, len(locs))
+	for _, l := range locs {
+		x.locations[l.ID] = l
+	}
+}
+
+func (x *idIndex) indexFunctions(funcs []*Function) {
+	x.function = funcs
+	x.functions = make(map[uint64]*Function, len(funcs))
+	for _, f := range funcs {
+		x.functions[f.ID] = f
+	}
+}
+
+func (x *idIndex) indexMappings(maps []*Mapping) {
+	x.mapping = maps
+	x.mappings = make(map[uint64]*Mapping, len(maps))
+	for _, m := range maps {
+		x.mappings[m.ID] = m
+	}
+}
+
+// sameLocationSlice returns whether two slices share the same elements in
+// memory.
+func sameLocationSlice(a, b []*Location) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// sameFunctionSlice returns whether two slices share the same elements
+// in memory.
+func sameFunctionSlice(a, b []*Function) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// sameMappingSlice returns whether two slices share the same elements in
+// memory.
+func sameMappingSlice(a, b []*Mapping) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
@@ -112,3 +112,44 @@ func TestSampleIndexByName(t *testing.T) {
 		}
 	}
 }
+
+func TestByID(t *testing.T) {
+	p := testProfile1.Copy()
+	for _, l := range p.Location {
+		if got := p.LocationByID(l.ID); got != l {
+			t.Errorf("LocationByID(%d) got %v, want %v", l.ID, got, l)
+		}
+	}
+	for _, f := range p.Function {
+		if got := p.FunctionByID(f.ID); got != f {
+			t.Errorf("FunctionByID(%d) got %v, want %v", f.ID, got, f)
+		}
+	}
+	for _, m := range p.Mapping {
+		if got := p.MappingByID(m.ID); got != m {
+			t.Errorf("MappingByID(%d) got %v, want %v", m.ID, got, m)
+		}
+	}
+	if got := p.LocationByID(1); got != nil {
+		t.Errorf("LocationByID(1) got %v, want nil", got)
+	}
+
+	// Replacing the slices invalidates the tables.
+	p.Location = p.Compact().Location
+	if got := p.LocationByID(1); got != p.Location[0] {
+		t.Errorf("LocationByID(1) after Compact got %v, want %v", got, p.Location[0])
+	}
+
+	// Other in place changes require RebuildIndex.
+	for _, f := range p.Function {
+		f.ID += 10
+	}
+	p.Mapping[0], p.Mapping[1] = p.Mapping[1], p.Mapping[0]
+	p.RebuildIndex()
+	if got := p.FunctionByID(11); got != p.Function[0] {
+		t.Errorf("FunctionByID(11) after renumbering got %v, want %v", got, p.Function[0])
+	}
+	if got := p.MappingByID(p.Mapping[0].ID); got != p.Mapping[0] {
+		t.Errorf("MappingByID(%d) after RebuildIndex got %v, want %v", p.Mapping[0].ID, got, p.Mapping[0])
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+// Implements a JSON export of profiles for consumers that can't decode
+// protocol buffers.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// jsonProfile is the JSON document written by WriteJSON.
+type jsonProfile struct {
+	SampleTypes       []jsonValueType `json:"sampleTypes"`
+	DefaultSampleType string          `json:"defaultSampleType,omitempty"`
+	PeriodType        *jsonValueType  `json:"periodType,omitempty"`
+	Period            int64           `json:"period,omitempty"`
+	TimeNanos         int64           `json:"timeNanos,omitempty"`
+	DurationNanos     int64           `json:"durationNanos,omitempty"`
+	Comments          []string        `json:"comments,omitempty"`
+	Samples           []jsonSample    `json:"samples"`
+}
+
+type jsonValueType struct {
+	Type string `json:"type"`
+	Unit string `json:"unit"`
+}
+
+type jsonSample struct {
+	Stack     []jsonFrame         `json:"stack"`
+	Values    []int64             `json:"values"`
+	Labels    map[string][]string `json:"labels,omitempty"`
+	NumLabels map[string][]int64  `json:"numLabels,omitempty"`
+	NumUnits  map[string][]string `json:"numUnits,omitempty"`
+}
+
+// jsonFrame is a frame of a call stack. Symbolized frames have a
+// function name, file and line, and unsymbolized ones an address and
+// the file of their mapping.
+type jsonFrame struct {
+	Function string `json:"function,omitempty"`
+	File     string `json:"file,omitempty"`
+	Line     int64  `json:"line,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Mapping  string `json:"mapping,omitempty"`
+}
+
+// WriteJSON writes p to w as a JSON document, for consumers such as web
+// frontends that can't decode protocol buffers. It holds the sample
+// types and other metadata of p, and its samples with their values,
+// labels and call stacks. Call stacks list frames from the leaf, with
+// a frame for each inlined function, holding their function names and
+// source positions, or for unsymbolized locations their hexadecimal
+// address and mapping file, instead of IDs. This is a lossy export, not
+// an alternative encoding of profiles: it can't be parsed back, and its
+// structure may be extended.
+func (p *Profile) WriteJSON(w io.Writer) error {
+	jp := jsonProfile{
+		SampleTypes:       make([]jsonValueType, len(p.SampleType)),
+		DefaultSampleType: p.DefaultSampleType,
+		Period:            p.Period,
+		TimeNanos:         p.TimeNanos,
+		DurationNanos:     p.DurationNanos,
+		Comments:          p.Comments,
+		Samples:           make([]jsonSample, len(p.Sample)),
+	}
+	for i, st := range p.SampleType {
+		jp.SampleTypes[i] = jsonValueType{st.Type, st.Unit}
+	}
+	if pt := p.PeriodType; pt != nil {
+		jp.PeriodType = &jsonValueType{pt.Type, pt.Unit}
+	}
+	for i, s := range p.Sample {
+		js := jsonSample{
+			Stack:  []jsonFrame{},
+			Values: s.Value,
+		}
+		if len(s.Label) > 0 {
+			js.Labels = s.Label
+		}
+		if len(s.NumLabel) > 0 {
+			js.NumLabels = s.NumLabel
+		}
+		if len(s.NumUnit) > 0 {
+			js.NumUnits = s.NumUnit
+		}
+		for _, l := range s.Location {
+			if len(l.Line) == 0 {
+				f := jsonFrame{Address: fmt.Sprintf("%#x", l.Address)}
+				if l.Mapping != nil {
+					f.Mapping = l.Mapping.File
+				}
+				js.Stack = append(js.Stack, f)
+			}
+			for _, ln := range l.Line {
+				f := jsonFrame{Line: ln.Line}
+				if fn := ln.Function; fn != nil {
+					f.Function, f.File = fn.Name, fn.Filename
+				}
+				js.Stack = append(js.Stack, f)
+			}
+		}
+		jp.Samples[i] = js
+	}
+	return json.NewEncoder(w).Encode(jp)
+}
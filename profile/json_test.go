@@ -0,0 +1,50 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestWriteJSON(t *testing.T) {
+	p := inlinesProfile.Copy()
+	p.Sample = p.Sample[:1]
+	unsymbolized := &Location{ID: 4, Mapping: p.Mapping[0], Address: 0x4000}
+	p.Location = append(p.Location, unsymbolized)
+	p.Sample[0].Location = append(p.Sample[0].Location, unsymbolized)
+	p.Sample[0].Label = map[string][]string{"key": {"value"}}
+	p.Sample[0].NumLabel = map[string][]int64{"bytes": {8}}
+	p.Sample[0].NumUnit = map[string][]string{"bytes": {"bytes"}}
+
+	var buf bytes.Buffer
+	if err := p.WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	want := `{"sampleTypes":[{"type":"samples","unit":"count"}],` +
+		`"periodType":{"type":"cpu","unit":"milliseconds"},"period":1,"timeNanos":10000,"durationNanos":10000000000,` +
+		`"samples":[{"stack":[` +
+		`{"function":"fun0","file":"file0","line":1},{"function":"fun1","file":"file1","line":1},` +
+		`{"function":"fun2","file":"file2","line":1},{"function":"fun3","file":"file3","line":1},` +
+		`{"address":"0x4000","mapping":"map0"}],` +
+		`"values":[1],"labels":{"key":["value"]},"numLabels":{"bytes":[8]},"numUnits":{"bytes":["bytes"]}}]}` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("WriteJSON got\n%s\nwant\n%s", got, want)
+	}
+	if !json.Valid(buf.Bytes()) {
+		t.Errorf("WriteJSON wrote invalid JSON")
+	}
+}
@@ -15,7 +15,11 @@
 package profile
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
@@ -29,6 +33,176 @@ func (p *Profile) Compact() *Profile {
 	return p
 }
 
+// CompactInPlace removes the samples of p with only zero values, and
+// the locations, functions and mappings left unused, then renumbers the
+// remaining ones from 1. Unlike Compact, it modifies p and doesn't merge
+// duplicate samples or entities, which makes it much cheaper when only
+// garbage needs to be collected.
+func (p *Profile) CompactInPlace() {
+	p.dropZeroSamples()
+	p.removeUnused()
+	for i, m := range p.Mapping {
+		m.ID = uint64(i + 1)
+	}
+	for i, f := range p.Function {
+		f.ID = uint64(i + 1)
+	}
+	for i, l := range p.Location {
+		l.ID = uint64(i + 1)
+	}
+}
+
+// CompactResult reports how many entities of each kind were removed by
+// CompactStats, either because they were unused or because they were
+// merged with identical ones.
+type CompactResult struct {
+	Samples, Locations, Functions, Mappings int
+}
+
+// CompactStats compacts the profile like Compact, and also reports how
+// many entities were removed in the process.
+func (p *Profile) CompactStats() (*Profile, CompactResult) {
+	c := p.Compact()
+	return c, CompactResult{
+		Samples:   len(p.Sample) - len(c.Sample),
+		Locations: len(p.Location) - len(c.Location),
+		Functions: len(p.Function) - len(c.Function),
+		Mappings:  len(p.Mapping) - len(c.Mapping),
+	}
+}
+
+// compact replaces the samples, locations, functions and mappings of p
+// with those of p.Compact(), merging any samples that became identical
+// and dropping those that became zero. The header of p is unchanged.
+func (p *Profile) compact() {
+	pp := p.Compact()
+	p.Sample, p.Location, p.Function, p.Mapping = pp.Sample, pp.Location, pp.Function, pp.Mapping
+}
+
+// CollapseToFunctions returns a new profile holding one single-frame
+// sample per leaf function, valued with the flat value of that function
+// for the sample type at idx. Call stacks and labels are discarded, so
+// this is a lossy but much smaller representation of p. Samples whose
+// leaf frame has no function are dropped. Returns an error if idx is
+// not a valid sample type index.
+func (p *Profile) CollapseToFunctions(idx int) (*Profile, error) {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return nil, err
+	}
+	st := p.SampleType[idx]
+	fp := &Profile{
+		SampleType:        []*ValueType{{Type: st.Type, Unit: st.Unit}},
+		DefaultSampleType: st.Type,
+		Mapping:           p.Mapping,
+		Function:          p.Function,
+		Comments:          p.Comments,
+		TimeNanos:         p.TimeNanos,
+		DurationNanos:     p.DurationNanos,
+		PeriodType:        p.PeriodType,
+		Period:            p.Period,
+	}
+	samples := make(map[*Function]*Sample)
+	for _, s := range p.Sample {
+		if len(s.Location) == 0 || len(s.Location[0].Line) == 0 {
+			continue
+		}
+		leaf := s.Location[0]
+		fn := leaf.Line[0].Function
+		if fn == nil {
+			continue
+		}
+		fs, ok := samples[fn]
+		if !ok {
+			loc := &Location{
+				ID:      uint64(len(fp.Location) + 1),
+				Mapping: leaf.Mapping,
+				Line:    []Line{{Function: fn}},
+			}
+			fp.Location = append(fp.Location, loc)
+			fs = &Sample{
+				Location: []*Location{loc},
+				Value:    []int64{0},
+			}
+			samples[fn] = fs
+			fp.Sample = append(fp.Sample, fs)
+		}
+		fs.Value[0] += s.Value[idx]
+	}
+	return fp.Compact(), nil
+}
+
+// Shard partitions the samples of p into n profiles by a hash of their
+// call stacks and labels, so that samples that would be merged together
+// always land in the same shard. Each shard is compacted and shares the
+// headers of p; merging all the shards yields p again. n values lower
+// than 1 are treated as 1.
+func (p *Profile) Shard(n int) []*Profile {
+	if n < 1 {
+		n = 1
+	}
+	buckets := make([][]*Sample, n)
+	for _, s := range p.Sample {
+		k := s.key()
+		h := fnv.New64a()
+		io.WriteString(h, k.locations)
+		h.Write([]byte{0})
+		io.WriteString(h, k.labels)
+		h.Write([]byte{0})
+		io.WriteString(h, k.numlabels)
+		i := h.Sum64() % uint64(n)
+		buckets[i] = append(buckets[i], s)
+	}
+	shards := make([]*Profile, n)
+	for i, samples := range buckets {
+		shards[i] = p.withSamples(samples)
+	}
+	return shards
+}
+
+// SplitByThread partitions the samples of p by the thread identifier in
+// their label key, returning a profile for each thread. Threads are
+// identified by the first value of the numeric label key, formatted in
+// decimal, or if there is none by the first value of the string label
+// key. Samples without a thread identifier are returned under "". Each
+// profile is compacted and shares the headers of p.
+func (p *Profile) SplitByThread(key string) map[string]*Profile {
+	threads := make(map[string][]*Sample)
+	for _, s := range p.Sample {
+		var thread string
+		if vs := s.NumLabel[key]; len(vs) > 0 {
+			thread = strconv.FormatInt(vs[0], 10)
+		} else if vs := s.Label[key]; len(vs) > 0 {
+			thread = vs[0]
+		}
+		threads[thread] = append(threads[thread], s)
+	}
+	profs := make(map[string]*Profile, len(threads))
+	for thread, samples := range threads {
+		profs[thread] = p.withSamples(samples)
+	}
+	return profs
+}
+
+// withSamples returns a compacted profile with the headers of p and the
+// given samples of p.
+func (p *Profile) withSamples(samples []*Sample) *Profile {
+	return (&Profile{
+		SampleType:        p.SampleType,
+		DefaultSampleType: p.DefaultSampleType,
+		Sample:            samples,
+		Mapping:           p.Mapping,
+		Location:          p.Location,
+		Function:          p.Function,
+		Comments:          p.Comments,
+		DropFrames:        p.DropFrames,
+		KeepFrames:        p.KeepFrames,
+		TimeNanos:         p.TimeNanos,
+		DurationNanos:     p.DurationNanos,
+		PeriodType:        p.PeriodType,
+		Period:            p.Period,
+	}).Compact()
+}
+
 // Merge merges all the profiles in profs into a single Profile.
 // Returns a new profile independent of the input profiles. The merged
 // profile is compacted to eliminate unused samples, locations,
@@ -36,55 +210,999 @@ func (p *Profile) Compact() *Profile {
 // and period types or the merge will fail. profile.Period of the
 // resulting profile will be the maximum of all profiles, and
 // profile.TimeNanos will be the earliest nonzero one.
+//
+// The samples of the merged profile are in the order they are first
+// found in srcs, taken in order: a sample merged into one with the same
+// key doesn't move it, and samples removed for having only zero values
+// don't reorder the other ones. In particular, Compact keeps the
+// relative order of the samples of a profile, which callers may rely on
+// to keep them approximately chronological.
 func Merge(srcs []*Profile) (*Profile, error) {
+	return (&ProfileMerger{}).Merge(srcs)
+}
+
+// MergeToWriter merges srcs as Merge does and writes the merged profile
+// to w as a gzip-compressed marshaled protobuf. The tables used to merge
+// the profiles are released before the merged profile is encoded, so
+// the peak memory use is the larger, rather than the sum, of the merge
+// working set and the merged profile with its encoding.
+func MergeToWriter(srcs []*Profile, w io.Writer) error {
+	p, err := Merge(srcs)
+	if err != nil {
+		return err
+	}
+	return p.Write(w)
+}
+
+// MergeDiffs merges profiles holding differences between profiles, such
+// as those computed by scaling a base profile by -1 and merging it with
+// another one, to add up several of them. It assumes all srcs compute
+// their differences in the same direction, so their signed values can
+// be added. Unlike Merge, if keepZero is set, samples whose values add
+// up to zero are kept, so that the stacks that didn't change are still
+// listed; otherwise they are removed.
+func MergeDiffs(srcs []*Profile, keepZero bool) (*Profile, error) {
+	return (&ProfileMerger{keepZeroSamples: keepZero}).Merge(srcs)
+}
+
+// MergeWithOffsets merges srcs as Merge does, adding offsetsNanos[i]
+// to the TimeNanos of srcs[i] before picking the earliest one as the
+// TimeNanos of the merged profile, to correct for the skew between the
+// clocks of the sources. Sources without a TimeNanos are left out as
+// usual. Returns an error if offsetsNanos doesn't have an offset for
+// each profile.
+func MergeWithOffsets(srcs []*Profile, offsetsNanos []int64) (*Profile, error) {
+	if len(offsetsNanos) != len(srcs) {
+		return nil, fmt.Errorf("time offsets for %d profiles, merging %d", len(offsetsNanos), len(srcs))
+	}
+	return (&ProfileMerger{timeOffsets: offsetsNanos}).Merge(srcs)
+}
+
+// VerifyMergeTotals checks that the values of each sample type of
+// merged add up to the sum of the values of that sample type in srcs,
+// as they do when merged is the result of merging srcs without scaling
+// or filtering them. Sample types are matched by type and unit, and
+// sources without one of the sample types of merged contribute nothing
+// to it. Returns an error listing the sample types whose totals differ,
+// with the difference.
+func VerifyMergeTotals(srcs []*Profile, merged *Profile) error {
+	want := make([]int64, len(merged.SampleType))
+	pm := &ProfileMerger{}
+	for _, src := range srcs {
+		columns := pm.sampleTypeColumns(merged.SampleType, src)
+		for _, s := range src.Sample {
+			for i := range want {
+				j := i
+				if columns != nil {
+					j = columns[i]
+				}
+				if j >= 0 {
+					want[i] += s.Value[j]
+				}
+			}
+		}
+	}
+	got := make([]int64, len(merged.SampleType))
+	for _, s := range merged.Sample {
+		for i, v := range s.Value {
+			got[i] += v
+		}
+	}
+	var diffs []string
+	for i, st := range merged.SampleType {
+		if got[i] != want[i] {
+			diffs = append(diffs, fmt.Sprintf("%s: got %d, want %d (%+d)", valueTypeString(st), got[i], want[i], got[i]-want[i]))
+		}
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("merged totals differ from sources: %s", strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+// MergePartialColumns merges srcs into a profile holding, for each
+// sample type, the mean of the values of the profiles contributing to
+// it, so that profiles with only placeholder values for some sample
+// types don't dilute their means. contributes holds, for each profile,
+// whether it contributes to each sample type; the values of
+// non-contributing profiles are ignored. Sample types without any
+// contributing profile have zero values. The values of the
+// contributing profiles are added up before being divided by their
+// number, rounding halves away from zero, and samples left with only
+// zero values are removed. Returns an error if the dimensions of
+// contributes don't match srcs and their sample types.
+func MergePartialColumns(srcs []*Profile, contributes [][]bool) (*Profile, error) {
 	if len(srcs) == 0 {
 		return nil, fmt.Errorf("no profiles to merge")
 	}
-	p, err := combineHeaders(srcs)
+	if len(contributes) != len(srcs) {
+		return nil, fmt.Errorf("contributions for %d profiles, merging %d", len(contributes), len(srcs))
+	}
+	n := len(srcs[0].SampleType)
+	counts := make([]int, n)
+	for i, cs := range contributes {
+		if len(cs) != n {
+			return nil, fmt.Errorf("profile %d: contributions for %d sample types, want %d", i, len(cs), n)
+		}
+		for j, c := range cs {
+			if c {
+				counts[j]++
+			}
+		}
+	}
+	pm := &ProfileMerger{ColumnScale: make([]map[int]float64, len(srcs))}
+	for i, cs := range contributes {
+		scale := make(map[int]float64)
+		for j, c := range cs {
+			if !c {
+				scale[j] = 0
+			}
+		}
+		pm.ColumnScale[i] = scale
+	}
+	p, err := pm.Merge(srcs)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range p.Sample {
+		for j, c := range counts {
+			if c > 1 {
+				s.Value[j] = roundDiv(s.Value[j], int64(c))
+			}
+		}
+	}
+	p.CompactInPlace()
+	return p, nil
+}
+
+// CombinePrefixed merges two profiles of possibly different types into
+// a profile holding the sample types of a prefixed with pa followed by
+// the sample types of b prefixed with pb. For example, with prefixes
+// "cpu/" and "heap/", a sample type "samples" of a becomes "cpu/samples".
+// Samples with the same stack and labels in both profiles are merged
+// into one sample holding the values of both; other samples have zero
+// values for the sample types of the other profile. The merged profile
+// takes its period type and period from a. As a and b are views of the
+// same time, its duration is the length of the union of their time
+// intervals, or the duration of a if either has no TimeNanos. Returns
+// an error if the prefixed sample types are not unique.
+func CombinePrefixed(a, b *Profile, pa, pb string) (*Profile, error) {
+	sampleType := make([]*ValueType, 0, len(a.SampleType)+len(b.SampleType))
+	seen := make(map[string]bool)
+	for _, src := range []struct {
+		p      *Profile
+		prefix string
+	}{{a, pa}, {b, pb}} {
+		for _, st := range src.p.SampleType {
+			typ := src.prefix + st.Type
+			if seen[typ] {
+				return nil, fmt.Errorf("duplicate sample type %s", typ)
+			}
+			seen[typ] = true
+			sampleType = append(sampleType, &ValueType{Type: typ, Unit: st.Unit})
+		}
+	}
+
+	wa := widenSampleTypes(a, sampleType, 0, pa)
+	wb := widenSampleTypes(b, sampleType, len(a.SampleType), pb)
+	wb.PeriodType, wb.Period = wa.PeriodType, wa.Period
+	p, err := (&ProfileMerger{UnionDuration: true}).Merge([]*Profile{wa, wb})
 	if err != nil {
 		return nil, err
 	}
+	if a.TimeNanos == 0 || b.TimeNanos == 0 {
+		p.DurationNanos = a.DurationNanos
+	}
+	return p, nil
+}
 
-	pm := &profileMerger{
+// widenSampleTypes returns a copy of p with the given sample types, and
+// with the values of its samples placed at offset. Other values are
+// zero. The default sample type of p is prefixed with prefix.
+func widenSampleTypes(p *Profile, sampleType []*ValueType, offset int, prefix string) *Profile {
+	wp := p.Copy()
+	wp.SampleType = sampleType
+	if wp.DefaultSampleType != "" {
+		wp.DefaultSampleType = prefix + wp.DefaultSampleType
+	}
+	for _, s := range wp.Sample {
+		values := make([]int64, len(sampleType))
+		copy(values[offset:], s.Value)
+		s.Value = values
+	}
+	return wp
+}
+
+// ProfileMerger merges profiles with options that alter how the merged
+// profile is built. The zero value merges exactly like Merge.
+type ProfileMerger struct {
+	// UnionDuration sets the DurationNanos of the merged profile to the
+	// length of the union of the sources' [TimeNanos,
+	// TimeNanos+DurationNanos) intervals rather than to the sum of
+	// their durations, so that overlapping profiles are not counted
+	// twice. Sources without a TimeNanos can't be placed in time and
+	// contribute their whole duration.
+	UnionDuration bool
+
+	// InputsCompacted declares that every source is already compacted:
+	// it has no zero samples and no duplicate samples, locations or
+	// functions, as is the case for the output of Merge. The merger
+	// then skips the zero sample checks and defers hashing the first
+	// source's entities until a second source needs to be matched
+	// against them, so compacting a single compacted profile does no
+	// hashing at all. If the first source turns out to contain
+	// duplicates when its entities are hashed, the merge falls back to
+	// the regular algorithm. A single source that is not really
+	// compacted is copied as is. Hashing is not deferred when other
+	// options change which samples, locations or functions are merged
+	// together, as even compacted sources may then have some to merge.
+	InputsCompacted bool
+
+	// MappingAliases maps build IDs or file names of source mappings to
+	// canonical ones, so that mappings known to describe the same binary
+	// are merged together. Mappings are identified by their build ID if
+	// they have one, and by their file name otherwise. Aliased mappings
+	// still need to have the same size and offset to be merged. The
+	// merged mapping keeps the build ID and file name of the first
+	// mapping seen.
+	MappingAliases map[string]string
+
+	// CommentNormalizer, if set, is applied to every source comment
+	// before duplicate comments are removed, and the merged profile
+	// keeps the normalized comments. For example, it can fold case and
+	// trim spaces so that comments differing only in those are kept
+	// once.
+	CommentNormalizer func(string) string
+
+	// SymbolicOnly merges symbolized locations based only on their
+	// functions and line numbers, ignoring their addresses and
+	// mappings. This allows merging profiles of the same program built
+	// for different architectures, whose addresses are unrelated.
+	// Mappings themselves are still merged as usual, and a merged
+	// location keeps the address and mapping of the first location
+	// seen; mappings left without locations are dropped. Locations
+	// without line information are still identified by address.
+	SymbolicOnly bool
+
+	// TypeAliases and UnitAliases map sample and period types and units
+	// to canonical ones, which are compared instead when checking that
+	// profiles can be merged. For example, mapping "ns" to "nanoseconds"
+	// allows merging profiles using either for the same unit. Values
+	// are not rescaled, so aliases must only map synonyms. The merged
+	// profile keeps the types and units of the first profile.
+	TypeAliases map[string]string
+	UnitAliases map[string]string
+
+	// PermuteSampleTypes allows merging profiles with the same sample
+	// types in a different order. The values of each profile are
+	// reordered to match the sample types of the first one.
+	PermuteSampleTypes bool
+
+	// SkipUnitDrift makes Merge skip the profiles that can't be merged
+	// only because some of their sample or period types have the same
+	// type but a different unit than in the first profile, which
+	// usually means their instrumentation changed, instead of failing.
+	// The skipped profiles are reported by Stats.
+	SkipUnitDrift bool
+
+	// DedupSources makes Merge skip the profiles with the same contents
+	// as a previous one, such as those sent twice by retrying clients,
+	// so they are not counted twice. The skipped profiles are reported
+	// by Stats.
+	DedupSources bool
+
+	// LocationKeyFunc, if set, replaces the default identity of
+	// locations: locations of the merged profile are merged together
+	// if and only if it returns the same key for them. It is called
+	// with locations already remapped into the merged profile, so
+	// their mapping is the merged one, and SymbolicOnly is ignored. It
+	// is called once for every distinct location of every source, so
+	// it should be cheap; building a string for each location can
+	// dominate the cost of merging large profiles.
+	LocationKeyFunc func(*Location) string
+
+	// MappingKeyFunc, if set, replaces the default identity of
+	// mappings: source mappings are merged together if and only if it
+	// returns the same key for them, and MappingAliases is ignored. The
+	// merged mapping keeps the fields of the first mapping seen, and
+	// the addresses of locations in the other ones are shifted by the
+	// difference of their starts. Mappings with the same key must thus
+	// describe the same binary loaded at possibly different addresses,
+	// with the same layout.
+	MappingKeyFunc func(*Mapping) string
+
+	// TimeLabel, if set, is the numeric label set on the samples of
+	// each profile to its TimeNanos, in nanoseconds, replacing any
+	// existing value. As labels are part of the identity of samples,
+	// this keeps samples from profiles taken at different times
+	// distinct in the merged profile, so they can later be bucketed by
+	// time. Profiles without a TimeNanos are not labeled.
+	TimeLabel string
+
+	// FoldedLocations selects whether locations that differ only in
+	// IsFolded are merged together, and which IsFolded the merged
+	// location keeps. By default they are kept distinct.
+	FoldedLocations FoldedMerge
+
+	// ColumnScale holds, for each profile being merged by position, the
+	// factors its values are multiplied by before being added, by the
+	// index of their sample type in the merged profile. Together with
+	// UnitAliases, this allows merging profiles that measure a sample
+	// type in different units, such as bytes and kilobytes. Scaled
+	// values are truncated to integers.
+	ColumnScale []map[int]float64
+
+	// StartLineWildcard makes functions with an unknown, zero, start
+	// line merge with the functions that only differ from them by
+	// their start line, keeping the known start line. This avoids
+	// splitting functions when only some profiles have start lines.
+	StartLineWildcard bool
+
+	// LineWildcard makes locations without line numbers, as in profiles
+	// only symbolized to functions, merge with the locations that only
+	// differ from them by their line numbers, keeping the known line
+	// numbers. If several such locations have different line numbers,
+	// as with SymbolicOnly, locations without line numbers merge with
+	// the first one. This avoids splitting the values of a location when
+	// only some profiles have line numbers. Their functions must merge,
+	// which may require StartLineWildcard. It is ignored with a
+	// LocationKeyFunc.
+	LineWildcard bool
+
+	// AlignSampleTypes selects how the values of profiles with
+	// different sample types are matched. By default, profiles must
+	// have the same sample types in the same order, unless
+	// PermuteSampleTypes is set, and values are matched by position.
+	// Otherwise, profiles only need the same period type, which
+	// supersedes PermuteSampleTypes, and values are matched by sample
+	// type and unit, after applying aliases.
+	AlignSampleTypes SampleTypeAlignment
+
+	// ReportUnmatched makes Merge report in Stats, for each profile,
+	// the fraction of its value of the default sample type in call
+	// stacks not found in the other profile, regardless of labels. A
+	// large fraction shows that the profiles don't describe the same
+	// workload, and are unlikely to be meaningfully compared. It
+	// requires merging exactly two profiles.
+	ReportUnmatched bool
+
+	// CanonicalMappings are the mappings the mappings of the profiles
+	// are merged into, when they match, instead of the first matching
+	// mapping seen. A mapping matches a canonical mapping if they have
+	// the same key: by default, the same build ID, or file name if they
+	// have no build ID, after applying MappingAliases, as well as the
+	// same offset and size rounded to pages; or the same key returned
+	// by MappingKeyFunc. The addresses of locations are shifted to the
+	// start of the canonical mapping. Other mappings are merged as
+	// usual. The first canonical mapping is the main binary of the
+	// merged profile, and the other canonical mappings are dropped if
+	// unused. The canonical mappings themselves are not modified.
+	CanonicalMappings []*Mapping
+
+	// TrackVariance makes Merge compute the variance across profiles of
+	// the values of each merged sample, returned by Variance.
+	TrackVariance bool
+
+	// RequireSameDefault makes Merge fail if profiles have different
+	// nonempty DefaultSampleTypes, instead of keeping the first one.
+	RequireSameDefault bool
+
+	// IgnoreLabelsForKey lists string and numeric label keys that don't
+	// distinguish samples: samples differing only in the values of these
+	// labels are merged together. The merged sample keeps the labels of
+	// the first of them seen, so the values of these labels remain
+	// visible, as representatives of the merged samples.
+	IgnoreLabelsForKey []string
+
+	// SourceWeight, if set, is called with each profile being merged to
+	// get the weight its values are multiplied by before being added,
+	// such as one derived from its comments, so that profiles can be
+	// weighted by their metadata. Weights apply on top of ColumnScale,
+	// and weighted values are truncated to integers. Merge returns an
+	// error if a weight is negative, infinite or NaN.
+	SourceWeight func(*Profile) float64
+
+	// FunctionUnify maps function names to canonical ones, so that
+	// functions known to be the same logical function under different
+	// names, such as a VM frame and the native frame implementing it,
+	// are merged together. Functions with a name in FunctionUnify, or
+	// with one of its canonical names, are identified by their
+	// canonical name alone. The merged function has the canonical name
+	// and keeps the other fields of the first function seen.
+	FunctionUnify map[string]string
+
+	// Whether to keep samples with only zero values, set by MergeDiffs.
+	keepZeroSamples bool
+
+	// Offsets added to the TimeNanos of profiles, by position, set by
+	// MergeWithOffsets.
+	timeOffsets []int64
+
+	// Caps set with PerLabelCap.
+	labelCaps map[string]int64
+
+	// Labels collected by source label key, set with KeepExemplars and
+	// CollectLabel.
+	collected map[string]collectedLabel
+
+	// Positions in the profiles passed to Merge of the profiles being
+	// merged, when some of them are skipped.
+	sources []int
+
+	// Statistics of the last merge.
+	stats MergeStats
+
+	// Variance profile of the last merge, with TrackVariance.
+	variance *Profile
+
+	// Profile returned by the last merge, for DeltaSince.
+	merged *Profile
+}
+
+// FoldedMerge is the policy of a ProfileMerger for locations that differ
+// only in IsFolded. As IsFolded only affects how locations are
+// presented, merging such locations avoids splitting the values of a
+// single frame between two locations.
+type FoldedMerge int
+
+const (
+	// KeepFoldedDistinct keeps locations that differ in IsFolded
+	// distinct, so each of them keeps its own values.
+	KeepFoldedDistinct FoldedMerge = iota
+	// PreferUnfolded merges locations that differ in IsFolded into an
+	// unfolded location.
+	PreferUnfolded
+	// PreferFolded merges locations that differ in IsFolded into a
+	// folded location.
+	PreferFolded
+)
+
+// SampleTypeAlignment is the policy of a ProfileMerger for matching the
+// values of profiles by sample type.
+type SampleTypeAlignment int
+
+const (
+	// AlignByPosition matches values by the position of their sample
+	// types, which must be the same in all profiles.
+	AlignByPosition SampleTypeAlignment = iota
+	// AlignUnion keeps all the sample types of any profile: those of
+	// the first profile in order, followed by the other ones in the
+	// order they are first found in the following profiles. Values of
+	// sample types missing from a profile are zero. A sample type
+	// repeated in a profile is matched to the first unmatched equal
+	// sample type in the merged profile, and so added once per
+	// repetition not already present.
+	AlignUnion
+	// AlignIntersection keeps the sample types of the first profile
+	// also found in all the other profiles, in order, dropping the
+	// values of other sample types. It is an error if no sample type
+	// is found in all profiles. DefaultSampleType is cleared if it is
+	// dropped.
+	AlignIntersection
+)
+
+// MergeStats reports what a ProfileMerger did in its last merge.
+type MergeStats struct {
+	// UnitDrift lists the sample and period types of the profiles
+	// skipped because of SkipUnitDrift.
+	UnitDrift []UnitDrift
+	// DuplicateSources lists the indices of the profiles skipped
+	// because of DedupSources.
+	DuplicateSources []int
+	// Unmatched holds the fractions reported because of
+	// ReportUnmatched, for each of the two profiles merged.
+	Unmatched []float64
+}
+
+// UnitDrift describes a sample or period type of a profile with the
+// same type as in the first profile being merged, but a different unit.
+type UnitDrift struct {
+	// Source is the index of the profile among those being merged.
+	Source int
+	// Index is the position of the sample type, or -1 for the period
+	// type.
+	Index int
+	// Type is the common type, Unit the unit in the profile and
+	// WantUnit the unit in the first profile.
+	Type, Unit, WantUnit string
+}
+
+// Variance returns a profile with a sample for each distinct sample of
+// the profiles merged by the last merge done by pm with TrackVariance,
+// valued with the population variance of the values each profile
+// contributed to it, rounded to integers. Profiles without a sample
+// count as contributing zero. The units of its sample types are the
+// squares of the original ones, suffixed with "^2". Returns nil if
+// TrackVariance wasn't set.
+func (pm *ProfileMerger) Variance() *Profile {
+	return pm.variance
+}
+
+// Stats returns the statistics of the last merge done by pm.
+func (pm *ProfileMerger) Stats() MergeStats {
+	return pm.stats
+}
+
+// PerLabelCap limits the value that samples sharing a value of the label
+// key can contribute to the merged profile, so that no single value of
+// the label (a tenant, say) dominates it. The cap applies to each sample
+// type separately: once the samples with a given value of key have
+// contributed max to a sample type, further values of that type from
+// samples with that label value are dropped, in the order the samples
+// are merged. Samples are capped on the first value of their label key,
+// and samples without it are not capped. Samples left with only zero
+// values are removed from the merged profile.
+func (pm *ProfileMerger) PerLabelCap(key string, max int64) {
+	if pm.labelCaps == nil {
+		pm.labelCaps = make(map[string]int64)
+	}
+	pm.labelCaps[key] = max
+}
+
+// KeepExemplars makes samples that only differ in the values of the
+// label key, such as trace IDs, be merged together, keeping up to max
+// distinct values of the label from the samples merged into each
+// sample, in the order they are seen, as exemplars of the merged
+// sample. It is the same as CollectLabel(key, key, max).
+func (pm *ProfileMerger) KeepExemplars(key string, max int) {
+	pm.CollectLabel(key, key, max)
+}
+
+// CollectLabel moves the values of the label key, such as unique trace
+// links, out of the identity of samples into the label destKey of the
+// merged samples: samples that only differ in the values of key or
+// destKey are merged together, and the merged sample has, under
+// destKey, the distinct values of both labels from the samples merged
+// into it, in the order they are seen, and no label key. At most max
+// values are collected for each merged sample; further values are
+// dropped, so a merged sample only links to the first samples merged
+// into it. Collecting into destKey of the values already collected
+// there lets merged profiles be merged again.
+func (pm *ProfileMerger) CollectLabel(key, destKey string, max int) {
+	if pm.collected == nil {
+		pm.collected = make(map[string]collectedLabel)
+	}
+	pm.collected[key] = collectedLabel{destKey, max}
+}
+
+// collectedLabel is the destination label key and maximum number of
+// values of a label collected with CollectLabel.
+type collectedLabel struct {
+	destKey string
+	max     int
+}
+
+// Merge merges all the profiles in srcs into a single Profile as
+// described for the package level Merge, honoring the options set on
+// pm.
+func (pm *ProfileMerger) Merge(srcs []*Profile) (*Profile, error) {
+	pm.stats = MergeStats{}
+	pm.sources = nil
+	pm.variance = nil
+	pm.merged = nil
+	if len(pm.ColumnScale) > 0 {
+		if pm.AlignSampleTypes == AlignIntersection {
+			return nil, fmt.Errorf("column scales can't be used with the intersection of sample types")
+		}
+		if err := pm.checkColumnScale(srcs); err != nil {
+			return nil, err
+		}
+	}
+	if pm.SkipUnitDrift || pm.DedupSources {
+		srcs, pm.sources = pm.filterSources(srcs)
+	}
+	if pm.ReportUnmatched && len(srcs) != 2 {
+		return nil, fmt.Errorf("reporting unmatched samples requires 2 profiles, got %d", len(srcs))
+	}
+	p, err := pm.merge(srcs, pm.InputsCompacted)
+	if err != nil {
+		return nil, err
+	}
+	pm.merged = p
+	return p, nil
+}
+
+// changesIdentity returns whether the options of pm change which
+// samples, locations, functions or mappings are merged together.
+func (pm *ProfileMerger) changesIdentity() bool {
+	return len(pm.IgnoreLabelsForKey) > 0 || len(pm.collected) > 0 ||
+		pm.SymbolicOnly || pm.LocationKeyFunc != nil ||
+		len(pm.MappingAliases) > 0 || pm.MappingKeyFunc != nil ||
+		pm.LineWildcard || pm.StartLineWildcard ||
+		pm.FoldedLocations != KeepFoldedDistinct || len(pm.FunctionUnify) > 0
+}
+
+// DeltaSince returns a profile holding the differences between the
+// profile returned by the last successful merge done by pm, in its
+// current state, and prev, such as a previously emitted snapshot of a
+// merged profile. Merging prev with the delta yields the merged
+// profile, except for samples with only zero values. prev isn't
+// modified. Returns an error if pm hasn't merged profiles, or if prev
+// can't be merged with them.
+func (pm *ProfileMerger) DeltaSince(prev *Profile) (*Profile, error) {
+	if pm.merged == nil {
+		return nil, fmt.Errorf("no merged profile")
+	}
+	neg := prev.Copy()
+	neg.Scale(-1)
+	return Merge([]*Profile{pm.merged, neg})
+}
+
+// sourceIndex returns the position in the profiles passed to Merge of
+// the profile at position i of those being merged.
+func (pm *ProfileMerger) sourceIndex(i int) int {
+	if pm.sources == nil {
+		return i
+	}
+	return pm.sources[i]
+}
+
+// columnScale returns the factors of ColumnScale for the profile at
+// position i of those being merged, or nil if it has none.
+func (pm *ProfileMerger) columnScale(i int) map[int]float64 {
+	if j := pm.sourceIndex(i); j < len(pm.ColumnScale) && len(pm.ColumnScale[j]) > 0 {
+		return pm.ColumnScale[j]
+	}
+	return nil
+}
+
+// checkColumnScale returns an error if pm.ColumnScale has more entries
+// than srcs or refers to sample types not in the first profile of srcs,
+// or has invalid factors.
+func (pm *ProfileMerger) checkColumnScale(srcs []*Profile) error {
+	if len(pm.ColumnScale) > len(srcs) {
+		return fmt.Errorf("column scales for %d profiles, merging %d", len(pm.ColumnScale), len(srcs))
+	}
+	for i, scale := range pm.ColumnScale {
+		for idx, f := range scale {
+			if err := srcs[0].checkSampleIndex(idx); err != nil {
+				return fmt.Errorf("column scale for profile %d: %v", i, err)
+			}
+			if math.IsNaN(f) || math.IsInf(f, 0) {
+				return fmt.Errorf("column scale for profile %d: invalid factor %v", i, f)
+			}
+		}
+	}
+	return nil
+}
+
+// filterSources returns the profiles of srcs except those skipped
+// because of SkipUnitDrift or DedupSources, which are recorded in
+// pm.stats, and their positions in srcs.
+func (pm *ProfileMerger) filterSources(srcs []*Profile) ([]*Profile, []int) {
+	if len(srcs) == 0 {
+		return srcs, nil
+	}
+	var seen map[[sha256.Size]byte]bool
+	if pm.DedupSources {
+		seen = map[[sha256.Size]byte]bool{contentHash(srcs[0]): true}
+	}
+	kept, indices := srcs[:1:1], []int{0}
+	for i, src := range srcs[1:] {
+		if pm.SkipUnitDrift {
+			if drifts := pm.unitDrift(srcs[0], src); len(drifts) > 0 {
+				for j := range drifts {
+					drifts[j].Source = i + 1
+				}
+				pm.stats.UnitDrift = append(pm.stats.UnitDrift, drifts...)
+				continue
+			}
+		}
+		if pm.DedupSources {
+			h := contentHash(src)
+			if seen[h] {
+				pm.stats.DuplicateSources = append(pm.stats.DuplicateSources, i+1)
+				continue
+			}
+			seen[h] = true
+		}
+		kept = append(kept, src)
+		indices = append(indices, i+1)
+	}
+	return kept, indices
+}
+
+// contentHash returns a hash of the full contents of p, including its
+// headers, samples and their values.
+func contentHash(p *Profile) [sha256.Size]byte {
+	return sha256.Sum256([]byte(p.String()))
+}
+
+// unitDrift returns the differences between the headers of a and b if
+// all of them are sample or period types with the same type but a
+// different unit, and nil otherwise.
+func (pm *ProfileMerger) unitDrift(a, b *Profile) []UnitDrift {
+	ca, cb := pm.canonicalHeader(a), pm.canonicalHeader(b)
+	var drifts []UnitDrift
+	for _, d := range ca.Diff(cb) {
+		var va, vb *ValueType
+		switch d.Kind {
+		case PeriodTypeMismatch:
+			va, vb = a.PeriodType, b.PeriodType
+		case SampleTypeMismatch:
+			va, vb = a.SampleType[d.Index], b.SampleType[d.Index]
+		default:
+			return nil
+		}
+		if pm.canonicalValueType(va).Type != pm.canonicalValueType(vb).Type {
+			return nil
+		}
+		drifts = append(drifts, UnitDrift{
+			Index:    d.Index,
+			Type:     va.Type,
+			Unit:     vb.Unit,
+			WantUnit: va.Unit,
+		})
+	}
+	return drifts
+}
+
+func (pm *ProfileMerger) merge(srcs []*Profile, compacted bool) (*Profile, error) {
+	if len(srcs) == 0 {
+		return nil, fmt.Errorf("no profiles to merge")
+	}
+	p, err := pm.combineHeaders(srcs)
+	if err != nil {
+		return nil, err
+	}
+
+	merger := &profileMerger{
 		p:         p,
 		samples:   make(map[sampleKey]*Sample, len(srcs[0].Sample)),
 		locations: make(map[locationKey]*Location, len(srcs[0].Location)),
 		functions: make(map[functionKey]*Function, len(srcs[0].Function)),
 		mappings:  make(map[mappingKey]*Mapping, len(srcs[0].Mapping)),
+		opts:      pm,
+		unkeyed:   compacted && !pm.changesIdentity(),
 	}
 
-	for _, src := range srcs {
+	for _, m := range pm.CanonicalMappings {
+		if mk := merger.mappingKey(m); merger.mappings[mk] == nil {
+			merger.addMapping(mk, m)
+		}
+	}
+
+	if pm.TrackVariance {
+		merger.contributions = make(map[*Sample][]int64)
+		merger.sumSquares = make(map[*Sample][]float64)
+	}
+
+	var stacks []map[string]int64
+	if pm.ReportUnmatched {
+		if merger.stackIdx, err = p.SampleIndexByName(""); err != nil {
+			return nil, err
+		}
+		if merger.stackIdx < 0 {
+			return nil, fmt.Errorf("reporting unmatched samples requires sample types")
+		}
+	}
+
+	for i, src := range srcs {
+		if i > 0 && merger.unkeyed {
+			// Entities from the first source must now be matched
+			// against those of the following sources.
+			if !merger.index() {
+				return pm.merge(srcs, false)
+			}
+		}
+
 		// Clear the profile-specific hash tables
-		pm.locationsByID = make(map[uint64]*Location, len(src.Location))
-		pm.functionsByID = make(map[uint64]*Function, len(src.Function))
-		pm.mappingsByID = make(map[uint64]mapInfo, len(src.Mapping))
+		merger.locationsByID = make(map[uint64]*Location, len(src.Location))
+		merger.functionsByID = make(map[uint64]*Function, len(src.Function))
+		merger.mappingsByID = make(map[uint64]mapInfo, len(src.Mapping))
+		merger.timeNanos = src.TimeNanos
+		merger.scale = pm.columnScale(i)
+		if pm.SourceWeight != nil {
+			w := pm.SourceWeight(src)
+			if math.IsNaN(w) || math.IsInf(w, 0) || w < 0 {
+				return nil, fmt.Errorf("source weight for profile %d: invalid weight %v", pm.sourceIndex(i), w)
+			}
+			merger.scale = weightScale(merger.scale, w, len(p.SampleType))
+		}
+		if pm.ReportUnmatched {
+			merger.stacks = make(map[string]int64)
+			stacks = append(stacks, merger.stacks)
+		}
+		merger.columns = nil
+		if pm.AlignSampleTypes != AlignByPosition {
+			merger.columns = pm.sampleTypeColumns(p.SampleType, src)
+		} else if pm.PermuteSampleTypes {
+			merger.columns = pm.sampleTypePermutation(srcs[0], src)
+		}
 
-		if len(pm.mappings) == 0 && len(src.Mapping) > 0 {
+		if len(merger.mappings) == 0 && len(src.Mapping) > 0 {
 			// The Mapping list has the property that the first mapping
 			// represents the main binary. Take the first Mapping we see,
 			// otherwise the operations below will add mappings in an
 			// arbitrary order.
-			pm.mapMapping(src.Mapping[0])
+			merger.mapMapping(src.Mapping[0])
 		}
 
 		for _, s := range src.Sample {
-			if !isZeroSample(s) {
-				pm.mapSample(s)
+			if compacted || pm.keepZeroSamples || !isZeroSample(s) {
+				merger.mapSample(s)
 			}
 		}
+		if pm.TrackVariance {
+			merger.foldVariance()
+		}
+	}
+
+	if pm.TrackVariance {
+		if pm.variance, err = merger.varianceProfile(len(srcs)); err != nil {
+			return nil, err
+		}
+	}
+
+	if pm.ReportUnmatched {
+		pm.stats.Unmatched = unmatchedFractions(stacks)
 	}
 
 	for _, s := range p.Sample {
-		if isZeroSample(s) {
+		if !pm.keepZeroSamples && isZeroSample(s) {
 			// If there are any zero samples, re-merge the profile to GC
 			// them.
 			return Merge([]*Profile{p})
 		}
 	}
+	if (pm.SymbolicOnly || len(pm.CanonicalMappings) > 0) && hasUnusedMappings(p) {
+		// Mappings of locations merged into locations of other
+		// mappings, or canonical mappings, may be left unused.
+		// Re-merge to GC them.
+		return Merge([]*Profile{p})
+	}
 
 	return p, nil
 }
 
+func (a sampleKey) less(b sampleKey) bool {
+	if a.locations != b.locations {
+		return a.locations < b.locations
+	}
+	if a.labels != b.labels {
+		return a.labels < b.labels
+	}
+	return a.numlabels < b.numlabels
+}
+
+func addValues(dst, src *Sample) {
+	for i, v := range src.Value {
+		dst.Value[i] += v
+	}
+}
+
+// otherFrame is the name of the frame standing for the samples folded by
+// MergeCapped.
+const otherFrame = "<other>"
+
+// MergeCapped merges srcs like Merge, but only merges the maxPerSource
+// samples of each profile with the highest values of its default sample
+// type, bounding the size and influence of profiles with very diverse
+// samples. The remaining samples of each profile are folded into a
+// single sample, without labels, whose only frame is "<other>". As
+// these samples have the same stack in all profiles, they are merged
+// together, so the merged profile has at most one "<other>" sample
+// adding up the samples left out of every profile.
+func MergeCapped(srcs []*Profile, maxPerSource int) (*Profile, error) {
+	if maxPerSource < 0 {
+		return nil, fmt.Errorf("negative number of samples per profile %d", maxPerSource)
+	}
+	capped := make([]*Profile, len(srcs))
+	for i, src := range srcs {
+		capped[i] = src.capSamples(maxPerSource)
+	}
+	return Merge(capped)
+}
+
+// capSamples returns a shallow copy of p holding, in their original
+// order, its max samples with the highest values of the default sample
+// type, and a sample adding up the others if there are more than max.
+func (p *Profile) capSamples(max int) *Profile {
+	if len(p.Sample) <= max {
+		return p
+	}
+	idx, err := p.SampleIndexByName("")
+	if err != nil || idx < 0 {
+		return p
+	}
+	samples := make([]*Sample, len(p.Sample))
+	copy(samples, p.Sample)
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Value[idx] > samples[j].Value[idx]
+	})
+	top := make(map[*Sample]bool, max)
+	for _, s := range samples[:max] {
+		top[s] = true
+	}
+	other := p.syntheticLocation(otherFrame)
+	rest := &Sample{
+		Location: []*Location{other},
+		Value:    make([]int64, len(p.SampleType)),
+	}
+	kept := make([]*Sample, 0, max+1)
+	for _, s := range p.Sample {
+		if top[s] {
+			kept = append(kept, s)
+		} else {
+			addValues(rest, s)
+		}
+	}
+	return &Profile{
+		SampleType:        p.SampleType,
+		DefaultSampleType: p.DefaultSampleType,
+		Sample:            append(kept, rest),
+		Mapping:           p.Mapping,
+		Location:          append(p.Location[:len(p.Location):len(p.Location)], other),
+		Function:          append(p.Function[:len(p.Function):len(p.Function)], other.Line[0].Function),
+		Comments:          p.Comments,
+		DropFrames:        p.DropFrames,
+		KeepFrames:        p.KeepFrames,
+		TimeNanos:         p.TimeNanos,
+		DurationNanos:     p.DurationNanos,
+		PeriodType:        p.PeriodType,
+		Period:            p.Period,
+	}
+}
+
+// hasUnusedMappings returns whether p has mappings not used by any
+// location, other than the main binary.
+func hasUnusedMappings(p *Profile) bool {
+	if len(p.Mapping) < 2 {
+		return false
+	}
+	used := map[*Mapping]bool{p.Mapping[0]: true}
+	for _, l := range p.Location {
+		if l.Mapping != nil {
+			used[l.Mapping] = true
+		}
+	}
+	return len(used) < len(p.Mapping)
+}
+
+// DistinctStacks returns the number of distinct nonzero samples in p,
+// using the same notion of identity as Merge. This is the number of
+// samples in p.Compact(), except for samples that add up to zero.
+func (p *Profile) DistinctStacks() int {
+	return DistinctStacksAcross([]*Profile{p})
+}
+
+// DistinctStacksAcross returns the number of distinct nonzero samples
+// in the union of srcs, using the same notion of identity as Merge.
+// This is an upper bound of the number of samples in the result of
+// merging srcs, which will be lower only if some samples add up to
+// zero. It can be used to predict the size of a merge before doing it.
+func DistinctStacksAcross(srcs []*Profile) int {
+	merger := &profileMerger{
+		p:         &Profile{},
+		locations: make(map[locationKey]*Location),
+		functions: make(map[functionKey]*Function),
+		mappings:  make(map[mappingKey]*Mapping),
+		opts:      &ProfileMerger{},
+	}
+	keys := make(map[sampleKey]bool)
+	for _, src := range srcs {
+		merger.locationsByID = make(map[uint64]*Location, len(src.Location))
+		merger.functionsByID = make(map[uint64]*Function, len(src.Function))
+		merger.mappingsByID = make(map[uint64]mapInfo, len(src.Mapping))
+		for _, s := range src.Sample {
+			if isZeroSample(s) {
+				continue
+			}
+			ms := &Sample{
+				Location: make([]*Location, len(s.Location)),
+				Label:    s.Label,
+				NumLabel: s.NumLabel,
+				NumUnit:  s.NumUnit,
+			}
+			for i, l := range s.Location {
+				ms.Location[i] = merger.mapLocation(l)
+			}
+			keys[ms.key()] = true
+		}
+	}
+	return len(keys)
+}
+
 // Normalize normalizes the source profile by multiplying each value in profile by the
 // ratio of the sum of the base profile's values of that sample type to the sum of the
 // source profile's value of that sample type.
@@ -120,6 +1238,88 @@ func (p *Profile) Normalize(pb *Profile) error {
 	return nil
 }
 
+// NormalizeAll normalizes each of profs against base as Normalize does,
+// bringing all of them to the same scale. The compatibility of every
+// profile with base is checked first, and no profile is modified if any
+// of them is incompatible.
+func NormalizeAll(profs []*Profile, base *Profile) error {
+	for i, p := range profs {
+		if err := p.compatible(base); err != nil {
+			return fmt.Errorf("profile %d: %v", i, err)
+		}
+	}
+	for _, p := range profs {
+		if err := p.Normalize(base); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScaleToTotal scales the values of the sample type at idx so that
+// they add up to total. This can be used to restore absolute values
+// after Normalize. Returns an error if the values at idx add up to
+// zero, as they can't be scaled.
+func (p *Profile) ScaleToTotal(idx int, total int64) error {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return err
+	}
+	var sum int64
+	for _, s := range p.Sample {
+		sum += s.Value[idx]
+	}
+	if sum == 0 {
+		return fmt.Errorf("cannot scale %s values adding up to zero", p.SampleType[idx].Type)
+	}
+	ratios := make([]float64, len(p.SampleType))
+	for i := range ratios {
+		ratios[i] = 1
+	}
+	ratios[idx] = float64(total) / float64(sum)
+	return p.ScaleN(ratios)
+}
+
+// weightScale returns the factors of scale, by sample type, multiplied
+// by weight, for n sample types. Sample types missing from scale have a
+// factor of 1.
+func weightScale(scale map[int]float64, weight float64, n int) map[int]float64 {
+	if weight == 1 {
+		return scale
+	}
+	weighted := make(map[int]float64, n)
+	for i := 0; i < n; i++ {
+		f, ok := scale[i]
+		if !ok {
+			f = 1
+		}
+		weighted[i] = f * weight
+	}
+	return weighted
+}
+
+// unmatchedFractions returns, for each of the values by stack in
+// stacks, the fraction of their total in stacks missing from the other
+// ones.
+func unmatchedFractions(stacks []map[string]int64) []float64 {
+	fractions := make([]float64, len(stacks))
+	for i, values := range stacks {
+		var total, unmatched int64
+		for stack, v := range values {
+			total += v
+			for j, other := range stacks {
+				if _, ok := other[stack]; !ok && j != i {
+					unmatched += v
+					break
+				}
+			}
+		}
+		if total != 0 {
+			fractions[i] = float64(unmatched) / float64(total)
+		}
+	}
+	return fractions
+}
+
 func isZeroSample(s *Sample) bool {
 	for _, v := range s.Value {
 		if v != 0 {
@@ -129,21 +1329,194 @@ func isZeroSample(s *Sample) bool {
 	return true
 }
 
-type profileMerger struct {
-	p *Profile
-
-	// Memoization tables within a profile.
-	locationsByID map[uint64]*Location
-	functionsByID map[uint64]*Function
-	mappingsByID  map[uint64]mapInfo
-
-	// Memoization tables for profile entities.
-	samples   map[sampleKey]*Sample
-	locations map[locationKey]*Location
-	functions map[functionKey]*Function
-	mappings  map[mappingKey]*Mapping
-}
-
+// dropZeroSamples removes the samples of p whose values are all zero.
+func (p *Profile) dropZeroSamples() {
+	samples := p.Sample[:0]
+	for _, s := range p.Sample {
+		if !isZeroSample(s) {
+			samples = append(samples, s)
+		}
+	}
+	p.Sample = samples
+}
+
+// GroupBy returns a copy of p with its samples aggregated by the key
+// returned by keyFn instead of by call stack and labels. Each group is
+// represented by a copy of its first sample in p, keeping its call
+// stack and labels, with the values of all the samples in the group
+// added up. Groups whose values add up to zero are dropped.
+func (p *Profile) GroupBy(keyFn func(*Sample) string) *Profile {
+	g := p.Copy()
+	groups := make(map[string]*Sample)
+	samples := g.Sample[:0]
+	for _, s := range g.Sample {
+		k := keyFn(s)
+		if rep, ok := groups[k]; ok {
+			addValues(rep, s)
+			continue
+		}
+		groups[k] = s
+		samples = append(samples, s)
+	}
+	g.Sample = samples
+	g.dropZeroSamples()
+	g.removeUnused()
+	return g
+}
+
+// removeUnused removes the locations not used by any sample, and the
+// functions and mappings not used by any remaining location, keeping the
+// main binary mapping. Unlike Compact, it doesn't merge samples.
+func (p *Profile) removeUnused() {
+	usedLocations := make(map[*Location]bool)
+	for _, s := range p.Sample {
+		for _, l := range s.Location {
+			usedLocations[l] = true
+		}
+	}
+	usedFunctions := make(map[*Function]bool)
+	usedMappings := make(map[*Mapping]bool)
+	if len(p.Mapping) > 0 {
+		usedMappings[p.Mapping[0]] = true
+	}
+	locations := p.Location[:0]
+	for _, l := range p.Location {
+		if !usedLocations[l] {
+			continue
+		}
+		locations = append(locations, l)
+		usedMappings[l.Mapping] = true
+		for _, ln := range l.Line {
+			usedFunctions[ln.Function] = true
+		}
+	}
+	p.Location = locations
+	functions := p.Function[:0]
+	for _, f := range p.Function {
+		if usedFunctions[f] {
+			functions = append(functions, f)
+		}
+	}
+	p.Function = functions
+	mappings := p.Mapping[:0]
+	for _, m := range p.Mapping {
+		if usedMappings[m] {
+			mappings = append(mappings, m)
+		}
+	}
+	p.Mapping = mappings
+}
+
+type profileMerger struct {
+	p    *Profile
+	opts *ProfileMerger
+
+	// Memoization tables within a profile.
+	locationsByID map[uint64]*Location
+	functionsByID map[uint64]*Function
+	mappingsByID  map[uint64]mapInfo
+
+	// Memoization tables for profile entities. samples is nil when
+	// samples are combined by the caller instead, as in
+	// DistinctStacksAcross.
+	samples   map[sampleKey]*Sample
+	locations map[locationKey]*Location
+	functions map[functionKey]*Function
+	mappings  map[mappingKey]*Mapping
+
+	// baseSamples, baseLocations, baseFunctions and baseMappings are
+	// read-only tables looked up after the ones above miss, as by
+	// BaseMerger, which merges onto its base without copying its tables.
+	// Entities added during the merge are only recorded in the tables
+	// above, which shadow these.
+	baseSamples   map[sampleKey]*Sample
+	baseLocations map[locationKey]*Location
+	baseFunctions map[functionKey]*Function
+	baseMappings  map[mappingKey]*Mapping
+
+	// Value contributed so far by each value of each capped label, per
+	// sample type.
+	capped map[string]map[string][]int64
+
+	// scale holds the factors applied to the values of the source being
+	// merged, by sample type.
+	scale map[int]float64
+
+	// timeNanos is the TimeNanos of the source being merged.
+	timeNanos int64
+
+	// contributions holds, for TrackVariance, the values the source
+	// being merged added to each merged sample, and sumSquares the sums
+	// of their squares for all sources merged so far.
+	contributions map[*Sample][]int64
+	sumSquares    map[*Sample][]float64
+
+	// stacks accumulates, for ReportUnmatched, the absolute values of
+	// the sample type at stackIdx of the source being merged by merged
+	// call stack.
+	stacks   map[string]int64
+	stackIdx int
+
+	// anyStartLine holds the first function recorded for each key with
+	// the start line cleared, for StartLineWildcard.
+	anyStartLine map[functionKey]*Function
+
+	// anyLine holds the first location recorded for each key with the
+	// line numbers cleared, for LineWildcard.
+	anyLine map[locationKey]*Location
+
+	// canonicalNames holds the canonical names of FunctionUnify, built
+	// on first use.
+	canonicalNames map[string]bool
+
+	// columns holds, for each sample type of the merged profile, the
+	// index of the matching sample type of the source being merged, or
+	// -1 if it has none, when they are not the same.
+	columns []int
+
+	// sharedSamples and sharedMappings hold the samples and mappings of
+	// the merged profile shared with another profile, as by BaseMerger,
+	// which must not be modified. sharedSamples holds their index in the
+	// merged samples, where they are replaced by copies before their
+	// values are changed.
+	sharedSamples  map[*Sample]int
+	sharedMappings map[*Mapping]bool
+
+	// unkeyed is set while samples, locations and functions are added
+	// without being recorded in their memoization tables, which is only
+	// correct for a source known to have no duplicates.
+	unkeyed bool
+}
+
+// index records all the samples, locations and functions of the merged
+// profile in the memoization tables and clears pm.unkeyed. Returns
+// false if any two of them have the same key.
+func (pm *profileMerger) index() bool {
+	pm.unkeyed = false
+	for _, f := range pm.p.Function {
+		k := pm.functionKey(f)
+		if _, ok := pm.findFunction(k); ok {
+			return false
+		}
+		pm.recordFunction(k, f)
+	}
+	for _, l := range pm.p.Location {
+		k := pm.locationKey(l)
+		if _, ok := pm.findLocation(k, l); ok {
+			return false
+		}
+		pm.recordLocation(k, l)
+	}
+	for _, s := range pm.p.Sample {
+		k := pm.sampleKey(s)
+		if _, ok := pm.samples[k]; ok {
+			return false
+		}
+		pm.samples[k] = s
+	}
+	return true
+}
+
 type mapInfo struct {
 	m      *Mapping
 	offset int64
@@ -152,7 +1525,7 @@ type mapInfo struct {
 func (pm *profileMerger) mapSample(src *Sample) *Sample {
 	s := &Sample{
 		Location: make([]*Location, len(src.Location)),
-		Value:    make([]int64, len(src.Value)),
+		Value:    make([]int64, len(pm.p.SampleType)),
 		Label:    make(map[string][]string, len(src.Label)),
 		NumLabel: make(map[string][]int64, len(src.NumLabel)),
 		NumUnit:  make(map[string][]string, len(src.NumLabel)),
@@ -165,6 +1538,13 @@ func (pm *profileMerger) mapSample(src *Sample) *Sample {
 		copy(vv, v)
 		s.Label[k] = vv
 	}
+	if len(pm.opts.collected) > 0 {
+		for k, c := range pm.opts.collected {
+			delete(s.Label, k)
+			delete(s.Label, c.destKey)
+		}
+		pm.collectLabels(s, src.Label)
+	}
 	for k, v := range src.NumLabel {
 		u := src.NumUnit[k]
 		vv := make([]int64, len(v))
@@ -174,23 +1554,267 @@ func (pm *profileMerger) mapSample(src *Sample) *Sample {
 		s.NumLabel[k] = vv
 		s.NumUnit[k] = uu
 	}
+	if key := pm.opts.TimeLabel; key != "" && pm.timeNanos != 0 {
+		s.NumLabel[key] = []int64{pm.timeNanos}
+		s.NumUnit[key] = []string{"nanoseconds"}
+	}
+	values := src.Value
+	if pm.columns != nil {
+		values = make([]int64, len(pm.columns))
+		for i, j := range pm.columns {
+			if j >= 0 {
+				values[i] = src.Value[j]
+			}
+		}
+	}
+	if pm.scale != nil {
+		scaled := make([]int64, len(values))
+		copy(scaled, values)
+		for i, f := range pm.scale {
+			scaled[i] = scaleValue(scaled[i], f)
+		}
+		values = scaled
+	}
+	if len(pm.opts.labelCaps) > 0 {
+		values = pm.capValues(src, values)
+	}
+	copy(s.Value, values)
+	if pm.stacks != nil {
+		pm.stacks[s.key().locations] += abs64(values[pm.stackIdx])
+	}
+	if pm.unkeyed || pm.samples == nil {
+		pm.p.Sample = append(pm.p.Sample, s)
+		pm.contribute(s, values)
+		return s
+	}
 	// Check memoization table. Must be done on the remapped location to
 	// account for the remapped mapping. Add current values to the
 	// existing sample.
-	k := s.key()
-	if ss, ok := pm.samples[k]; ok {
-		for i, v := range src.Value {
+	k := pm.sampleKey(s)
+	ss, ok := pm.samples[k]
+	if !ok {
+		ss, ok = pm.baseSamples[k]
+	}
+	if ok {
+		if i, ok := pm.sharedSamples[ss]; ok {
+			ss = pm.unshare(k, ss, i)
+		}
+		for i, v := range values {
 			ss.Value[i] += v
 		}
+		pm.collectLabels(ss, s.Label)
+		pm.contribute(ss, values)
 		return ss
 	}
-	copy(s.Value, src.Value)
 	pm.samples[k] = s
 	pm.p.Sample = append(pm.p.Sample, s)
+	pm.contribute(s, values)
 	return s
 }
 
-// key generates sampleKey to be used as a key for maps.
+// unshare replaces the shared sample ss, at index i of the merged
+// samples and memoized as k, with a copy that can be modified.
+func (pm *profileMerger) unshare(k sampleKey, ss *Sample, i int) *Sample {
+	c := *ss
+	c.Value = append([]int64(nil), ss.Value...)
+	pm.p.Sample[i] = &c
+	pm.samples[k] = &c
+	return &c
+}
+
+// collectLabels adds to the merged sample s the values of the labels
+// collected with CollectLabel in labels, from both their source and
+// destination keys, that it doesn't have yet, up to their maximum.
+func (pm *profileMerger) collectLabels(s *Sample, labels map[string][]string) {
+	for k, c := range pm.opts.collected {
+		have := s.Label[c.destKey]
+		values := labels[c.destKey]
+		if k != c.destKey {
+			values = append(values[:len(values):len(values)], labels[k]...)
+		}
+	next:
+		for _, v := range values {
+			if len(have) >= c.max {
+				break
+			}
+			for _, h := range have {
+				if h == v {
+					continue next
+				}
+			}
+			have = append(have, v)
+		}
+		if len(have) > 0 {
+			s.Label[c.destKey] = have
+		}
+	}
+}
+
+// sampleKey returns the key identifying s in the merged profile,
+// ignoring the labels in IgnoreLabelsForKey and the labels collected
+// with CollectLabel.
+func (pm *profileMerger) sampleKey(s *Sample) sampleKey {
+	if len(pm.opts.IgnoreLabelsForKey) == 0 && len(pm.opts.collected) == 0 {
+		return s.key()
+	}
+	ks := &Sample{
+		Location: s.Location,
+		Label:    make(map[string][]string, len(s.Label)),
+		NumLabel: make(map[string][]int64, len(s.NumLabel)),
+		NumUnit:  make(map[string][]string, len(s.NumUnit)),
+	}
+	for k, v := range s.Label {
+		ks.Label[k] = v
+	}
+	for k, v := range s.NumLabel {
+		ks.NumLabel[k] = v
+	}
+	for k, v := range s.NumUnit {
+		ks.NumUnit[k] = v
+	}
+	for _, k := range pm.opts.IgnoreLabelsForKey {
+		delete(ks.Label, k)
+		delete(ks.NumLabel, k)
+		delete(ks.NumUnit, k)
+	}
+	for k, c := range pm.opts.collected {
+		delete(ks.Label, k)
+		delete(ks.Label, c.destKey)
+	}
+	return ks.key()
+}
+
+// contribute records, with TrackVariance, that the source being merged
+// added values to the merged sample s.
+func (pm *profileMerger) contribute(s *Sample, values []int64) {
+	if pm.contributions == nil {
+		return
+	}
+	c := pm.contributions[s]
+	if c == nil {
+		c = make([]int64, len(values))
+		pm.contributions[s] = c
+	}
+	for i, v := range values {
+		c[i] += v
+	}
+}
+
+// foldVariance adds the contributions of the source just merged to the
+// running sums used to compute variances, and clears them.
+func (pm *profileMerger) foldVariance() {
+	for s, c := range pm.contributions {
+		sq := pm.sumSquares[s]
+		if sq == nil {
+			sq = make([]float64, len(c))
+			pm.sumSquares[s] = sq
+		}
+		for i, v := range c {
+			sq[i] += float64(v) * float64(v)
+		}
+		delete(pm.contributions, s)
+	}
+}
+
+// varianceProfile returns a profile with the samples of the merged
+// profile, valued with the population variance of the values the n
+// merged profiles contributed to them.
+func (pm *profileMerger) varianceProfile(n int) (*Profile, error) {
+	p := pm.p
+	vp := &Profile{
+		SampleType:    make([]*ValueType, len(p.SampleType)),
+		Sample:        make([]*Sample, len(p.Sample)),
+		Mapping:       p.Mapping,
+		Location:      p.Location,
+		Function:      p.Function,
+		Comments:      p.Comments,
+		DropFrames:    p.DropFrames,
+		KeepFrames:    p.KeepFrames,
+		TimeNanos:     p.TimeNanos,
+		DurationNanos: p.DurationNanos,
+		PeriodType:    p.PeriodType,
+		Period:        p.Period,
+
+		DefaultSampleType: p.DefaultSampleType,
+	}
+	for i, st := range p.SampleType {
+		vp.SampleType[i] = &ValueType{Type: st.Type, Unit: st.Unit + "^2"}
+	}
+	for i, s := range p.Sample {
+		vs := &Sample{
+			Location: s.Location,
+			Value:    make([]int64, len(s.Value)),
+			Label:    s.Label,
+			NumLabel: s.NumLabel,
+			NumUnit:  s.NumUnit,
+		}
+		sq := pm.sumSquares[s]
+		for j, v := range s.Value {
+			mean := float64(v) / float64(n)
+			variance := sq[j]/float64(n) - mean*mean
+			if variance < 0 {
+				// Rounding errors.
+				variance = 0
+			}
+			vs.Value[j] = scaleValue(1, math.Round(variance))
+		}
+		vp.Sample[i] = vs
+	}
+	// Make the variance profile independent of the merged one, keeping
+	// the stacks with no variance.
+	return (&ProfileMerger{keepZeroSamples: true}).Merge([]*Profile{vp})
+}
+
+// capValues returns a copy of the values of src reduced so that the
+// total value contributed by each value of a capped label stays within
+// its cap.
+func (pm *profileMerger) capValues(src *Sample, srcValues []int64) []int64 {
+	values := make([]int64, len(srcValues))
+	copy(values, srcValues)
+	var contributed [][]int64
+	for key, max := range pm.opts.labelCaps {
+		lv := src.Label[key]
+		if len(lv) == 0 {
+			continue
+		}
+		totals := pm.cappedTotals(key, lv[0], len(values))
+		for i, v := range values {
+			if allowed := max - totals[i]; v > allowed {
+				values[i] = allowed
+			}
+		}
+		contributed = append(contributed, totals)
+	}
+	for _, totals := range contributed {
+		for i, v := range values {
+			totals[i] += v
+		}
+	}
+	return values
+}
+
+// cappedTotals returns the values contributed so far by samples with
+// value as the first value of their label key.
+func (pm *profileMerger) cappedTotals(key, value string, n int) []int64 {
+	if pm.capped == nil {
+		pm.capped = make(map[string]map[string][]int64)
+	}
+	byValue := pm.capped[key]
+	if byValue == nil {
+		byValue = make(map[string][]int64)
+		pm.capped[key] = byValue
+	}
+	totals := byValue[value]
+	if totals == nil {
+		totals = make([]int64, n)
+		byValue[value] = totals
+	}
+	return totals
+}
+
+// key generates sampleKey to be used as a key for maps. Labels are
+// encoded with length prefixes so that no choice of label keys and
+// values can make two distinct label sets produce the same key.
 func (sample *Sample) key() sampleKey {
 	ids := make([]string, len(sample.Location))
 	for i, l := range sample.Location {
@@ -199,13 +1823,30 @@ func (sample *Sample) key() sampleKey {
 
 	labels := make([]string, 0, len(sample.Label))
 	for k, v := range sample.Label {
-		labels = append(labels, fmt.Sprintf("%q%q", k, v))
+		buf := appendKeyString(nil, k)
+		buf = strconv.AppendInt(buf, int64(len(v)), 10)
+		for _, s := range v {
+			buf = appendKeyString(buf, s)
+		}
+		labels = append(labels, string(buf))
 	}
 	sort.Strings(labels)
 
 	numlabels := make([]string, 0, len(sample.NumLabel))
 	for k, v := range sample.NumLabel {
-		numlabels = append(numlabels, fmt.Sprintf("%q%x%x", k, v, sample.NumUnit[k]))
+		buf := appendKeyString(nil, k)
+		buf = strconv.AppendInt(buf, int64(len(v)), 10)
+		for _, n := range v {
+			buf = append(buf, ',')
+			buf = strconv.AppendInt(buf, n, 10)
+		}
+		units := sample.NumUnit[k]
+		buf = append(buf, ';')
+		buf = strconv.AppendInt(buf, int64(len(units)), 10)
+		for _, u := range units {
+			buf = appendKeyString(buf, u)
+		}
+		numlabels = append(numlabels, string(buf))
 	}
 	sort.Strings(numlabels)
 
@@ -216,6 +1857,15 @@ func (sample *Sample) key() sampleKey {
 	}
 }
 
+// appendKeyString appends s to buf preceded by its length, making the
+// encoding self-delimiting regardless of the contents of s.
+func appendKeyString(buf []byte, s string) []byte {
+	buf = append(buf, ':')
+	buf = strconv.AppendInt(buf, int64(len(s)), 10)
+	buf = append(buf, ':')
+	return append(buf, s...)
+}
+
 type sampleKey struct {
 	locations string
 	labels    string
@@ -243,19 +1893,107 @@ func (pm *profileMerger) mapLocation(src *Location) *Location {
 	for i, ln := range src.Line {
 		l.Line[i] = pm.mapLine(ln)
 	}
+	if pm.unkeyed {
+		pm.locationsByID[src.ID] = l
+		pm.p.Location = append(pm.p.Location, l)
+		return l
+	}
 	// Check memoization table. Must be done on the remapped location to
 	// account for the remapped mapping ID.
-	k := l.key()
-	if ll, ok := pm.locations[k]; ok {
+	k := pm.locationKey(l)
+	if ll, ok := pm.findLocation(k, l); ok {
+		switch pm.opts.FoldedLocations {
+		case PreferUnfolded:
+			ll.IsFolded = ll.IsFolded && l.IsFolded
+		case PreferFolded:
+			ll.IsFolded = ll.IsFolded || l.IsFolded
+		}
 		pm.locationsByID[src.ID] = ll
 		return ll
 	}
 	pm.locationsByID[src.ID] = l
-	pm.locations[k] = l
+	pm.recordLocation(k, l)
 	pm.p.Location = append(pm.p.Location, l)
 	return l
 }
 
+// findLocation returns the location of the merged profile with key k,
+// or with LineWildcard, a location differing from l only by its line
+// numbers when either has none. A location without line numbers found
+// for l takes the line numbers of l.
+func (pm *profileMerger) findLocation(k locationKey, l *Location) (*Location, bool) {
+	if ll, ok := pm.locations[k]; ok {
+		return ll, true
+	}
+	if ll, ok := pm.baseLocations[k]; ok {
+		return ll, true
+	}
+	if !pm.lineWildcard(l) {
+		return nil, false
+	}
+	wk := pm.anyLineKey(l)
+	if wk == k {
+		ll, ok := pm.anyLine[wk]
+		return ll, ok
+	}
+	if ll, ok := pm.locations[wk]; ok {
+		delete(pm.locations, wk)
+		ll.Line = l.Line
+		pm.locations[k] = ll
+		return ll, true
+	}
+	return nil, false
+}
+
+// recordLocation records l as the location of the merged profile with
+// key k.
+func (pm *profileMerger) recordLocation(k locationKey, l *Location) {
+	pm.locations[k] = l
+	if !pm.lineWildcard(l) {
+		return
+	}
+	wk := pm.anyLineKey(l)
+	if _, ok := pm.anyLine[wk]; !ok {
+		if pm.anyLine == nil {
+			pm.anyLine = make(map[locationKey]*Location)
+		}
+		pm.anyLine[wk] = l
+	}
+}
+
+// lineWildcard returns whether LineWildcard applies to l.
+func (pm *profileMerger) lineWildcard(l *Location) bool {
+	return pm.opts.LineWildcard && pm.opts.LocationKeyFunc == nil && len(l.Line) > 0
+}
+
+// anyLineKey returns the key of l with its line numbers cleared.
+func (pm *profileMerger) anyLineKey(l *Location) locationKey {
+	wl := *l
+	wl.Line = make([]Line, len(l.Line))
+	for i, ln := range l.Line {
+		wl.Line[i] = Line{Function: ln.Function}
+	}
+	return pm.locationKey(&wl)
+}
+
+// locationKey returns the key identifying l in the merged profile. With
+// SymbolicOnly, symbolized locations are identified by their lines
+// alone, and with a LocationKeyFunc by the key it returns. IsFolded is
+// ignored unless folded locations are kept distinct.
+func (pm *profileMerger) locationKey(l *Location) locationKey {
+	if pm.opts.LocationKeyFunc != nil {
+		return locationKey{custom: pm.opts.LocationKeyFunc(l)}
+	}
+	k := l.key()
+	if pm.opts.SymbolicOnly && len(l.Line) > 0 {
+		k.addr, k.mappingID = 0, 0
+	}
+	if pm.opts.FoldedLocations != KeepFoldedDistinct {
+		k.isFolded = false
+	}
+	return k
+}
+
 // key generates locationKey to be used as a key for maps.
 func (l *Location) key() locationKey {
 	key := locationKey{
@@ -282,6 +2020,7 @@ type locationKey struct {
 	addr, mappingID uint64
 	lines           string
 	isFolded        bool
+	custom          string
 }
 
 func (pm *profileMerger) mapMapping(src *Mapping) mapInfo {
@@ -294,12 +2033,31 @@ func (pm *profileMerger) mapMapping(src *Mapping) mapInfo {
 	}
 
 	// Check memoization tables.
-	mk := src.key()
-	if m, ok := pm.mappings[mk]; ok {
+	mk := pm.mappingKey(src)
+	m, ok := pm.mappings[mk]
+	if !ok {
+		m, ok = pm.baseMappings[mk]
+	}
+	if ok {
+		// Keep the best symbolization available from any source.
+		// Shared mappings are never modified.
+		if !pm.sharedMappings[m] {
+			m.HasFunctions = m.HasFunctions || src.HasFunctions
+			m.HasFilenames = m.HasFilenames || src.HasFilenames
+			m.HasLineNumbers = m.HasLineNumbers || src.HasLineNumbers
+			m.HasInlineFrames = m.HasInlineFrames || src.HasInlineFrames
+		}
 		mi := mapInfo{m, int64(m.Start) - int64(src.Start)}
 		pm.mappingsByID[src.ID] = mi
 		return mi
 	}
+	mi := mapInfo{pm.addMapping(mk, src), 0}
+	pm.mappingsByID[src.ID] = mi
+	return mi
+}
+
+// addMapping adds a copy of src to the merged profile, memoized as mk.
+func (pm *profileMerger) addMapping(mk mappingKey, src *Mapping) *Mapping {
 	m := &Mapping{
 		ID:              uint64(len(pm.p.Mapping) + 1),
 		Start:           src.Start,
@@ -313,12 +2071,21 @@ func (pm *profileMerger) mapMapping(src *Mapping) mapInfo {
 		HasInlineFrames: src.HasInlineFrames,
 	}
 	pm.p.Mapping = append(pm.p.Mapping, m)
-
-	// Update memoization tables.
 	pm.mappings[mk] = m
-	mi := mapInfo{m, 0}
-	pm.mappingsByID[src.ID] = mi
-	return mi
+	return m
+}
+
+// mappingKey returns the key identifying src in the merged profile,
+// taking mapping aliases and MappingKeyFunc into account.
+func (pm *profileMerger) mappingKey(src *Mapping) mappingKey {
+	if pm.opts.MappingKeyFunc != nil {
+		return mappingKey{custom: pm.opts.MappingKeyFunc(src)}
+	}
+	mk := src.key()
+	if alias, ok := pm.opts.MappingAliases[mk.buildIDOrFile]; ok {
+		mk.buildIDOrFile = alias
+	}
+	return mk
 }
 
 // key generates encoded strings of Mapping to be used as a key for
@@ -352,6 +2119,7 @@ func (m *Mapping) key() mappingKey {
 type mappingKey struct {
 	size, offset  uint64
 	buildIDOrFile string
+	custom        string
 }
 
 func (pm *profileMerger) mapLine(src Line) Line {
@@ -369,24 +2137,105 @@ func (pm *profileMerger) mapFunction(src *Function) *Function {
 	if f, ok := pm.functionsByID[src.ID]; ok {
 		return f
 	}
-	k := src.key()
-	if f, ok := pm.functions[k]; ok {
-		pm.functionsByID[src.ID] = f
-		return f
+	var k functionKey
+	if !pm.unkeyed {
+		k = pm.functionKey(src)
+		if f, ok := pm.findFunction(k); ok {
+			pm.functionsByID[src.ID] = f
+			return f
+		}
+	}
+	name := src.Name
+	if len(pm.opts.FunctionUnify) > 0 {
+		name, _ = pm.unifiedName(name)
 	}
 	f := &Function{
 		ID:         uint64(len(pm.p.Function) + 1),
-		Name:       src.Name,
+		Name:       name,
 		SystemName: src.SystemName,
 		Filename:   src.Filename,
 		StartLine:  src.StartLine,
 	}
-	pm.functions[k] = f
+	if !pm.unkeyed {
+		pm.recordFunction(k, f)
+	}
 	pm.functionsByID[src.ID] = f
 	pm.p.Function = append(pm.p.Function, f)
 	return f
 }
 
+// functionKey returns the key of f, which is its canonical name alone
+// for a function unified by FunctionUnify.
+func (pm *profileMerger) functionKey(f *Function) functionKey {
+	if len(pm.opts.FunctionUnify) > 0 {
+		if name, ok := pm.unifiedName(f.Name); ok {
+			return functionKey{name: name}
+		}
+	}
+	return f.key()
+}
+
+// unifiedName returns the canonical name of the function named name,
+// and whether it is unified by FunctionUnify.
+func (pm *profileMerger) unifiedName(name string) (string, bool) {
+	if c, ok := pm.opts.FunctionUnify[name]; ok {
+		return c, true
+	}
+	if pm.canonicalNames == nil {
+		pm.canonicalNames = make(map[string]bool, len(pm.opts.FunctionUnify))
+		for _, c := range pm.opts.FunctionUnify {
+			pm.canonicalNames[c] = true
+		}
+	}
+	return name, pm.canonicalNames[name]
+}
+
+// findFunction returns the function of the merged profile with key k.
+// With StartLineWildcard, a function with an unknown start line matches
+// any function that only differs by it, and when matched by one with a
+// known start line, takes it.
+func (pm *profileMerger) findFunction(k functionKey) (*Function, bool) {
+	if f, ok := pm.functions[k]; ok {
+		return f, true
+	}
+	if f, ok := pm.baseFunctions[k]; ok {
+		return f, true
+	}
+	if !pm.opts.StartLineWildcard {
+		return nil, false
+	}
+	wk := k
+	wk.startLine = 0
+	if k.startLine == 0 {
+		f, ok := pm.anyStartLine[wk]
+		return f, ok
+	}
+	if f, ok := pm.functions[wk]; ok {
+		delete(pm.functions, wk)
+		f.StartLine = k.startLine
+		pm.functions[k] = f
+		return f, true
+	}
+	return nil, false
+}
+
+// recordFunction records f as the function of the merged profile with
+// key k.
+func (pm *profileMerger) recordFunction(k functionKey, f *Function) {
+	pm.functions[k] = f
+	if !pm.opts.StartLineWildcard {
+		return
+	}
+	wk := k
+	wk.startLine = 0
+	if _, ok := pm.anyStartLine[wk]; !ok {
+		if pm.anyStartLine == nil {
+			pm.anyStartLine = make(map[functionKey]*Function)
+		}
+		pm.anyStartLine[wk] = f
+	}
+}
+
 // key generates a struct to be used as a key for maps.
 func (f *Function) key() functionKey {
 	return functionKey{
@@ -404,9 +2253,16 @@ type functionKey struct {
 
 // combineHeaders checks that all profiles can be merged and returns
 // their combined profile.
-func combineHeaders(srcs []*Profile) (*Profile, error) {
+func (pm *ProfileMerger) combineHeaders(srcs []*Profile) (*Profile, error) {
 	for _, s := range srcs[1:] {
-		if err := srcs[0].compatible(s); err != nil {
+		if err := pm.compatible(srcs[0], s); err != nil {
+			return nil, err
+		}
+	}
+	sampleTypes := srcs[0].SampleType
+	if pm.AlignSampleTypes != AlignByPosition {
+		var err error
+		if sampleTypes, err = pm.alignSampleTypes(srcs); err != nil {
 			return nil, err
 		}
 	}
@@ -415,15 +2271,22 @@ func combineHeaders(srcs []*Profile) (*Profile, error) {
 	var comments []string
 	seenComments := map[string]bool{}
 	var defaultSampleType string
-	for _, s := range srcs {
-		if timeNanos == 0 || s.TimeNanos < timeNanos {
-			timeNanos = s.TimeNanos
+	for i, s := range srcs {
+		t := s.TimeNanos
+		if j := pm.sourceIndex(i); t != 0 && j < len(pm.timeOffsets) {
+			t += pm.timeOffsets[j]
+		}
+		if timeNanos == 0 || t < timeNanos {
+			timeNanos = t
 		}
 		durationNanos += s.DurationNanos
 		if period == 0 || period < s.Period {
 			period = s.Period
 		}
 		for _, c := range s.Comments {
+			if pm.CommentNormalizer != nil {
+				c = pm.CommentNormalizer(c)
+			}
 			if seen := seenComments[c]; !seen {
 				comments = append(comments, c)
 				seenComments[c] = true
@@ -431,11 +2294,19 @@ func combineHeaders(srcs []*Profile) (*Profile, error) {
 		}
 		if defaultSampleType == "" {
 			defaultSampleType = s.DefaultSampleType
+		} else if pm.RequireSameDefault && s.DefaultSampleType != "" && s.DefaultSampleType != defaultSampleType {
+			return nil, fmt.Errorf("conflicting default sample types %q and %q", defaultSampleType, s.DefaultSampleType)
 		}
 	}
+	if pm.UnionDuration {
+		durationNanos = unionDuration(srcs)
+	}
+	if pm.AlignSampleTypes == AlignIntersection && !hasSampleType(sampleTypes, defaultSampleType) {
+		defaultSampleType = ""
+	}
 
 	p := &Profile{
-		SampleType: make([]*ValueType, len(srcs[0].SampleType)),
+		SampleType: make([]*ValueType, len(sampleTypes)),
 
 		DropFrames: srcs[0].DropFrames,
 		KeepFrames: srcs[0].KeepFrames,
@@ -448,28 +2319,339 @@ func combineHeaders(srcs []*Profile) (*Profile, error) {
 		Comments:          comments,
 		DefaultSampleType: defaultSampleType,
 	}
-	copy(p.SampleType, srcs[0].SampleType)
+	copy(p.SampleType, sampleTypes)
 	return p, nil
 }
 
+// alignSampleTypes returns the sample types of the profile merging srcs
+// according to pm.AlignSampleTypes.
+func (pm *ProfileMerger) alignSampleTypes(srcs []*Profile) ([]*ValueType, error) {
+	types := append([]*ValueType(nil), srcs[0].SampleType...)
+	for _, src := range srcs[1:] {
+		columns := pm.sampleTypeColumns(types, src)
+		if columns == nil {
+			continue
+		}
+		switch pm.AlignSampleTypes {
+		case AlignUnion:
+			used := make([]bool, len(src.SampleType))
+			for _, j := range columns {
+				if j >= 0 {
+					used[j] = true
+				}
+			}
+			for j, st := range src.SampleType {
+				if !used[j] {
+					types = append(types, st)
+				}
+			}
+		case AlignIntersection:
+			common := types[:0]
+			for i, j := range columns {
+				if j >= 0 {
+					common = append(common, types[i])
+				}
+			}
+			types = common
+		}
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("no sample type common to all profiles")
+	}
+	return types, nil
+}
+
+// sampleTypeColumns returns, for each of types, the index of a sample
+// type of src equal to it after applying aliases, each used once, or -1
+// if there is none. Returns nil if the sample types of src are types.
+func (pm *ProfileMerger) sampleTypeColumns(types []*ValueType, src *Profile) []int {
+	columns := make([]int, len(types))
+	used := make([]bool, len(src.SampleType))
+	identity := len(types) == len(src.SampleType)
+	for i, st := range types {
+		want := pm.canonicalValueType(st)
+		columns[i] = -1
+		for j, sst := range src.SampleType {
+			if !used[j] && equalValueType(pm.canonicalValueType(sst), want) {
+				columns[i], used[j] = j, true
+				break
+			}
+		}
+		identity = identity && columns[i] == i
+	}
+	if identity {
+		return nil
+	}
+	return columns
+}
+
+func hasSampleType(types []*ValueType, name string) bool {
+	for _, st := range types {
+		if st.Type == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckCompatible checks whether each of the profiles in srcs can be
+// merged with the first one, without merging them. It returns a slice
+// with an error for each profile in srcs, which is nil for compatible
+// profiles, so all the incompatible ones can be reported at once.
+func CheckCompatible(srcs []*Profile) []error {
+	return (&ProfileMerger{}).CheckCompatible(srcs)
+}
+
+// CheckCompatible is like the package level CheckCompatible, honoring
+// the type and unit aliases of pm.
+func (pm *ProfileMerger) CheckCompatible(srcs []*Profile) []error {
+	errs := make([]error, len(srcs))
+	for i, src := range srcs {
+		if i == 0 {
+			continue
+		}
+		if err := pm.compatible(srcs[0], src); err != nil {
+			errs[i] = fmt.Errorf("profile %d: %v", i, err)
+		}
+	}
+	return errs
+}
+
+// compatible determines if two profiles can be merged, taking type and
+// unit aliases into account.
+func (pm *ProfileMerger) compatible(a, b *Profile) error {
+	if pm.AlignSampleTypes != AlignByPosition {
+		// Only the period types need to match.
+		a, b = &Profile{PeriodType: a.PeriodType}, &Profile{PeriodType: b.PeriodType}
+	}
+	if pm.PermuteSampleTypes {
+		if columns := pm.sampleTypePermutation(a, b); columns != nil {
+			pb := &Profile{
+				PeriodType: b.PeriodType,
+				SampleType: make([]*ValueType, len(columns)),
+			}
+			for i, j := range columns {
+				pb.SampleType[i] = b.SampleType[j]
+			}
+			b = pb
+		}
+	}
+	if len(pm.TypeAliases) == 0 && len(pm.UnitAliases) == 0 {
+		return a.compatible(b)
+	}
+	return pm.canonicalHeader(a).compatible(pm.canonicalHeader(b))
+}
+
+// sampleTypePermutation returns, for each sample type of a, the index
+// of a sample type of b equal to it after applying aliases, each used
+// once. Returns nil if there is no such permutation or if the sample
+// types are already in the same order.
+func (pm *ProfileMerger) sampleTypePermutation(a, b *Profile) []int {
+	if len(a.SampleType) != len(b.SampleType) {
+		return nil
+	}
+	columns := make([]int, len(a.SampleType))
+	used := make([]bool, len(b.SampleType))
+	identity := true
+	for i, st := range a.SampleType {
+		want := pm.canonicalValueType(st)
+		columns[i] = -1
+		for j, bst := range b.SampleType {
+			if !used[j] && equalValueType(pm.canonicalValueType(bst), want) {
+				columns[i], used[j] = j, true
+				break
+			}
+		}
+		if columns[i] < 0 {
+			return nil
+		}
+		identity = identity && columns[i] == i
+	}
+	if identity {
+		return nil
+	}
+	return columns
+}
+
+// canonicalHeader returns a profile holding the period and sample types
+// of p with their types and units replaced by their aliases.
+func (pm *ProfileMerger) canonicalHeader(p *Profile) *Profile {
+	c := &Profile{
+		PeriodType: pm.canonicalValueType(p.PeriodType),
+		SampleType: make([]*ValueType, len(p.SampleType)),
+	}
+	for i, st := range p.SampleType {
+		c.SampleType[i] = pm.canonicalValueType(st)
+	}
+	return c
+}
+
+func (pm *ProfileMerger) canonicalValueType(vt *ValueType) *ValueType {
+	if vt == nil {
+		return nil
+	}
+	c := &ValueType{Type: vt.Type, Unit: vt.Unit}
+	if t, ok := pm.TypeAliases[c.Type]; ok {
+		c.Type = t
+	}
+	if u, ok := pm.UnitAliases[c.Unit]; ok {
+		c.Unit = u
+	}
+	return c
+}
+
+// unionDuration returns the length of the union of the time intervals
+// covered by srcs. Profiles without a TimeNanos contribute their whole
+// DurationNanos.
+func unionDuration(srcs []*Profile) int64 {
+	var total int64
+	intervals := make([]interval, 0, len(srcs))
+	for _, s := range srcs {
+		if s.TimeNanos == 0 {
+			total += s.DurationNanos
+			continue
+		}
+		intervals = append(intervals, interval{s.TimeNanos, s.TimeNanos + s.DurationNanos})
+	}
+	return total + unionLength(intervals)
+}
+
+// interval is a half-open [start, end) range of nanoseconds.
+type interval struct {
+	start, end int64
+}
+
+// unionLength returns the total length covered by the union of
+// intervals. It sorts intervals in place.
+func unionLength(intervals []interval) int64 {
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].start < intervals[j].start
+	})
+	var total int64
+	var cur interval
+	for _, iv := range intervals {
+		if iv.end <= iv.start {
+			continue
+		}
+		if cur.end <= cur.start || iv.start > cur.end {
+			total += cur.end - cur.start
+			cur = iv
+			continue
+		}
+		if iv.end > cur.end {
+			cur.end = iv.end
+		}
+	}
+	return total + cur.end - cur.start
+}
+
 // compatible determines if two profiles can be compared/merged.
 // returns nil if the profiles are compatible; otherwise an error with
 // details on the incompatibility.
 func (p *Profile) compatible(pb *Profile) error {
+	diffs := p.Diff(pb)
+	if len(diffs) == 0 {
+		return nil
+	}
+	if diffs[0].Kind == PeriodTypeMismatch {
+		return fmt.Errorf("incompatible period types %s and %s", valueTypeString(p.PeriodType), valueTypeString(pb.PeriodType))
+	}
+	return fmt.Errorf("incompatible sample types %s and %s", valueTypesString(p.SampleType), valueTypesString(pb.SampleType))
+}
+
+// IncompatibilityKind identifies which part of a profile header differs
+// between two profiles.
+type IncompatibilityKind int
+
+const (
+	// PeriodTypeMismatch indicates the profiles have different period
+	// types.
+	PeriodTypeMismatch IncompatibilityKind = iota
+	// SampleTypeCountMismatch indicates the profiles have a different
+	// number of sample types.
+	SampleTypeCountMismatch
+	// SampleTypeMismatch indicates the profiles have different sample
+	// types at the same position.
+	SampleTypeMismatch
+)
+
+// Incompatibility describes a single difference that prevents two
+// profiles from being compared or merged.
+type Incompatibility struct {
+	Kind IncompatibilityKind
+	// Index is the position of the mismatched sample type for
+	// SampleTypeMismatch, and -1 otherwise.
+	Index int
+	// A and B are the mismatched values of the receiver and the
+	// argument of Diff respectively. Value types are formatted as
+	// "type/unit" and sample type counts as decimal numbers.
+	A, B string
+}
+
+func (in Incompatibility) String() string {
+	switch in.Kind {
+	case PeriodTypeMismatch:
+		return fmt.Sprintf("period type %s vs %s", in.A, in.B)
+	case SampleTypeCountMismatch:
+		return fmt.Sprintf("sample type count %s vs %s", in.A, in.B)
+	default:
+		return fmt.Sprintf("sample type %d: %s vs %s", in.Index, in.A, in.B)
+	}
+}
+
+// Diff returns all the differences between the headers of p and pb
+// that prevent them from being compared or merged, in the order period
+// type, sample type count, and then each mismatched sample type
+// position. Returns an empty slice if the profiles are compatible.
+func (p *Profile) Diff(pb *Profile) []Incompatibility {
+	var diffs []Incompatibility
 	if !equalValueType(p.PeriodType, pb.PeriodType) {
-		return fmt.Errorf("incompatible period types %v and %v", p.PeriodType, pb.PeriodType)
+		diffs = append(diffs, Incompatibility{
+			Kind:  PeriodTypeMismatch,
+			Index: -1,
+			A:     valueTypeString(p.PeriodType),
+			B:     valueTypeString(pb.PeriodType),
+		})
 	}
 
-	if len(p.SampleType) != len(pb.SampleType) {
-		return fmt.Errorf("incompatible sample types %v and %v", p.SampleType, pb.SampleType)
+	n := len(p.SampleType)
+	if len(pb.SampleType) != n {
+		diffs = append(diffs, Incompatibility{
+			Kind:  SampleTypeCountMismatch,
+			Index: -1,
+			A:     strconv.Itoa(len(p.SampleType)),
+			B:     strconv.Itoa(len(pb.SampleType)),
+		})
+		if len(pb.SampleType) < n {
+			n = len(pb.SampleType)
+		}
 	}
 
-	for i := range p.SampleType {
+	for i := 0; i < n; i++ {
 		if !equalValueType(p.SampleType[i], pb.SampleType[i]) {
-			return fmt.Errorf("incompatible sample types %v and %v", p.SampleType, pb.SampleType)
+			diffs = append(diffs, Incompatibility{
+				Kind:  SampleTypeMismatch,
+				Index: i,
+				A:     valueTypeString(p.SampleType[i]),
+				B:     valueTypeString(pb.SampleType[i]),
+			})
 		}
 	}
-	return nil
+	return diffs
+}
+
+// valueTypeString formats vt as "type/unit".
+func valueTypeString(vt *ValueType) string {
+	return vt.Type + "/" + vt.Unit
+}
+
+// valueTypesString formats vts as a list of "type/unit" pairs.
+func valueTypesString(vts []*ValueType) string {
+	s := make([]string, len(vts))
+	for i, vt := range vts {
+		s[i] = valueTypeString(vt)
+	}
+	return "[" + strings.Join(s, " ") + "]"
 }
 
 // equalValueType returns true if the two value types are semantically
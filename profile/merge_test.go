@@ -15,12 +15,23 @@
 package profile
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/google/pprof/internal/proftest"
 )
 
 func TestMapMapping(t *testing.T) {
 	pm := &profileMerger{
 		p:            &Profile{},
+		opts:         &ProfileMerger{},
 		mappings:     make(map[mappingKey]*Mapping),
 		mappingsByID: make(map[uint64]mapInfo),
 	}
@@ -165,3 +176,2151 @@ func TestMapMapping(t *testing.T) {
 		})
 	}
 }
+
+func TestCollapseToFunctions(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		prof      *Profile
+		idx       int
+		wantFuncs []string
+	}{
+		{
+			desc:      "one function per sample",
+			prof:      noInlinesProfile,
+			wantFuncs: []string{"fun0: 1", "fun4: 2", "fun7: 3", "fun9: 4"},
+		},
+		{
+			desc:      "inlined leaf frame",
+			prof:      inlinesProfile,
+			wantFuncs: []string{"fun0: 1", "fun4: 2"},
+		},
+		{
+			desc:      "samples sharing a leaf function",
+			prof:      testProfile1,
+			idx:       1,
+			wantFuncs: []string{"main: 1000", "foo: 110", "foo_caller: 10001"},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := tc.prof.Copy()
+			fp, err := p.CollapseToFunctions(tc.idx)
+			if err != nil {
+				t.Fatalf("CollapseToFunctions: %v", err)
+			}
+			if err := fp.CheckValid(); err != nil {
+				t.Fatalf("CollapseToFunctions produced invalid profile: %v", err)
+			}
+			if got, want := len(fp.SampleType), 1; got != want {
+				t.Errorf("got %d sample types, want %d", got, want)
+			}
+			if got, want := strings.Join(sampleFuncs(fp), "\n"), strings.Join(tc.wantFuncs, "\n"); got != want {
+				t.Errorf("CollapseToFunctions got samples:\n%s\nwant:\n%s", got, want)
+			}
+			if len(p.Sample) != len(tc.prof.Sample) {
+				t.Errorf("CollapseToFunctions modified the source profile")
+			}
+		})
+	}
+	for _, idx := range []int{-1, len(testProfile1.SampleType)} {
+		if _, err := testProfile1.CollapseToFunctions(idx); err == nil {
+			t.Errorf("CollapseToFunctions(%d): want error", idx)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	cpuType := &ValueType{Type: "cpu", Unit: "milliseconds"}
+	wallType := &ValueType{Type: "wall", Unit: "milliseconds"}
+	samplesType := &ValueType{Type: "samples", Unit: "count"}
+	for _, tc := range []struct {
+		desc string
+		a, b *Profile
+		want []Incompatibility
+	}{
+		{
+			desc: "compatible",
+			a:    &Profile{PeriodType: cpuType, SampleType: []*ValueType{samplesType, cpuType}},
+			b:    &Profile{PeriodType: cpuType, SampleType: []*ValueType{samplesType, cpuType}},
+		},
+		{
+			desc: "period type",
+			a:    &Profile{PeriodType: cpuType, SampleType: []*ValueType{samplesType}},
+			b:    &Profile{PeriodType: wallType, SampleType: []*ValueType{samplesType}},
+			want: []Incompatibility{
+				{Kind: PeriodTypeMismatch, Index: -1, A: "cpu/milliseconds", B: "wall/milliseconds"},
+			},
+		},
+		{
+			desc: "all differences",
+			a:    &Profile{PeriodType: cpuType, SampleType: []*ValueType{samplesType, cpuType, cpuType}},
+			b:    &Profile{PeriodType: wallType, SampleType: []*ValueType{cpuType, cpuType}},
+			want: []Incompatibility{
+				{Kind: PeriodTypeMismatch, Index: -1, A: "cpu/milliseconds", B: "wall/milliseconds"},
+				{Kind: SampleTypeCountMismatch, Index: -1, A: "3", B: "2"},
+				{Kind: SampleTypeMismatch, Index: 0, A: "samples/count", B: "cpu/milliseconds"},
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got := tc.a.Diff(tc.b)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Diff got %v, want %v", got, tc.want)
+			}
+			if err := tc.a.compatible(tc.b); (err == nil) != (len(tc.want) == 0) {
+				t.Errorf("compatible got error %v, want error %v", err, len(tc.want) != 0)
+			}
+		})
+	}
+}
+
+func TestCheckCompatible(t *testing.T) {
+	cpuType := &ValueType{Type: "cpu", Unit: "milliseconds"}
+	wallType := &ValueType{Type: "wall", Unit: "milliseconds"}
+	samplesType := &ValueType{Type: "samples", Unit: "count"}
+	cpu := &Profile{PeriodType: cpuType, SampleType: []*ValueType{samplesType, cpuType}}
+	wall := &Profile{PeriodType: wallType, SampleType: []*ValueType{samplesType, wallType}}
+	samples := &Profile{PeriodType: cpuType, SampleType: []*ValueType{samplesType}}
+
+	errs := CheckCompatible([]*Profile{cpu, wall, cpu, samples})
+	if got, want := len(errs), 4; got != want {
+		t.Fatalf("CheckCompatible got %d errors, want %d", got, want)
+	}
+	for i, wantErr := range []bool{false, true, false, true} {
+		if gotErr := errs[i] != nil; gotErr != wantErr {
+			t.Errorf("CheckCompatible profile %d got error %v, want error %v", i, errs[i], wantErr)
+		}
+	}
+	if got, want := errs[3].Error(), "profile 3: "; !strings.HasPrefix(got, want) {
+		t.Errorf("CheckCompatible got error %q, want prefix %q", got, want)
+	}
+}
+
+func TestUnionLength(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		intervals []interval
+		want      int64
+	}{
+		{
+			desc: "empty",
+		},
+		{
+			desc:      "disjoint",
+			intervals: []interval{{30, 40}, {10, 20}},
+			want:      20,
+		},
+		{
+			desc:      "overlapping",
+			intervals: []interval{{10, 30}, {20, 40}},
+			want:      30,
+		},
+		{
+			desc:      "nested",
+			intervals: []interval{{10, 40}, {20, 30}, {50, 60}},
+			want:      40,
+		},
+		{
+			desc:      "adjacent",
+			intervals: []interval{{10, 20}, {20, 30}},
+			want:      20,
+		},
+		{
+			desc:      "empty intervals ignored",
+			intervals: []interval{{10, 10}, {5, 0}, {20, 30}},
+			want:      10,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := unionLength(tc.intervals); got != tc.want {
+				t.Errorf("unionLength got %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMergeUnionDuration(t *testing.T) {
+	p1 := testProfile1.Copy()
+	p1.TimeNanos, p1.DurationNanos = 1000, 500
+	p2 := testProfile1.Copy()
+	p2.TimeNanos, p2.DurationNanos = 1200, 500
+	p3 := testProfile1.Copy()
+	p3.TimeNanos, p3.DurationNanos = 0, 100
+
+	for _, tc := range []struct {
+		desc string
+		pm   *ProfileMerger
+		want int64
+	}{
+		{
+			desc: "sum of durations by default",
+			pm:   &ProfileMerger{},
+			want: 1100,
+		},
+		{
+			desc: "union of intervals",
+			pm:   &ProfileMerger{UnionDuration: true},
+			want: 800,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, err := tc.pm.Merge([]*Profile{p1, p2, p3})
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if p.DurationNanos != tc.want {
+				t.Errorf("got DurationNanos %d, want %d", p.DurationNanos, tc.want)
+			}
+		})
+	}
+}
+
+func TestMergeInputsCompacted(t *testing.T) {
+	compacted := testProfile1.Compact()
+	for _, tc := range []struct {
+		desc string
+		srcs []*Profile
+	}{
+		{
+			desc: "single compacted profile",
+			srcs: []*Profile{compacted},
+		},
+		{
+			desc: "multiple compacted profiles",
+			srcs: []*Profile{compacted, testProfile2.Compact(), compacted},
+		},
+		{
+			desc: "duplicate locations in first profile fall back",
+			srcs: []*Profile{testProfile1.Copy(), compacted},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			want, err := Merge(tc.srcs)
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			got, err := (&ProfileMerger{InputsCompacted: true}).Merge(tc.srcs)
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if got, want := got.String(), want.String(); got != want {
+				diff, err := proftest.Diff([]byte(want), []byte(got))
+				if err != nil {
+					t.Fatalf("failed to get diff: %v", err)
+				}
+				t.Errorf("InputsCompacted merge: got diff(want->got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMergeInputsCompactedIdentityOptions(t *testing.T) {
+	// A compacted profile with samples only differing in a label, and
+	// locations only differing in their address.
+	m := &Mapping{ID: 1, Start: 0x1000, Limit: 0x2000, File: "bin"}
+	f := &Function{ID: 1, Name: "f", SystemName: "f"}
+	g := &Function{ID: 2, Name: "g", SystemName: "g"}
+	l1 := &Location{ID: 1, Mapping: m, Address: 0x1010, Line: []Line{{Function: f, Line: 1}}}
+	l2 := &Location{ID: 2, Mapping: m, Address: 0x1020, Line: []Line{{Function: f, Line: 1}}}
+	l3 := &Location{ID: 3, Mapping: m, Address: 0x1030, Line: []Line{{Function: g, Line: 1}}}
+	p := &Profile{
+		PeriodType: &ValueType{Type: "cpu", Unit: "nanoseconds"},
+		SampleType: []*ValueType{{Type: "samples", Unit: "count"}},
+		Mapping:    []*Mapping{m},
+		Function:   []*Function{f, g},
+		Location:   []*Location{l1, l2, l3},
+		Sample: []*Sample{
+			{Location: []*Location{l1}, Value: []int64{1}, Label: map[string][]string{"k": {"a"}}},
+			{Location: []*Location{l1}, Value: []int64{2}, Label: map[string][]string{"k": {"b"}}},
+			{Location: []*Location{l2}, Value: []int64{4}, Label: map[string][]string{"k": {"a"}}},
+			{Location: []*Location{l3}, Value: []int64{8}, Label: map[string][]string{"k": {"a"}}},
+		},
+	}
+
+	for _, tc := range []struct {
+		desc string
+		pm   func() *ProfileMerger
+	}{
+		{"IgnoreLabelsForKey", func() *ProfileMerger { return &ProfileMerger{IgnoreLabelsForKey: []string{"k"}} }},
+		{"CollectLabel", func() *ProfileMerger {
+			pm := &ProfileMerger{}
+			pm.CollectLabel("k", "ks", 2)
+			return pm
+		}},
+		{"SymbolicOnly", func() *ProfileMerger { return &ProfileMerger{SymbolicOnly: true} }},
+		{"LocationKeyFunc", func() *ProfileMerger {
+			return &ProfileMerger{LocationKeyFunc: func(l *Location) string { return l.Line[0].Function.Name }}
+		}},
+		{"FunctionUnify", func() *ProfileMerger { return &ProfileMerger{FunctionUnify: map[string]string{"g": "f"}} }},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			want, err := tc.pm().Merge([]*Profile{p})
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if len(want.Sample) == len(p.Sample) && len(want.Location) == len(p.Location) && len(want.Function) == len(p.Function) {
+				t.Fatalf("%s merged nothing", tc.desc)
+			}
+			pm := tc.pm()
+			pm.InputsCompacted = true
+			got, err := pm.Merge([]*Profile{p})
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if got, want := got.String(), want.String(); got != want {
+				diff, err := proftest.Diff([]byte(want), []byte(got))
+				if err != nil {
+					t.Fatalf("failed to get diff: %v", err)
+				}
+				t.Errorf("InputsCompacted merge: got diff(want->got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func benchmarkCompact(b *testing.B, pm *ProfileMerger) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "cppbench.cpu"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	p, err := Parse(bytes.NewBuffer(data))
+	if err != nil {
+		b.Fatal(err)
+	}
+	p = p.Compact()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := pm.Merge([]*Profile{p}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompact(b *testing.B) {
+	benchmarkCompact(b, &ProfileMerger{})
+}
+
+func BenchmarkCompactInputsCompacted(b *testing.B) {
+	benchmarkCompact(b, &ProfileMerger{InputsCompacted: true})
+}
+
+func BenchmarkCompactInPlace(b *testing.B) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "cppbench.cpu"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	p, err := Parse(bytes.NewBuffer(data))
+	if err != nil {
+		b.Fatal(err)
+	}
+	p = p.Compact()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.CompactInPlace()
+	}
+}
+
+func TestCompactInPlace(t *testing.T) {
+	p := testProfile1.Copy()
+	p.Sample = p.Sample[:2]
+	p.Sample = append(p.Sample, &Sample{
+		Location: []*Location{p.Location[2]},
+		Value:    []int64{0, 0},
+	})
+	dup := &Sample{Location: p.Sample[0].Location, Value: []int64{1, 1}}
+	p.Sample = append(p.Sample, dup)
+
+	p.CompactInPlace()
+	if err := p.CheckValid(); err != nil {
+		t.Fatalf("CompactInPlace left an invalid profile: %v", err)
+	}
+	// Duplicate samples are not merged.
+	if got, want := len(p.Sample), 3; got != want {
+		t.Errorf("got %d samples, want %d", got, want)
+	}
+	if got, want := len(p.Location), 2; got != want {
+		t.Errorf("got %d locations, want %d", got, want)
+	}
+	for i, l := range p.Location {
+		if got, want := l.ID, uint64(i+1); got != want {
+			t.Errorf("location %d got ID %d, want %d", i, got, want)
+		}
+	}
+	if got, want := len(p.Mapping), 2; got != want {
+		t.Errorf("got %d mappings, want %d", got, want)
+	}
+	if got, want := p.Mapping[0].File, mainBinary; got != want {
+		t.Errorf("got main binary %q, want %q", got, want)
+	}
+}
+
+func TestMapMappingSymbolization(t *testing.T) {
+	unsymbolized := testProfile1.Copy()
+	for _, m := range unsymbolized.Mapping {
+		m.HasFunctions = false
+		m.HasFilenames = false
+		m.HasLineNumbers = false
+		m.HasInlineFrames = false
+	}
+	for _, tc := range []struct {
+		desc string
+		srcs []*Profile
+	}{
+		{
+			desc: "unsymbolized first",
+			srcs: []*Profile{unsymbolized, testProfile1.Copy()},
+		},
+		{
+			desc: "symbolized first",
+			srcs: []*Profile{testProfile1.Copy(), unsymbolized},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, err := Merge(tc.srcs)
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			for _, m := range p.Mapping {
+				if !m.HasFunctions || !m.HasFilenames || !m.HasLineNumbers || !m.HasInlineFrames {
+					t.Errorf("mapping %s lost symbolization flags: %s", m.File, m.string())
+				}
+			}
+		})
+	}
+}
+
+func TestMergeToWriter(t *testing.T) {
+	srcs := []*Profile{testProfile1.Copy(), testProfile2.Copy()}
+	want, err := Merge(srcs)
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := MergeToWriter(srcs, &buf); err != nil {
+		t.Fatalf("MergeToWriter error: %v", err)
+	}
+	got, err := Parse(&buf)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if got, want := got.String(), want.String(); got != want {
+		diff, err := proftest.Diff([]byte(want), []byte(got))
+		if err != nil {
+			t.Fatalf("failed to get diff: %v", err)
+		}
+		t.Errorf("MergeToWriter: got diff(want->got):\n%s", diff)
+	}
+
+	if err := MergeToWriter(nil, &buf); err == nil {
+		t.Errorf("MergeToWriter with no profiles: want error")
+	}
+}
+
+func TestDistinctStacks(t *testing.T) {
+	dupLocations := noInlinesProfile.Copy()
+	dupLoc := *dupLocations.Location[0]
+	dupLoc.ID = uint64(len(dupLocations.Location) + 1)
+	dupLocations.Location = append(dupLocations.Location, &dupLoc)
+	dupLocations.Sample = append(dupLocations.Sample, &Sample{
+		Location: []*Location{&dupLoc, dupLocations.Location[1], dupLocations.Location[2], dupLocations.Location[3]},
+		Value:    []int64{5},
+	}, &Sample{
+		Location: []*Location{dupLocations.Location[0]},
+		Value:    []int64{0},
+	})
+
+	for _, tc := range []struct {
+		desc string
+		srcs []*Profile
+		want int
+	}{
+		{
+			desc: "single profile",
+			srcs: []*Profile{testProfile1},
+			want: 5,
+		},
+		{
+			desc: "same stacks in two profiles",
+			srcs: []*Profile{testProfile1, testProfile2},
+			want: 5,
+		},
+		{
+			desc: "different labels",
+			srcs: []*Profile{testProfile1, testProfile4},
+			want: 6,
+		},
+		{
+			desc: "duplicate locations and zero samples",
+			srcs: []*Profile{dupLocations},
+			want: 4,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := DistinctStacksAcross(tc.srcs); got != tc.want {
+				t.Errorf("DistinctStacksAcross got %d, want %d", got, tc.want)
+			}
+			if len(tc.srcs) != 1 {
+				return
+			}
+			if got := tc.srcs[0].DistinctStacks(); got != tc.want {
+				t.Errorf("DistinctStacks got %d, want %d", got, tc.want)
+			}
+			if got := len(tc.srcs[0].Compact().Sample); got != tc.want {
+				t.Errorf("Compact got %d samples, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMergeMappingAliases(t *testing.T) {
+	aliased := func(buildID string) *Profile {
+		p := testProfile1.Copy()
+		for _, m := range p.Mapping {
+			if m.File == mainBinary {
+				m.BuildID = buildID
+			}
+		}
+		return p
+	}
+	srcs := []*Profile{aliased("build-1"), aliased("build-2")}
+
+	for _, tc := range []struct {
+		desc         string
+		aliases      map[string]string
+		wantMappings int
+	}{
+		{
+			desc:         "no aliases",
+			wantMappings: 3,
+		},
+		{
+			desc:         "unrelated aliases",
+			aliases:      map[string]string{"build-3": "build-1"},
+			wantMappings: 3,
+		},
+		{
+			desc:         "aliased build IDs",
+			aliases:      map[string]string{"build-2": "build-1"},
+			wantMappings: 2,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, err := (&ProfileMerger{MappingAliases: tc.aliases}).Merge(srcs)
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if got := len(p.Mapping); got != tc.wantMappings {
+				t.Errorf("got %d mappings, want %d", got, tc.wantMappings)
+			}
+			if got := p.Mapping[0].BuildID; got != "build-1" {
+				t.Errorf("got main binary build ID %q, want %q", got, "build-1")
+			}
+		})
+	}
+}
+
+func TestMergeMappingKeyFunc(t *testing.T) {
+	// Relocate the main binary of a copy and install it elsewhere.
+	moved := testProfile1.Copy()
+	const shift = 0x100000
+	m := moved.Mapping[0]
+	m.File, m.Start, m.Limit = "/opt/main", m.Start+shift, m.Limit+shift
+	for _, l := range moved.Location {
+		if l.Mapping == m {
+			l.Address += shift
+		}
+	}
+	srcs := []*Profile{testProfile1.Copy(), moved}
+
+	want, err := Merge([]*Profile{testProfile1.Copy(), testProfile1.Copy()})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	p, err := Merge(srcs)
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if got, want := len(p.Mapping), len(want.Mapping)+1; got != want {
+		t.Errorf("without MappingKeyFunc got %d mappings, want %d", got, want)
+	}
+
+	pm := &ProfileMerger{
+		MappingKeyFunc: func(m *Mapping) string {
+			return filepath.Base(m.File)
+		},
+	}
+	p, err = pm.Merge(srcs)
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if got, want := p.String(), want.String(); got != want {
+		t.Errorf("with MappingKeyFunc got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMergeCanonicalMappings(t *testing.T) {
+	canonical := []*Mapping{
+		{ID: 10, Start: 0x800000, Limit: 0x830000, File: mainBinary},
+		{ID: 11, Start: 0x900000, Limit: 0x901000, File: "/lib/unused.so"},
+	}
+	src := testProfile1.Copy()
+	pm := &ProfileMerger{CanonicalMappings: canonical}
+	p, err := pm.Merge([]*Profile{src})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if err := p.CheckValid(); err != nil {
+		t.Fatalf("merged profile is invalid: %v", err)
+	}
+	if got, want := len(p.Mapping), len(src.Compact().Mapping); got != want {
+		t.Errorf("got %d mappings, want %d", got, want)
+	}
+	main := p.Mapping[0]
+	if main.File != mainBinary || main.Start != 0x800000 || main.Limit != 0x830000 {
+		t.Errorf("got main mapping %s [%#x, %#x), want %s [0x800000, 0x830000)", main.File, main.Start, main.Limit, mainBinary)
+	}
+	const shift = 0x800000 - 0x10000
+	for i, l := range p.Location {
+		want := src.Location[i].Address
+		if l.Mapping == main {
+			want += shift
+		}
+		if l.Address != want {
+			t.Errorf("location %d got address %#x, want %#x", i, l.Address, want)
+		}
+	}
+	if canonical[0].HasFunctions || canonical[0].ID != 10 {
+		t.Errorf("merge modified the canonical mappings")
+	}
+}
+
+func TestMergeCommentNormalizer(t *testing.T) {
+	p1 := testProfile1.Copy()
+	p1.Comments = []string{"Host: web-1 ", "build: 1"}
+	p2 := testProfile1.Copy()
+	p2.Comments = []string{"host: web-1", "Build: 1", "build: 2"}
+
+	for _, tc := range []struct {
+		desc string
+		norm func(string) string
+		want []string
+	}{
+		{
+			desc: "exact match by default",
+			want: []string{"Host: web-1 ", "build: 1", "host: web-1", "Build: 1", "build: 2"},
+		},
+		{
+			desc: "case and space insensitive",
+			norm: func(c string) string {
+				return strings.ToLower(strings.TrimSpace(c))
+			},
+			want: []string{"host: web-1", "build: 1", "build: 2"},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, err := (&ProfileMerger{CommentNormalizer: tc.norm}).Merge([]*Profile{p1, p2})
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if !reflect.DeepEqual(p.Comments, tc.want) {
+				t.Errorf("got comments %q, want %q", p.Comments, tc.want)
+			}
+		})
+	}
+}
+
+func TestMergeSymbolicOnly(t *testing.T) {
+	// Build an arm64 flavor of testProfile1, with a different binary
+	// loaded at different addresses.
+	arm := testProfile1.Copy()
+	for _, m := range arm.Mapping {
+		m.BuildID = "arm64-" + m.File
+		m.Start += 0x100000
+		m.Limit += 0x180000
+	}
+	for _, l := range arm.Location {
+		l.Address = l.Address*2 + 0x100000
+	}
+	amd := testProfile1.Copy()
+	for _, m := range amd.Mapping {
+		m.BuildID = "amd64-" + m.File
+	}
+
+	for _, tc := range []struct {
+		desc         string
+		symbolicOnly bool
+		wantSamples  int
+		wantMappings int
+	}{
+		{
+			desc:         "address based",
+			wantSamples:  10,
+			wantMappings: 4,
+		},
+		{
+			desc:         "symbolic only",
+			symbolicOnly: true,
+			wantSamples:  5,
+			wantMappings: 2,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, err := (&ProfileMerger{SymbolicOnly: tc.symbolicOnly}).Merge([]*Profile{amd, arm})
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if err := p.CheckValid(); err != nil {
+				t.Fatalf("merge produced invalid profile: %v", err)
+			}
+			if got := len(p.Sample); got != tc.wantSamples {
+				t.Errorf("got %d samples, want %d", got, tc.wantSamples)
+			}
+			if got := len(p.Mapping); got != tc.wantMappings {
+				t.Errorf("got %d mappings, want %d", got, tc.wantMappings)
+			}
+		})
+	}
+}
+
+func TestMergePerLabelCap(t *testing.T) {
+	tenant := func(name string, values ...int64) *Profile {
+		p := noInlinesProfile.Copy()
+		for i, s := range p.Sample {
+			s.Value[0] = values[i]
+			s.Label = map[string][]string{"tenant": {name}}
+		}
+		return p
+	}
+	untagged := noInlinesProfile.Copy()
+
+	pm := &ProfileMerger{}
+	pm.PerLabelCap("tenant", 10)
+	p, err := pm.Merge([]*Profile{
+		tenant("noisy", 4, 4, 4, 4),
+		tenant("quiet", 1, 1, 1, 1),
+		tenant("noisy", 1, 1, 1, 1),
+		untagged,
+	})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	totals, err := p.TotalsByLabel("tenant", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"noisy": 10, "quiet": 4, "": 10}; !reflect.DeepEqual(totals, want) {
+		t.Errorf("got totals %v, want %v", totals, want)
+	}
+	// The last noisy sample was entirely capped.
+	if got, want := len(p.Sample), 11; got != want {
+		t.Errorf("got %d samples, want %d", got, want)
+	}
+}
+
+func TestCombinePrefixed(t *testing.T) {
+	a := testProfile3.Copy()
+	b := testProfile3.Copy()
+	b.PeriodType = &ValueType{Type: "space", Unit: "bytes"}
+	b.SampleType = []*ValueType{{Type: "samples", Unit: "count"}}
+	b.DefaultSampleType = "samples"
+	b.Sample = append(b.Sample, &Sample{
+		Location: []*Location{b.Location[1], b.Location[0]},
+		Value:    []int64{7},
+	})
+
+	p, err := CombinePrefixed(a, b, "cpu/", "heap/")
+	if err != nil {
+		t.Fatalf("CombinePrefixed: %v", err)
+	}
+	if got, want := sampleTypes(p), []string{"cpu/samples", "heap/samples"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got sample types %v, want %v", got, want)
+	}
+	if got, want := p.DefaultSampleType, "heap/samples"; got != want {
+		t.Errorf("got default sample type %q, want %q", got, want)
+	}
+	if got, want := p.PeriodType.Type, "cpu"; got != want {
+		t.Errorf("got period type %q, want %q", got, want)
+	}
+	var got [][]int64
+	for _, s := range p.Sample {
+		got = append(got, s.Value)
+	}
+	if want := [][]int64{{1000, 1000}, {0, 7}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got values %v, want %v", got, want)
+	}
+
+	if _, err := CombinePrefixed(a, b, "", ""); err == nil {
+		t.Errorf("CombinePrefixed with colliding sample types: want error")
+	}
+
+	// The duration covers the time of both profiles once.
+	for _, tc := range []struct {
+		desc                   string
+		timeA, timeB, durB     int64
+		wantTime, wantDuration int64
+	}{
+		{"same window", 1e9, 1e9, 10e9, 1e9, 10e9},
+		{"overlapping windows", 1e9, 6e9, 10e9, 1e9, 15e9},
+		{"no time", 0, 0, 20e9, 0, 10e9},
+	} {
+		a, b := a.Copy(), b.Copy()
+		a.TimeNanos, a.DurationNanos = tc.timeA, 10e9
+		b.TimeNanos, b.DurationNanos = tc.timeB, tc.durB
+		p, err := CombinePrefixed(a, b, "cpu/", "heap/")
+		if err != nil {
+			t.Fatalf("%s: CombinePrefixed: %v", tc.desc, err)
+		}
+		if p.TimeNanos != tc.wantTime || p.DurationNanos != tc.wantDuration {
+			t.Errorf("%s: got time %d and duration %d, want %d and %d", tc.desc, p.TimeNanos, p.DurationNanos, tc.wantTime, tc.wantDuration)
+		}
+	}
+}
+
+func TestMergeAliases(t *testing.T) {
+	ns := testProfile1.Copy()
+	ns.PeriodType = &ValueType{Type: "cpu", Unit: "ms"}
+	ns.SampleType = []*ValueType{
+		{Type: "sample", Unit: "count"},
+		{Type: "cpu", Unit: "ms"},
+	}
+	srcs := []*Profile{testProfile1.Copy(), ns}
+
+	if _, err := Merge(srcs); err == nil {
+		t.Fatalf("Merge with different units: want error")
+	}
+	pm := &ProfileMerger{
+		TypeAliases: map[string]string{"sample": "samples"},
+		UnitAliases: map[string]string{"ms": "milliseconds"},
+	}
+	p, err := pm.Merge(srcs)
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if got, want := p.SampleType[1].Unit, "milliseconds"; got != want {
+		t.Errorf("got unit %q, want %q", got, want)
+	}
+	if got, want := p.Sample[0].Value[0], 2*testProfile1.Sample[0].Value[0]; got != want {
+		t.Errorf("got value %d, want %d", got, want)
+	}
+	pm.TypeAliases = nil
+	if _, err := pm.Merge(srcs); err == nil {
+		t.Errorf("Merge with unaliased types: want error")
+	}
+}
+
+func TestMergePermuteSampleTypes(t *testing.T) {
+	swapped := testProfile1.Copy()
+	swapped.SampleType[0], swapped.SampleType[1] = swapped.SampleType[1], swapped.SampleType[0]
+	for _, s := range swapped.Sample {
+		s.Value[0], s.Value[1] = s.Value[1], s.Value[0]
+	}
+	srcs := []*Profile{testProfile1.Copy(), swapped}
+
+	if _, err := Merge(srcs); err == nil {
+		t.Fatalf("Merge with swapped sample types: want error")
+	}
+	pm := &ProfileMerger{PermuteSampleTypes: true}
+	got, err := pm.Merge(srcs)
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	want, err := Merge([]*Profile{testProfile1.Copy(), testProfile1.Copy()})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if got, want := got.String(), want.String(); got != want {
+		diff, err := proftest.Diff([]byte(want), []byte(got))
+		if err != nil {
+			t.Fatalf("failed to get diff: %v", err)
+		}
+		t.Errorf("PermuteSampleTypes merge: got diff(want->got):\n%s", diff)
+	}
+
+	other := swapped.Copy()
+	other.SampleType[0] = &ValueType{Type: "wall", Unit: "milliseconds"}
+	if _, err := pm.Merge([]*Profile{testProfile1.Copy(), other}); err == nil {
+		t.Errorf("PermuteSampleTypes merge with no matching permutation: want error")
+	}
+}
+
+func TestMergeAlignSampleTypes(t *testing.T) {
+	a := testProfile1.Copy()
+	a.DefaultSampleType = "cpu"
+	b := testProfile1.Copy()
+	b.SampleType = []*ValueType{
+		{Type: "wall", Unit: "milliseconds"},
+		{Type: "samples", Unit: "count"},
+	}
+	srcs := []*Profile{a, b}
+
+	for _, tc := range []struct {
+		desc        string
+		align       SampleTypeAlignment
+		wantTypes   string
+		wantDefault string
+		// wantValues returns the merged values of a sample with the
+		// value v in every sample type of both profiles.
+		wantValues func(v int64) []int64
+	}{
+		{
+			desc:        "union",
+			align:       AlignUnion,
+			wantTypes:   "[samples/count cpu/milliseconds wall/milliseconds]",
+			wantDefault: "cpu",
+			wantValues:  func(v int64) []int64 { return []int64{2 * v, v, v} },
+		},
+		{
+			desc:        "intersection",
+			align:       AlignIntersection,
+			wantTypes:   "[samples/count]",
+			wantDefault: "",
+			wantValues:  func(v int64) []int64 { return []int64{2 * v} },
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			pm := &ProfileMerger{AlignSampleTypes: tc.align}
+			p, err := pm.Merge(srcs)
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if err := p.CheckValid(); err != nil {
+				t.Fatalf("merged profile is invalid: %v", err)
+			}
+			var types []string
+			for _, st := range p.SampleType {
+				types = append(types, valueTypeString(st))
+			}
+			if got := fmt.Sprint(types); got != tc.wantTypes {
+				t.Errorf("got sample types %s, want %s", got, tc.wantTypes)
+			}
+			if got := p.DefaultSampleType; got != tc.wantDefault {
+				t.Errorf("got default sample type %q, want %q", got, tc.wantDefault)
+			}
+			for i, s := range p.Sample {
+				want := tc.wantValues(testProfile1.Sample[i].Value[0])
+				if !reflect.DeepEqual(s.Value, want) {
+					t.Errorf("sample %d got values %v, want %v", i, s.Value, want)
+				}
+			}
+		})
+	}
+
+	disjoint := testProfile1.Copy()
+	disjoint.SampleType = []*ValueType{
+		{Type: "wall", Unit: "milliseconds"},
+		{Type: "alloc", Unit: "count"},
+	}
+	if _, err := (&ProfileMerger{AlignSampleTypes: AlignIntersection}).Merge([]*Profile{a, disjoint}); err == nil {
+		t.Errorf("intersection of disjoint sample types: want error")
+	}
+	otherPeriod := testProfile1.Copy()
+	otherPeriod.PeriodType = &ValueType{Type: "wall", Unit: "milliseconds"}
+	if _, err := (&ProfileMerger{AlignSampleTypes: AlignUnion}).Merge([]*Profile{a, otherPeriod}); err == nil {
+		t.Errorf("union with different period types: want error")
+	}
+}
+
+func TestMergeSkipUnitDrift(t *testing.T) {
+	drifted := testProfile1.Copy()
+	drifted.SampleType = []*ValueType{
+		{Type: "samples", Unit: "count"},
+		{Type: "cpu", Unit: "nanoseconds"},
+	}
+	other := testProfile1.Copy()
+	other.SampleType = []*ValueType{
+		{Type: "samples", Unit: "count"},
+		{Type: "wall", Unit: "nanoseconds"},
+	}
+	srcs := []*Profile{testProfile1.Copy(), drifted, testProfile1.Copy()}
+
+	pm := &ProfileMerger{}
+	if _, err := pm.Merge(srcs); err == nil {
+		t.Fatalf("Merge with unit drift: want error")
+	}
+	pm.SkipUnitDrift = true
+	p, err := pm.Merge(srcs)
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if got, want := p.Sample[0].Value[0], 2*testProfile1.Sample[0].Value[0]; got != want {
+		t.Errorf("got value %d, want %d", got, want)
+	}
+	want := []UnitDrift{{Source: 1, Index: 1, Type: "cpu", Unit: "nanoseconds", WantUnit: "milliseconds"}}
+	if got := pm.Stats().UnitDrift; !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats got unit drift %+v, want %+v", got, want)
+	}
+
+	if _, err := pm.Merge([]*Profile{testProfile1.Copy(), other}); err == nil {
+		t.Errorf("Merge with different types: want error")
+	}
+	if got := pm.Stats().UnitDrift; len(got) != 0 {
+		t.Errorf("Stats got unit drift %+v, want none", got)
+	}
+}
+
+func TestMergeDedupSources(t *testing.T) {
+	changed := testProfile1.Copy()
+	changed.Sample[0].Value[0]++
+	srcs := []*Profile{testProfile1.Copy(), testProfile1.Copy(), changed, changed.Copy(), testProfile2.Copy()}
+
+	pm := &ProfileMerger{DedupSources: true}
+	got, err := pm.Merge(srcs)
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	want, err := Merge([]*Profile{srcs[0], srcs[2], srcs[4]})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if got, want := got.String(), want.String(); got != want {
+		diff, err := proftest.Diff([]byte(want), []byte(got))
+		if err != nil {
+			t.Fatalf("failed to get diff: %v", err)
+		}
+		t.Errorf("DedupSources merge: got diff(want->got):\n%s", diff)
+	}
+	if got, want := pm.Stats().DuplicateSources, []int{1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats got duplicate sources %v, want %v", got, want)
+	}
+}
+
+func TestMergeLocationKeyFunc(t *testing.T) {
+	pm := &ProfileMerger{
+		LocationKeyFunc: func(l *Location) string {
+			return l.Line[0].Function.Name
+		},
+	}
+	p, err := pm.Merge([]*Profile{recursionProfile.Copy()})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if got, want := len(p.Location), 3; got != want {
+		t.Errorf("got %d locations, want %d", got, want)
+	}
+	if got, want := strings.Join(sampleFuncs(p), "\n"), strings.Join([]string{
+		"fun0 fun0 fun0 fun1: 1",
+		"fun0 fun1: 2",
+		"fun0 fun1 fun0 fun2: 4",
+		"fun2 fun2: 8",
+	}, "\n"); got != want {
+		t.Errorf("got samples:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMergeTimeLabel(t *testing.T) {
+	early, late, untimed := testProfile1.Copy(), testProfile1.Copy(), testProfile1.Copy()
+	early.TimeNanos, late.TimeNanos, untimed.TimeNanos = 1000, 2000, 0
+	pm := &ProfileMerger{TimeLabel: "time_nanos"}
+	p, err := pm.Merge([]*Profile{early, late, early.Copy(), untimed})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if got, want := len(p.Sample), 3*len(testProfile1.Sample); got != want {
+		t.Errorf("got %d samples, want %d", got, want)
+	}
+	totals := make(map[int64]int64)
+	for _, s := range p.Sample {
+		var time int64
+		if v := s.NumLabel["time_nanos"]; len(v) > 0 {
+			time = v[0]
+			if got, want := s.NumUnit["time_nanos"], []string{"nanoseconds"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got time unit %v, want %v", got, want)
+			}
+		}
+		totals[time] += s.Value[1]
+	}
+	var total int64
+	for _, s := range testProfile1.Sample {
+		total += s.Value[1]
+	}
+	if want := map[int64]int64{1000: 2 * total, 2000: total, 0: total}; !reflect.DeepEqual(totals, want) {
+		t.Errorf("got totals by time %v, want %v", totals, want)
+	}
+}
+
+func TestMergeFoldedLocations(t *testing.T) {
+	folded := noInlinesProfile.Copy()
+	for _, l := range folded.Location {
+		l.IsFolded = true
+	}
+	for _, tc := range []struct {
+		desc       string
+		policy     FoldedMerge
+		wantLocs   int
+		wantFolded bool
+		wantValue  int64
+	}{
+		{
+			desc:       "distinct",
+			policy:     KeepFoldedDistinct,
+			wantLocs:   2 * len(noInlinesLocs),
+			wantFolded: false,
+			wantValue:  1,
+		},
+		{
+			desc:       "prefer unfolded",
+			policy:     PreferUnfolded,
+			wantLocs:   len(noInlinesLocs),
+			wantFolded: false,
+			wantValue:  2,
+		},
+		{
+			desc:       "prefer folded",
+			policy:     PreferFolded,
+			wantLocs:   len(noInlinesLocs),
+			wantFolded: true,
+			wantValue:  2,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			pm := &ProfileMerger{FoldedLocations: tc.policy}
+			p, err := pm.Merge([]*Profile{noInlinesProfile.Copy(), folded.Copy()})
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if got, want := len(p.Location), tc.wantLocs; got != want {
+				t.Errorf("got %d locations, want %d", got, want)
+			}
+			if got, want := p.Location[0].IsFolded, tc.wantFolded; got != want {
+				t.Errorf("got IsFolded %v, want %v", got, want)
+			}
+			if got, want := p.Sample[0].Value[0], tc.wantValue; got != want {
+				t.Errorf("got value %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	leaf := func(s *Sample) string {
+		return s.Location[0].Line[0].Function.Name
+	}
+	p := noInlinesProfile.Copy()
+	p.Sample = append(p.Sample,
+		&Sample{Value: []int64{8}, Location: []*Location{p.Location[4], p.Location[5]}},
+		&Sample{Value: []int64{16}, Location: []*Location{p.Location[0]}},
+	)
+	got := p.GroupBy(leaf)
+	if err := got.CheckValid(); err != nil {
+		t.Fatalf("GroupBy produced invalid profile: %v", err)
+	}
+	if got, want := strings.Join(sampleFuncs(got), "\n"), strings.Join([]string{
+		"fun0 fun1 fun2 fun3: 17",
+		"fun4 fun5 fun1 fun6: 10",
+		"fun7 fun8: 3",
+		"fun9 fun4 fun10 fun7: 4",
+	}, "\n"); got != want {
+		t.Errorf("GroupBy got samples:\n%s\nwant:\n%s", got, want)
+	}
+
+	byLeafMapping := p.GroupBy(func(s *Sample) string {
+		return s.Location[0].Mapping.File
+	})
+	if got, want := strings.Join(sampleFuncs(byLeafMapping), "\n"), "fun0 fun1 fun2 fun3: 34"; got != want {
+		t.Errorf("GroupBy got samples:\n%s\nwant:\n%s", got, want)
+	}
+	if got, want := len(byLeafMapping.Location), 4; got != want {
+		t.Errorf("GroupBy got %d locations, want %d", got, want)
+	}
+	if got, want := strings.Join(sampleFuncs(p), "\n"), strings.Join(append(allNoInlinesSampleFuncs, "fun4 fun5: 8", "fun0: 16"), "\n"); got != want {
+		t.Errorf("GroupBy modified the source profile:\n%s", got)
+	}
+}
+
+func TestMergeColumnScale(t *testing.T) {
+	us := testProfile1.Copy()
+	us.SampleType[1] = &ValueType{Type: "cpu", Unit: "microseconds"}
+	for _, s := range us.Sample {
+		s.Value[1] *= 1000
+	}
+	srcs := []*Profile{testProfile1.Copy(), us}
+
+	pm := &ProfileMerger{
+		UnitAliases: map[string]string{"microseconds": "milliseconds"},
+		ColumnScale: []map[int]float64{nil, {1: 0.001}},
+	}
+	got, err := pm.Merge(srcs)
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	want, err := Merge([]*Profile{testProfile1.Copy(), testProfile1.Copy()})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if got, want := got.String(), want.String(); got != want {
+		diff, err := proftest.Diff([]byte(want), []byte(got))
+		if err != nil {
+			t.Fatalf("failed to get diff: %v", err)
+		}
+		t.Errorf("ColumnScale merge: got diff(want->got):\n%s", diff)
+	}
+
+	for _, scale := range [][]map[int]float64{
+		{nil, {2: 0.001}},
+		{nil, {1: math.NaN()}},
+		{nil, nil, nil},
+	} {
+		pm.ColumnScale = scale
+		if _, err := pm.Merge(srcs); err == nil {
+			t.Errorf("Merge with column scale %v: want error", scale)
+		}
+	}
+
+	// Scales follow the positions of the profiles, even when a profile
+	// is repeated or others are skipped.
+	p := noInlinesProfile.Copy()
+	for _, tc := range []struct {
+		desc string
+		pm   *ProfileMerger
+		srcs []*Profile
+		want []string
+	}{
+		{
+			desc: "repeated profile",
+			pm:   &ProfileMerger{ColumnScale: []map[int]float64{{0: 3}, {0: 2}}},
+			srcs: []*Profile{p, p},
+			want: []string{
+				"fun0 fun1 fun2 fun3: 5",
+				"fun4 fun5 fun1 fun6: 10",
+				"fun7 fun8: 15",
+				"fun9 fun4 fun10 fun7: 20",
+			},
+		},
+		{
+			desc: "skipped profile",
+			pm:   &ProfileMerger{DedupSources: true, ColumnScale: []map[int]float64{{0: 3}, {0: 7}, nil, {0: 2}}},
+			srcs: []*Profile{p, p.Copy(), noInlinesProfile.Copy(), inlinesProfile},
+			want: []string{
+				"fun0 fun1 fun2 fun3: 3",
+				"fun4 fun5 fun1 fun6: 6",
+				"fun7 fun8: 9",
+				"fun9 fun4 fun10 fun7: 12",
+				"fun0 fun1 fun2 fun3: 2",
+				"fun4 fun5 fun6: 4",
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := tc.pm.Merge(tc.srcs)
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if got := sampleFuncs(got); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got samples %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMergeSourceWeight(t *testing.T) {
+	weighted := func(comments ...string) *Profile {
+		p := noInlinesProfile.Copy()
+		p.Comments = comments
+		return p
+	}
+	srcs := []*Profile{weighted("weight=2"), weighted(), weighted("weight=0")}
+	pm := &ProfileMerger{SourceWeight: func(p *Profile) float64 {
+		for _, c := range p.Comments {
+			if w, err := strconv.ParseFloat(strings.TrimPrefix(c, "weight="), 64); err == nil {
+				return w
+			}
+		}
+		return 1
+	}}
+
+	for _, tc := range []struct {
+		desc        string
+		columnScale []map[int]float64
+		want        []string
+	}{
+		{
+			desc: "weights",
+			want: []string{
+				"fun0 fun1 fun2 fun3: 3",
+				"fun4 fun5 fun1 fun6: 6",
+				"fun7 fun8: 9",
+				"fun9 fun4 fun10 fun7: 12",
+			},
+		},
+		{
+			desc:        "weights and column scales",
+			columnScale: []map[int]float64{{0: 2}, {0: 3}, nil},
+			want: []string{
+				"fun0 fun1 fun2 fun3: 7",
+				"fun4 fun5 fun1 fun6: 14",
+				"fun7 fun8: 21",
+				"fun9 fun4 fun10 fun7: 28",
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			pm.ColumnScale = tc.columnScale
+			merged, err := pm.Merge(srcs)
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if got := sampleFuncs(merged); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got samples %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	for _, w := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), -1} {
+		pm := &ProfileMerger{SourceWeight: func(p *Profile) float64 { return w }}
+		if _, err := pm.Merge(srcs); err == nil {
+			t.Errorf("merge with source weight %v: want error", w)
+		}
+	}
+}
+
+func TestMergeCapped(t *testing.T) {
+	p := noInlinesProfile.Copy()
+	q := noInlinesProfile.Copy()
+	q.Sample[0].Value[0] = 10
+	got, err := MergeCapped([]*Profile{p, q}, 2)
+	if err != nil {
+		t.Fatalf("MergeCapped: %v", err)
+	}
+	if err := got.CheckValid(); err != nil {
+		t.Fatalf("MergeCapped produced invalid profile: %v", err)
+	}
+	if got, want := strings.Join(sampleFuncs(got), "\n"), strings.Join([]string{
+		"fun7 fun8: 3",
+		"fun9 fun4 fun10 fun7: 8",
+		"<other>: 8",
+		"fun0 fun1 fun2 fun3: 10",
+	}, "\n"); got != want {
+		t.Errorf("MergeCapped got samples:\n%s\nwant:\n%s", got, want)
+	}
+	if _, err := MergeCapped([]*Profile{p}, -1); err == nil {
+		t.Errorf("MergeCapped with negative limit: want error")
+	}
+}
+
+func TestMergeStartLineWildcard(t *testing.T) {
+	withStart := noInlinesProfile.Copy()
+	for _, f := range withStart.Function {
+		f.StartLine = 42
+	}
+	for _, tc := range []struct {
+		desc string
+		srcs []*Profile
+	}{
+		{
+			desc: "zero first",
+			srcs: []*Profile{noInlinesProfile.Copy(), withStart.Copy(), noInlinesProfile.Copy()},
+		},
+		{
+			desc: "nonzero first",
+			srcs: []*Profile{withStart.Copy(), noInlinesProfile.Copy()},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, err := Merge(tc.srcs)
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if got, want := len(p.Function), 2*len(noInlinesProfile.Function); got != want {
+				t.Errorf("Merge got %d functions, want %d", got, want)
+			}
+			pm := &ProfileMerger{StartLineWildcard: true}
+			p, err = pm.Merge(tc.srcs)
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if got, want := len(p.Function), len(noInlinesProfile.Function); got != want {
+				t.Errorf("StartLineWildcard merge got %d functions, want %d", got, want)
+			}
+			for _, f := range p.Function {
+				if f.StartLine != 42 {
+					t.Errorf("StartLineWildcard merge got function %s start line %d, want 42", f.Name, f.StartLine)
+				}
+			}
+			if got, want := len(p.Sample), len(noInlinesProfile.Sample); got != want {
+				t.Errorf("StartLineWildcard merge got %d samples, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestMergeWithOffsets(t *testing.T) {
+	p1 := testProfile1.Copy()
+	p1.TimeNanos = 1000
+	p2 := testProfile1.Copy()
+	p2.TimeNanos = 1200
+
+	for _, tc := range []struct {
+		desc    string
+		srcs    []*Profile
+		offsets []int64
+		want    int64
+	}{
+		{
+			desc:    "no offsets",
+			offsets: []int64{0, 0},
+			want:    1000,
+		},
+		{
+			desc:    "skewed first clock",
+			offsets: []int64{500, 0},
+			want:    1200,
+		},
+		{
+			desc:    "skewed second clock",
+			offsets: []int64{0, -300},
+			want:    900,
+		},
+		{
+			desc:    "repeated profile",
+			srcs:    []*Profile{p1, p1},
+			offsets: []int64{0, -500},
+			want:    500,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			srcs := tc.srcs
+			if srcs == nil {
+				srcs = []*Profile{p1, p2}
+			}
+			p, err := MergeWithOffsets(srcs, tc.offsets)
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if p.TimeNanos != tc.want {
+				t.Errorf("got TimeNanos %d, want %d", p.TimeNanos, tc.want)
+			}
+		})
+	}
+
+	if _, err := MergeWithOffsets([]*Profile{p1, p2}, []int64{0}); err == nil {
+		t.Errorf("MergeWithOffsets with missing offsets: want error")
+	}
+}
+
+func TestMergeDiffs(t *testing.T) {
+	diff := func(values ...int64) *Profile {
+		p := noInlinesProfile.Copy()
+		for i, s := range p.Sample {
+			s.Value[0] = values[i]
+		}
+		return p
+	}
+	srcs := []*Profile{diff(1, -2, 0, 3), diff(-1, 2, 0, 1)}
+
+	for _, tc := range []struct {
+		desc     string
+		keepZero bool
+		want     []string
+	}{
+		{
+			desc:     "keep zero",
+			keepZero: true,
+			want: []string{
+				"fun0 fun1 fun2 fun3: 0",
+				"fun4 fun5 fun1 fun6: 0",
+				"fun7 fun8: 0",
+				"fun9 fun4 fun10 fun7: 4",
+			},
+		},
+		{
+			desc: "drop zero",
+			want: []string{
+				"fun9 fun4 fun10 fun7: 4",
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, err := MergeDiffs(srcs, tc.keepZero)
+			if err != nil {
+				t.Fatalf("MergeDiffs: %v", err)
+			}
+			if err := p.CheckValid(); err != nil {
+				t.Fatalf("merged profile is invalid: %v", err)
+			}
+			if got, want := strings.Join(sampleFuncs(p), "\n"), strings.Join(tc.want, "\n"); got != want {
+				t.Errorf("MergeDiffs got samples:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestMergePartialColumns(t *testing.T) {
+	a := testProfile1.Copy()
+	a.Scale(2)
+	// b only has placeholder zeros for its second sample type.
+	b := testProfile1.Copy()
+	for _, s := range b.Sample {
+		s.Value[0], s.Value[1] = 6*s.Value[0], 0
+	}
+	p, err := MergePartialColumns([]*Profile{a, b}, [][]bool{{true, true}, {true, false}})
+	if err != nil {
+		t.Fatalf("MergePartialColumns: %v", err)
+	}
+	for i, s := range p.Sample {
+		v := testProfile1.Sample[i].Value[0]
+		if got, want := s.Value, []int64{4 * v, 2 * v}; !reflect.DeepEqual(got, want) {
+			t.Errorf("sample %d got values %v, want %v", i, got, want)
+		}
+	}
+
+	withValues := func(values ...int64) *Profile {
+		p := noInlinesProfile.Copy()
+		for i, s := range p.Sample {
+			s.Value[0] = values[i]
+		}
+		return p
+	}
+	p, err = MergePartialColumns([]*Profile{
+		withValues(1, 1, 1, -1),
+		withValues(1, 2, 0, -2),
+		withValues(1, 2, 0, -2),
+	}, [][]bool{{true}, {true}, {true}})
+	if err != nil {
+		t.Fatalf("MergePartialColumns: %v", err)
+	}
+	// Means of 1, 5/3, 1/3 and -5/3.
+	want := []string{
+		"fun0 fun1 fun2 fun3: 1",
+		"fun4 fun5 fun1 fun6: 2",
+		"fun9 fun4 fun10 fun7: -2",
+	}
+	if got := sampleFuncs(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("MergePartialColumns got samples %q, want %q", got, want)
+	}
+	if err := p.CheckValid(); err != nil {
+		t.Errorf("MergePartialColumns produced an invalid profile: %v", err)
+	}
+
+	// A profile passed twice contributes as set for each position.
+	p, err = MergePartialColumns([]*Profile{a, a}, [][]bool{{true, true}, {false, true}})
+	if err != nil {
+		t.Fatalf("MergePartialColumns: %v", err)
+	}
+	for i, s := range p.Sample {
+		v := a.Sample[i].Value
+		if got, want := s.Value, []int64{v[0], v[1]}; !reflect.DeepEqual(got, want) {
+			t.Errorf("repeated profile: sample %d got values %v, want %v", i, got, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		desc        string
+		contributes [][]bool
+	}{
+		{desc: "too few profiles", contributes: [][]bool{{true, true}}},
+		{desc: "too few sample types", contributes: [][]bool{{true, true}, {true}}},
+	} {
+		if _, err := MergePartialColumns([]*Profile{a, b}, tc.contributes); err == nil {
+			t.Errorf("MergePartialColumns with %s: want error", tc.desc)
+		}
+	}
+}
+
+func TestMergeReportUnmatched(t *testing.T) {
+	a := noInlinesProfile.Copy()
+	// b lacks the last stack of a, with a value of 4 out of 10, and
+	// adds a stack with a value of 5, so 5 out of 11.
+	b := noInlinesProfile.Copy()
+	b.Sample = append(b.Sample[:3], &Sample{
+		Location: []*Location{b.Location[0]},
+		Value:    []int64{5},
+	})
+	// Labels don't distinguish stacks.
+	b.Sample[0].Label = map[string][]string{"key": {"value"}}
+
+	pm := &ProfileMerger{ReportUnmatched: true}
+	if _, err := pm.Merge([]*Profile{a, b}); err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if got, want := pm.Stats().Unmatched, []float64{0.4, 5.0 / 11}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got unmatched fractions %v, want %v", got, want)
+	}
+
+	if _, err := pm.Merge([]*Profile{a, b, a}); err == nil {
+		t.Errorf("ReportUnmatched merge of 3 profiles: want error")
+	}
+	pm.ReportUnmatched = false
+	if _, err := pm.Merge([]*Profile{a, b}); err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if got := pm.Stats().Unmatched; got != nil {
+		t.Errorf("got unmatched fractions %v without ReportUnmatched, want none", got)
+	}
+}
+
+func TestMergeTrackVariance(t *testing.T) {
+	withValues := func(values ...int64) *Profile {
+		p := noInlinesProfile.Copy()
+		p.Sample = p.Sample[:len(values)]
+		for i, v := range values {
+			p.Sample[i].Value[0] = v
+		}
+		return p
+	}
+	srcs := []*Profile{withValues(1, 2, 3, 4), withValues(3, 2, 3, 4), withValues(4, 2, 3)}
+
+	pm := &ProfileMerger{TrackVariance: true}
+	if _, err := pm.Merge(srcs); err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	vp := pm.Variance()
+	if vp == nil {
+		t.Fatalf("Variance got nil, want a profile")
+	}
+	if err := vp.CheckValid(); err != nil {
+		t.Fatalf("Variance profile is invalid: %v", err)
+	}
+	// The variance of 1, 3 and 4 is 14/9, and of 4, 4 and 0 is 32/9.
+	want := []string{
+		"fun0 fun1 fun2 fun3: 2",
+		"fun4 fun5 fun1 fun6: 0",
+		"fun7 fun8: 0",
+		"fun9 fun4 fun10 fun7: 4",
+	}
+	if got, want := strings.Join(sampleFuncs(vp), "\n"), strings.Join(want, "\n"); got != want {
+		t.Errorf("Variance got samples:\n%s\nwant:\n%s", got, want)
+	}
+	if got, want := vp.SampleType[0].Unit, "count^2"; got != want {
+		t.Errorf("Variance got unit %q, want %q", got, want)
+	}
+
+	pm.TrackVariance = false
+	if _, err := pm.Merge(srcs); err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if vp := pm.Variance(); vp != nil {
+		t.Errorf("Variance without TrackVariance got a profile, want nil")
+	}
+}
+
+func TestMergeRequireSameDefault(t *testing.T) {
+	withDefault := func(dst string) *Profile {
+		p := testProfile1.Copy()
+		p.DefaultSampleType = dst
+		return p
+	}
+	for _, tc := range []struct {
+		desc    string
+		srcs    []*Profile
+		want    string
+		wantErr bool
+	}{
+		{
+			desc: "same defaults",
+			srcs: []*Profile{withDefault("cpu"), withDefault("cpu")},
+			want: "cpu",
+		},
+		{
+			desc: "some empty defaults",
+			srcs: []*Profile{withDefault(""), withDefault("cpu"), withDefault("")},
+			want: "cpu",
+		},
+		{
+			desc:    "conflicting defaults",
+			srcs:    []*Profile{withDefault("cpu"), withDefault(""), withDefault("samples")},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, err := (&ProfileMerger{RequireSameDefault: true}).Merge(tc.srcs)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Merge got error %v, want error %v", err, tc.wantErr)
+			}
+			if err == nil && p.DefaultSampleType != tc.want {
+				t.Errorf("got default sample type %q, want %q", p.DefaultSampleType, tc.want)
+			}
+		})
+	}
+}
+
+func TestMergeLineWildcard(t *testing.T) {
+	noLines := testProfile1.Copy()
+	for _, l := range noLines.Location {
+		for i := range l.Line {
+			l.Line[i].Line = 0
+		}
+	}
+	for _, m := range noLines.Mapping {
+		m.HasLineNumbers = false
+	}
+	want, err := Merge([]*Profile{testProfile1.Copy(), testProfile1.Copy()})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		desc string
+		srcs []*Profile
+	}{
+		{
+			desc: "line numbers first",
+			srcs: []*Profile{testProfile1.Copy(), noLines},
+		},
+		{
+			desc: "line numbers last",
+			srcs: []*Profile{noLines, testProfile1.Copy()},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p, err := Merge(tc.srcs)
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if len(p.Location) == len(want.Location) {
+				t.Errorf("merge without LineWildcard got %d locations, want more", len(p.Location))
+			}
+
+			p, err = (&ProfileMerger{LineWildcard: true}).Merge(tc.srcs)
+			if err != nil {
+				t.Fatalf("merge error: %v", err)
+			}
+			if got, want := p.String(), want.String(); got != want {
+				diff, err := proftest.Diff([]byte(want), []byte(got))
+				if err != nil {
+					t.Fatalf("failed to get diff: %v", err)
+				}
+				t.Errorf("LineWildcard merge: got diff(want->got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMergeIgnoreLabelsForKey(t *testing.T) {
+	p := noInlinesProfile.Copy()
+	dup := func(s *Sample, v int64, host string, pid int64) *Sample {
+		return &Sample{
+			Location: s.Location,
+			Value:    []int64{v},
+			Label:    map[string][]string{"host": {host}, "region": {"us"}},
+			NumLabel: map[string][]int64{"pid": {pid}},
+		}
+	}
+	s := p.Sample
+	p.Sample = []*Sample{
+		dup(s[0], 1, "a", 1),
+		dup(s[0], 2, "b", 2),
+		dup(s[1], 4, "c", 3),
+	}
+	other := dup(s[0], 8, "d", 4)
+	other.Label["region"] = []string{"eu"}
+	p.Sample = append(p.Sample, other)
+
+	pm := &ProfileMerger{IgnoreLabelsForKey: []string{"host", "pid"}}
+	merged, err := pm.Merge([]*Profile{p})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	var got []string
+	for _, s := range merged.Sample {
+		got = append(got, fmt.Sprintf("%v %v %v %v", s.Value, s.Label["host"], s.Label["region"], s.NumLabel["pid"]))
+	}
+	// Samples with a different region are still distinct.
+	want := []string{
+		"[3] [a] [us] [1]",
+		"[4] [c] [us] [3]",
+		"[8] [d] [eu] [4]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %q, want %q", got, want)
+	}
+}
+
+func TestVerifyMergeTotals(t *testing.T) {
+	srcs := []*Profile{testProfile1.Copy(), testProfile1.Copy()}
+	merged, err := Merge(srcs)
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if err := VerifyMergeTotals(srcs, merged); err != nil {
+		t.Errorf("VerifyMergeTotals got error %v, want none", err)
+	}
+
+	merged.Sample = merged.Sample[1:]
+	err = VerifyMergeTotals(srcs, merged)
+	if err == nil {
+		t.Fatalf("VerifyMergeTotals with a dropped sample: want error")
+	}
+	if want := "cpu/milliseconds: got 20222, want 22222 (-2000)"; !strings.Contains(err.Error(), want) {
+		t.Errorf("VerifyMergeTotals got error %q, want it to contain %q", err, want)
+	}
+}
+
+func TestMergeFunctionUnify(t *testing.T) {
+	frame := func(name, file string, v int64) *Profile {
+		f := &Function{ID: 1, Name: name, SystemName: name, Filename: file}
+		l := &Location{ID: 1, Line: []Line{{Function: f, Line: 10}}}
+		return &Profile{
+			SampleType: []*ValueType{{Type: "samples", Unit: "count"}},
+			PeriodType: &ValueType{Type: "cpu", Unit: "nanoseconds"},
+			Sample:     []*Sample{{Location: []*Location{l}, Value: []int64{v}}},
+			Location:   []*Location{l},
+			Function:   []*Function{f},
+		}
+	}
+	srcs := []*Profile{
+		frame("py:work", "work.py", 1),
+		frame("work_native", "work.c", 2),
+		frame("work", "work.go", 4),
+		frame("other", "other.c", 8),
+	}
+
+	pm := &ProfileMerger{FunctionUnify: map[string]string{
+		"py:work":     "work",
+		"work_native": "work",
+	}}
+	merged, err := pm.Merge(srcs)
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if got, want := len(merged.Function), 2; got != want {
+		t.Errorf("got %d functions, want %d", got, want)
+	}
+	got, want := sampleFuncs(merged), []string{"work: 7", "other: 8"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %q, want %q", got, want)
+	}
+	if f := merged.Function[0]; f.Filename != "work.py" {
+		t.Errorf("unified function got file %q, want %q", f.Filename, "work.py")
+	}
+
+	// A single source is unified too.
+	pm.InputsCompacted = true
+	merged, err = pm.Merge(srcs[1:2])
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if got, want := sampleFuncs(merged), []string{"work: 2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %q, want %q", got, want)
+	}
+}
+
+func TestMergeKeepExemplars(t *testing.T) {
+	p := noInlinesProfile.Copy()
+	traced := func(s *Sample, v int64, traces ...string) *Sample {
+		return &Sample{
+			Location: s.Location,
+			Value:    []int64{v},
+			Label:    map[string][]string{"trace": traces, "region": {"us"}},
+		}
+	}
+	s := p.Sample
+	p.Sample = []*Sample{
+		traced(s[0], 1, "t1"),
+		traced(s[0], 2, "t2", "t3"),
+		traced(s[0], 4, "t1"),
+		traced(s[0], 8, "t4"),
+		traced(s[1], 16, "t5"),
+	}
+
+	pm := &ProfileMerger{}
+	pm.KeepExemplars("trace", 3)
+	merged, err := pm.Merge([]*Profile{p})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	var got []string
+	for _, s := range merged.Sample {
+		got = append(got, fmt.Sprintf("%v %v %v", s.Value, s.Label["trace"], s.Label["region"]))
+	}
+	want := []string{
+		"[15] [t1 t2 t3] [us]",
+		"[16] [t5] [us]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %q, want %q", got, want)
+	}
+	if got, want := p.Sample[1].Label["trace"], []string{"t2", "t3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("source sample got traces %q, want %q", got, want)
+	}
+}
+
+func TestMergeCollectLabel(t *testing.T) {
+	p := noInlinesProfile.Copy()
+	linked := func(s *Sample, v int64, link string) *Sample {
+		return &Sample{
+			Location: s.Location,
+			Value:    []int64{v},
+			Label:    map[string][]string{"link": {link}, "region": {"us"}},
+		}
+	}
+	s := p.Sample
+	p.Sample = []*Sample{
+		linked(s[0], 1, "l1"),
+		linked(s[0], 2, "l2"),
+		linked(s[1], 4, "l3"),
+	}
+	q := p.Copy()
+	for i, s := range q.Sample {
+		s.Label["link"] = []string{fmt.Sprintf("l%d", i+4)}
+	}
+
+	pm := &ProfileMerger{}
+	pm.CollectLabel("link", "links", 2)
+	merged, err := pm.Merge([]*Profile{p, q})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	samples := func(p *Profile) []string {
+		var got []string
+		for _, s := range p.Sample {
+			got = append(got, fmt.Sprintf("%v %v %v %v", s.Value, s.Label["link"], s.Label["links"], s.Label["region"]))
+		}
+		return got
+	}
+	want := []string{
+		"[6] [] [l1 l2] [us]",
+		"[8] [] [l3 l6] [us]",
+	}
+	if got := samples(merged); !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %q, want %q", got, want)
+	}
+
+	// Merging again collects the values already collected.
+	pm.CollectLabel("link", "links", 3)
+	remerged, err := pm.Merge([]*Profile{merged, q})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	want = []string{
+		"[9] [] [l1 l2 l4] [us]",
+		"[12] [] [l3 l6] [us]",
+	}
+	if got := samples(remerged); !reflect.DeepEqual(got, want) {
+		t.Errorf("merging again got samples %q, want %q", got, want)
+	}
+}
+
+func TestDeltaSince(t *testing.T) {
+	pm := &ProfileMerger{}
+	if _, err := pm.DeltaSince(testProfile1); err == nil {
+		t.Errorf("DeltaSince before merging: want error")
+	}
+
+	prev, err := pm.Merge([]*Profile{testProfile1.Copy()})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	more := testProfile1.Copy()
+	more.Sample = more.Sample[1:3]
+	cur, err := pm.Merge([]*Profile{prev, more})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	orig := prev.String()
+
+	delta, err := pm.DeltaSince(prev)
+	if err != nil {
+		t.Fatalf("DeltaSince: %v", err)
+	}
+	if got := prev.String(); got != orig {
+		t.Errorf("DeltaSince modified prev")
+	}
+	if got, want := len(delta.Sample), 2; got != want {
+		t.Errorf("delta got %d samples, want %d", got, want)
+	}
+	applied, err := Merge([]*Profile{prev, delta})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	if got, want := sampleValuesByStack(applied), sampleValuesByStack(cur); !reflect.DeepEqual(got, want) {
+		t.Errorf("prev merged with delta got samples %v, want %v", got, want)
+	}
+
+	incompatible := testProfile1.Copy()
+	incompatible.PeriodType = &ValueType{Type: "wall", Unit: "milliseconds"}
+	if _, err := pm.DeltaSince(incompatible); err == nil {
+		t.Errorf("DeltaSince with incompatible profile: want error")
+	}
+}
+
+func TestMergeSampleOrder(t *testing.T) {
+	p := noInlinesProfile.Copy()
+	s := p.Sample
+	dup := func(s *Sample, v int64) *Sample {
+		return &Sample{Location: s.Location, Value: []int64{v}}
+	}
+	p.Sample = []*Sample{s[2], s[0], dup(s[2], 10), s[3], dup(s[1], 0), dup(s[0], 10)}
+
+	// Duplicates and zero samples are removed without moving the other
+	// samples.
+	want := []string{
+		"fun7 fun8: 13",
+		"fun0 fun1 fun2 fun3: 11",
+		"fun9 fun4 fun10 fun7: 4",
+	}
+	if got, want := strings.Join(sampleFuncs(p.Compact()), "\n"), strings.Join(want, "\n"); got != want {
+		t.Errorf("Compact got samples:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Samples first found in later profiles follow those of earlier
+	// ones.
+	q := noInlinesProfile.Copy()
+	q.Sample = []*Sample{q.Sample[1], q.Sample[2]}
+	merged, err := Merge([]*Profile{p, q})
+	if err != nil {
+		t.Fatalf("merge error: %v", err)
+	}
+	want = []string{
+		"fun7 fun8: 16",
+		"fun0 fun1 fun2 fun3: 11",
+		"fun9 fun4 fun10 fun7: 4",
+		"fun4 fun5 fun1 fun6: 2",
+	}
+	if got, want := strings.Join(sampleFuncs(merged), "\n"), strings.Join(want, "\n"); got != want {
+		t.Errorf("Merge got samples:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCompactStats(t *testing.T) {
+	p := testProfile1.Copy()
+	p.Sample = p.Sample[:2]
+	p.Sample = append(p.Sample, &Sample{
+		Location: []*Location{p.Location[0]},
+		Value:    []int64{0, 0},
+	})
+	c, got := p.CompactStats()
+	if want := (CompactResult{Samples: 1, Locations: 3, Functions: 0, Mappings: 2}); got != want {
+		t.Errorf("CompactStats got %+v, want %+v", got, want)
+	}
+	if got, want := len(c.Sample), 2; got != want {
+		t.Errorf("got %d samples, want %d", got, want)
+	}
+}
+
+func TestSampleKeyLabels(t *testing.T) {
+	for _, tc := range []struct {
+		desc  string
+		a, b  *Sample
+		equal bool
+	}{{
+		desc:  "same labels",
+		a:     &Sample{Label: map[string][]string{"a": {"x"}, "b": {"y"}}},
+		b:     &Sample{Label: map[string][]string{"b": {"y"}, "a": {"x"}}},
+		equal: true,
+	}, {
+		desc: "quote moved between key and value",
+		a:    &Sample{Label: map[string][]string{`a"`: {`"b`}}},
+		b:    &Sample{Label: map[string][]string{`a`: {`""b`}}},
+	}, {
+		desc: "backslash in key and value",
+		a:    &Sample{Label: map[string][]string{`a\`: {`b`}}},
+		b:    &Sample{Label: map[string][]string{`a`: {`\b`}}},
+	}, {
+		desc: "value split across labels",
+		a:    &Sample{Label: map[string][]string{"k": {"ab"}}},
+		b:    &Sample{Label: map[string][]string{"k": {"a", "b"}}},
+	}, {
+		desc:  "quoted labels",
+		a:     &Sample{Label: map[string][]string{`"\"`: {`\"\\`, `"`}}},
+		b:     &Sample{Label: map[string][]string{`"\"`: {`\"\\`, `"`}}},
+		equal: true,
+	}, {
+		desc: "numeric units moved between keys",
+		a: &Sample{
+			NumLabel: map[string][]int64{"a": {1}, "b": {2}},
+			NumUnit:  map[string][]string{"a": {"bytes"}},
+		},
+		b: &Sample{
+			NumLabel: map[string][]int64{"a": {1}, "b": {2}},
+			NumUnit:  map[string][]string{"b": {"bytes"}},
+		},
+	}, {
+		desc: "numeric values split",
+		a:    &Sample{NumLabel: map[string][]int64{"a": {12}}},
+		b:    &Sample{NumLabel: map[string][]int64{"a": {1, 2}}},
+	}} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := tc.a.key() == tc.b.key(); got != tc.equal {
+				t.Errorf("key equality got %v, want %v", got, tc.equal)
+			}
+		})
+	}
+}
+
+func TestShard(t *testing.T) {
+	for _, tc := range []struct {
+		n, want int
+	}{{0, 1}, {1, 1}, {2, 2}, {5, 5}} {
+		t.Run(fmt.Sprintf("%d shards", tc.n), func(t *testing.T) {
+			p := testProfile1.Copy()
+			shards := p.Shard(tc.n)
+			if got, want := len(shards), tc.want; got != want {
+				t.Fatalf("Shard got %d shards, want %d", got, want)
+			}
+			var samples int
+			for _, s := range shards {
+				if err := s.CheckValid(); err != nil {
+					t.Fatalf("invalid shard: %v", err)
+				}
+				if got, want := s.Period, p.Period; got != want {
+					t.Errorf("shard period got %d, want %d", got, want)
+				}
+				samples += len(s.Sample)
+			}
+			if got, want := samples, len(p.Sample); got != want {
+				t.Errorf("shards got %d samples, want %d", got, want)
+			}
+			merged, err := Merge(shards)
+			if err != nil {
+				t.Fatalf("Merge: %v", err)
+			}
+			want := p.Compact()
+			if got, want := sampleValuesByStack(merged), sampleValuesByStack(want); !reflect.DeepEqual(got, want) {
+				t.Errorf("merged shards got samples %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSplitByThread(t *testing.T) {
+	p := noInlinesProfile.Copy()
+	p.Sample[0].NumLabel = map[string][]int64{"thread": {7}}
+	p.Sample[1].Label = map[string][]string{"thread": {"main"}}
+	p.Sample[2].NumLabel = map[string][]int64{"thread": {7}}
+
+	threads := p.SplitByThread("thread")
+	want := map[string][]string{
+		"7":    {"fun0 fun1 fun2 fun3: 1", "fun7 fun8: 3"},
+		"main": {"fun4 fun5 fun1 fun6: 2"},
+		"":     {"fun9 fun4 fun10 fun7: 4"},
+	}
+	if got, want := len(threads), len(want); got != want {
+		t.Fatalf("SplitByThread got %d threads, want %d", got, want)
+	}
+	for thread, funcs := range want {
+		tp := threads[thread]
+		if tp == nil {
+			t.Errorf("SplitByThread got no profile for thread %q", thread)
+			continue
+		}
+		if err := tp.CheckValid(); err != nil {
+			t.Errorf("thread %q: invalid profile: %v", thread, err)
+		}
+		if got, want := strings.Join(sampleFuncs(tp), "\n"), strings.Join(funcs, "\n"); got != want {
+			t.Errorf("thread %q got samples:\n%s\nwant:\n%s", thread, got, want)
+		}
+		if got, want := tp.DurationNanos, p.DurationNanos; got != want {
+			t.Errorf("thread %q got duration %d, want %d", thread, got, want)
+		}
+	}
+	if got, want := len(threads["main"].Location), 4; got != want {
+		t.Errorf("thread %q got %d locations, want %d", "main", got, want)
+	}
+}
+
+// sampleValuesByStack returns the values of the samples of p by a
+// string of their call stacks and labels, comparable across profiles.
+func sampleValuesByStack(p *Profile) map[string][]int64 {
+	values := make(map[string][]int64, len(p.Sample))
+	for _, s := range p.Sample {
+		var stack []string
+		for _, l := range s.Location {
+			stack = append(stack, fmt.Sprintf("%#x", l.Address))
+			for _, ln := range l.Line {
+				stack = append(stack, fmt.Sprintf("%s:%d", ln.Function.Name, ln.Line))
+			}
+		}
+		k := strings.Join(stack, ";") + fmt.Sprint(s.Label, s.NumLabel)
+		values[k] = append(values[k], s.Value...)
+	}
+	return values
+}
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -57,6 +58,10 @@ type Profile struct {
 	keepFramesX        int64
 	stringTable        []string
 	defaultSampleTypeX int64
+
+	// Lazily built lookup tables by ID, see LocationByID.
+	indexMu sync.Mutex
+	index   idIndex
 }
 
 // ValueType corresponds to Profile.ValueType
@@ -408,6 +413,154 @@ func (p *Profile) CheckValid() error {
 	return nil
 }
 
+// Repair fixes the problems reported by CheckValid that can be fixed
+// without rejecting the whole profile, such as those of profiles from
+// unreliable exporters, and returns a description of each fix. Nil
+// entities are removed, as are samples without the right number of
+// values and entities listed more than once in the profile tables.
+// References to locations, functions and mappings missing from the
+// profile tables are removed too: such frames are dropped from the call
+// stacks, such lines from the locations, and locations lose such a
+// mapping. Entities with a zero or duplicate ID are given new IDs.
+func (p *Profile) Repair() []string {
+	var repairs []string
+	report := func(n int, format string) {
+		if n > 0 {
+			repairs = append(repairs, fmt.Sprintf(format, n))
+		}
+	}
+
+	var nilEntities, duplicates int
+	mappings := make(map[*Mapping]bool, len(p.Mapping))
+	maps := p.Mapping[:0]
+	for _, m := range p.Mapping {
+		switch {
+		case m == nil:
+			nilEntities++
+		case mappings[m]:
+			duplicates++
+		default:
+			mappings[m] = true
+			maps = append(maps, m)
+		}
+	}
+	p.Mapping = maps
+	functions := make(map[*Function]bool, len(p.Function))
+	funcs := p.Function[:0]
+	for _, f := range p.Function {
+		switch {
+		case f == nil:
+			nilEntities++
+		case functions[f]:
+			duplicates++
+		default:
+			functions[f] = true
+			funcs = append(funcs, f)
+		}
+	}
+	p.Function = funcs
+	locations := make(map[*Location]bool, len(p.Location))
+	locs := p.Location[:0]
+	for _, l := range p.Location {
+		switch {
+		case l == nil:
+			nilEntities++
+		case locations[l]:
+			duplicates++
+		default:
+			locations[l] = true
+			locs = append(locs, l)
+		}
+	}
+	p.Location = locs
+	report(nilEntities, "removed %d nil locations, functions and mappings")
+	report(duplicates, "removed %d duplicate locations, functions and mappings")
+
+	var missing int
+	for _, l := range p.Location {
+		if l.Mapping != nil && !mappings[l.Mapping] {
+			l.Mapping = nil
+			missing++
+		}
+		lines := l.Line[:0]
+		for _, ln := range l.Line {
+			if ln.Function != nil && !functions[ln.Function] {
+				missing++
+				continue
+			}
+			lines = append(lines, ln)
+		}
+		l.Line = lines
+	}
+
+	samples := p.Sample[:0]
+	var nilSamples, badSamples, nilFrames int
+	for _, s := range p.Sample {
+		switch {
+		case s == nil:
+			nilSamples++
+			continue
+		case len(s.Value) != len(p.SampleType):
+			badSamples++
+			continue
+		}
+		locs := s.Location[:0]
+		for _, l := range s.Location {
+			switch {
+			case l == nil:
+				nilFrames++
+			case !locations[l]:
+				missing++
+			default:
+				locs = append(locs, l)
+			}
+		}
+		s.Location = locs
+		samples = append(samples, s)
+	}
+	p.Sample = samples
+	report(nilSamples, "removed %d nil samples")
+	report(badSamples, "removed %d samples with the wrong number of values")
+	report(nilFrames, "removed %d nil locations from call stacks")
+	report(missing, "removed %d references to missing locations, functions and mappings")
+
+	var mappingIDs, functionIDs, locationIDs []*uint64
+	for _, m := range p.Mapping {
+		mappingIDs = append(mappingIDs, &m.ID)
+	}
+	for _, f := range p.Function {
+		functionIDs = append(functionIDs, &f.ID)
+	}
+	for _, l := range p.Location {
+		locationIDs = append(locationIDs, &l.ID)
+	}
+	renumbered := fixIDs(mappingIDs) + fixIDs(functionIDs) + fixIDs(locationIDs)
+	report(renumbered, "renumbered %d entities with zero or duplicate IDs")
+	return repairs
+}
+
+// fixIDs gives the IDs in ids that are zero or already used a new ID
+// above all of them, and returns how many it changed.
+func fixIDs(ids []*uint64) int {
+	var max uint64
+	for _, id := range ids {
+		if *id > max {
+			max = *id
+		}
+	}
+	fixed := 0
+	seen := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		if *id == 0 || seen[*id] {
+			max++
+			*id = max
+			fixed++
+		}
+		seen[*id] = true
+	}
+	return fixed
+}
+
 // Aggregate merges the locations in the profile into equivalence
 // classes preserving the request attributes. It also updates the
 // samples to point to the merged locations.
@@ -723,15 +876,19 @@ func (p *Profile) Scale(ratio float64) {
 }
 
 // ScaleN multiplies each sample values in a sample by a different amount.
+// Returns an error without modifying the profile if any ratio is NaN or
+// infinite. Scaled values outside of the int64 range are clamped to it.
 func (p *Profile) ScaleN(ratios []float64) error {
 	if len(p.SampleType) != len(ratios) {
 		return fmt.Errorf("mismatched scale ratios, got %d, want %d", len(ratios), len(p.SampleType))
 	}
 	allOnes := true
-	for _, r := range ratios {
+	for i, r := range ratios {
+		if math.IsNaN(r) || math.IsInf(r, 0) {
+			return fmt.Errorf("invalid scale ratio %v for %s", r, p.SampleType[i].Type)
+		}
 		if r != 1 {
 			allOnes = false
-			break
 		}
 	}
 	if allOnes {
@@ -740,13 +897,47 @@ func (p *Profile) ScaleN(ratios []float64) error {
 	for _, s := range p.Sample {
 		for i, v := range s.Value {
 			if ratios[i] != 1 {
-				s.Value[i] = int64(float64(v) * ratios[i])
+				s.Value[i] = scaleValue(v, ratios[i])
 			}
 		}
 	}
 	return nil
 }
 
+// MapValues replaces the values of each sample with those returned by
+// fn for a copy of them, which fn may modify and return. Samples left
+// with only zero values are removed, along with the locations,
+// functions and mappings they alone used. Returns an error without
+// modifying the profile if fn returns the wrong number of values.
+func (p *Profile) MapValues(fn func(values []int64) []int64) error {
+	mapped := make([][]int64, len(p.Sample))
+	for i, s := range p.Sample {
+		values := fn(append([]int64(nil), s.Value...))
+		if len(values) != len(p.SampleType) {
+			return fmt.Errorf("mapped sample %d has %d values, want %d", i, len(values), len(p.SampleType))
+		}
+		mapped[i] = values
+	}
+	for i, s := range p.Sample {
+		s.Value = mapped[i]
+	}
+	p.dropZeroSamples()
+	p.removeUnused()
+	return nil
+}
+
+// scaleValue returns v multiplied by ratio, clamped to the int64 range.
+func scaleValue(v int64, ratio float64) int64 {
+	switch f := float64(v) * ratio; {
+	case f >= math.MaxInt64:
+		return math.MaxInt64
+	case f <= math.MinInt64:
+		return math.MinInt64
+	default:
+		return int64(f)
+	}
+}
+
 // HasFunctions determines if all locations in this profile have
 // symbolized function information.
 func (p *Profile) HasFunctions() bool {
@@ -769,6 +960,171 @@ func (p *Profile) HasFileLines() bool {
 	return true
 }
 
+// ForEachFunction calls fn for each function in the profile, ordered
+// by Name, then Filename, then SystemName, then StartLine, then ID. The
+// order does not depend on the order of p.Function, which varies with
+// the order in which profiles were merged.
+func (p *Profile) ForEachFunction(fn func(*Function)) {
+	funcs := make([]*Function, len(p.Function))
+	copy(funcs, p.Function)
+	sort.Slice(funcs, func(i, j int) bool {
+		a, b := funcs[i], funcs[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		if a.SystemName != b.SystemName {
+			return a.SystemName < b.SystemName
+		}
+		if a.StartLine != b.StartLine {
+			return a.StartLine < b.StartLine
+		}
+		return a.ID < b.ID
+	})
+	for _, f := range funcs {
+		fn(f)
+	}
+}
+
+// BuildIDs returns the distinct nonempty build IDs of the mappings of
+// p, sorted.
+func (p *Profile) BuildIDs() []string {
+	return p.mappingStrings(func(m *Mapping) string { return m.BuildID })
+}
+
+// Files returns the distinct nonempty file names of the mappings of p,
+// sorted.
+func (p *Profile) Files() []string {
+	return p.mappingStrings(func(m *Mapping) string { return m.File })
+}
+
+// mappingStrings returns the distinct nonempty values of field for the
+// mappings of p, sorted.
+func (p *Profile) mappingStrings(field func(*Mapping) string) []string {
+	seen := make(map[string]bool)
+	var values []string
+	for _, m := range p.Mapping {
+		if v := field(m); v != "" && !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+// FunctionsByFilename returns the functions of p grouped by their
+// source file name, in the order of p.Function. File names are used as
+// recorded, without normalizing their paths, and functions without a
+// file name are grouped under "".
+func (p *Profile) FunctionsByFilename() map[string][]*Function {
+	byFile := make(map[string][]*Function)
+	for _, f := range p.Function {
+		byFile[f.Filename] = append(byFile[f.Filename], f)
+	}
+	return byFile
+}
+
+// WalkLocations calls fn once for each distinct location of the
+// profile, in the order of p.Location. It is meant as the hook for
+// symbolizers to fill in the lines of locations that only have an
+// address: fn may modify the location, except for its ID. Call Compact
+// after symbolizing to merge locations that became identical.
+func (p *Profile) WalkLocations(fn func(*Location)) {
+	seen := make(map[*Location]bool, len(p.Location))
+	for _, l := range p.Location {
+		if !seen[l] {
+			seen[l] = true
+			fn(l)
+		}
+	}
+}
+
+// RebaseMapping moves the mapping m of p so that it starts at newStart,
+// shifting its limit and the addresses of all its locations by the same
+// amount, as when symbolizing against a binary loaded at a different
+// address. The profile is then compacted to merge locations that became
+// identical, which replaces its mappings, so m must not be used to refer
+// to the rebased mapping afterwards.
+func (p *Profile) RebaseMapping(m *Mapping, newStart uint64) {
+	delta := newStart - m.Start
+	m.Start += delta
+	m.Limit += delta
+	for _, l := range p.Location {
+		if l.Mapping == m && l.Address != 0 {
+			l.Address += delta
+		}
+	}
+	p.compact()
+}
+
+// RewritePaths replaces the prefix old of the file names of mappings and
+// functions with new, as when binaries are built or installed under
+// changing directories. The profile is then compacted to merge the
+// entities that became identical, which replaces its mappings,
+// functions and locations. Mappings with build IDs are still only merged
+// if their build IDs are equal.
+func (p *Profile) RewritePaths(old, new string) {
+	for _, m := range p.Mapping {
+		if strings.HasPrefix(m.File, old) {
+			m.File = new + m.File[len(old):]
+		}
+	}
+	for _, f := range p.Function {
+		if strings.HasPrefix(f.Filename, old) {
+			f.Filename = new + f.Filename[len(old):]
+		}
+	}
+	p.compact()
+}
+
+// ClusterFunctions renames every function to the result of calling
+// normalize with its name, and its system name to that of calling
+// normalize with its system name, so that functions with names that
+// normalize the same, such as the instantiations of a generic function
+// once type parameters are stripped, are merged into a representative
+// function when the profile is then compacted. Functions are only
+// merged if their file names and start lines are the same as well.
+// Compacting replaces the functions and locations of the profile.
+func (p *Profile) ClusterFunctions(normalize func(string) string) {
+	for _, f := range p.Function {
+		f.Name = normalize(f.Name)
+		f.SystemName = normalize(f.SystemName)
+	}
+	p.compact()
+}
+
+// Invert reverses the call stacks of all samples, so that they start at
+// their roots and end at their leaves, as used for inverted flame graphs.
+// If reverseLines is set, the inlined lines of each location are also
+// reversed, so that the sequence of all frames of each stack is exactly
+// reversed; otherwise they keep their innermost first order. The
+// profile is compacted afterwards.
+func (p *Profile) Invert(reverseLines bool) {
+	for _, s := range p.Sample {
+		locs := s.Location
+		for i, j := 0, len(locs)-1; i < j; i, j = i+1, j-1 {
+			locs[i], locs[j] = locs[j], locs[i]
+		}
+	}
+	if reverseLines {
+		seen := make(map[*Location]bool, len(p.Location))
+		for _, l := range p.Location {
+			if seen[l] {
+				continue
+			}
+			seen[l] = true
+			lines := l.Line
+			for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+				lines[i], lines[j] = lines[j], lines[i]
+			}
+		}
+	}
+	p.compact()
+}
+
 // Unsymbolizable returns true if a mapping points to a binary for which
 // locations can't be symbolized in principle, at least now. Examples are
 // "[vdso]", [vsyscall]" and some others, see the code.
@@ -789,3 +1145,32 @@ func (p *Profile) Copy() *Profile {
 
 	return pp
 }
+
+// Header returns a copy of the metadata of p, such as its sample and
+// period types, comments and times, without any sample, location,
+// function or mapping. It can be used as the base of a profile derived
+// from p.
+func (p *Profile) Header() *Profile {
+	h := &Profile{
+		DefaultSampleType: p.DefaultSampleType,
+		DropFrames:        p.DropFrames,
+		KeepFrames:        p.KeepFrames,
+		TimeNanos:         p.TimeNanos,
+		DurationNanos:     p.DurationNanos,
+		Period:            p.Period,
+	}
+	if p.PeriodType != nil {
+		h.PeriodType = &ValueType{Type: p.PeriodType.Type, Unit: p.PeriodType.Unit}
+	}
+	for _, st := range p.SampleType {
+		h.SampleType = append(h.SampleType, &ValueType{Type: st.Type, Unit: st.Unit})
+	}
+	h.Comments = append(h.Comments, p.Comments...)
+	return h
+}
+
+// DurationSeconds returns the duration of the profile in seconds, or
+// zero if it has no duration.
+func (p *Profile) DurationSeconds() float64 {
+	return float64(p.DurationNanos) / 1e9
+}
@@ -19,6 +19,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"path/filepath"
 	"reflect"
 	"strings"
@@ -910,6 +911,91 @@ func TestNormalizeIncompatibleProfiles(t *testing.T) {
 	}
 }
 
+func TestNormalizeAll(t *testing.T) {
+	profs := []*Profile{testProfile1.Copy(), testProfile1.Copy()}
+	if err := NormalizeAll(profs, testProfile2.Copy()); err != nil {
+		t.Fatal(err)
+	}
+	want := testProfile1.Copy()
+	if err := want.Normalize(testProfile2.Copy()); err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range profs {
+		if got, want := p.String(), want.String(); got != want {
+			t.Errorf("profile %d got:\n%s\nwant:\n%s", i, got, want)
+		}
+	}
+
+	profs = []*Profile{testProfile1.Copy(), testProfile3.Copy()}
+	if err := NormalizeAll(profs, testProfile2.Copy()); err == nil {
+		t.Fatalf("NormalizeAll with incompatible profile: want error")
+	}
+	if got, want := profs[0].String(), testProfile1.String(); got != want {
+		t.Errorf("NormalizeAll modified a profile despite an error")
+	}
+}
+
+func TestScaleToTotal(t *testing.T) {
+	p := testProfile1.Copy()
+	if err := p.ScaleToTotal(0, 2*totalSamples); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range p.Sample {
+		if got, want := s.Value[0], 2*testProfile1.Sample[i].Value[0]; got != want {
+			t.Errorf("For sample %d, value 0 want %d got %d", i, want, got)
+		}
+		if got, want := s.Value[1], testProfile1.Sample[i].Value[1]; got != want {
+			t.Errorf("For sample %d, value 1 want %d got %d", i, want, got)
+		}
+	}
+
+	if err := p.ScaleToTotal(2, 1); err == nil {
+		t.Errorf("ScaleToTotal with invalid index: want error")
+	}
+	p.Sample = nil
+	if err := p.ScaleToTotal(0, 1); err == nil {
+		t.Errorf("ScaleToTotal of zero values: want error")
+	}
+}
+
+func TestScaleNInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		desc       string
+		ratios     []float64
+		wantValues []int64
+		wantErr    bool
+	}{
+		{
+			desc:       "NaN ratio",
+			ratios:     []float64{math.NaN(), 1},
+			wantValues: []int64{1000, 1000},
+			wantErr:    true,
+		},
+		{
+			desc:       "infinite ratio",
+			ratios:     []float64{2, math.Inf(-1)},
+			wantValues: []int64{1000, 1000},
+			wantErr:    true,
+		},
+		{
+			desc:       "overflow is clamped",
+			ratios:     []float64{1e20, -1e20},
+			wantValues: []int64{math.MaxInt64, math.MinInt64},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := testProfile1.Copy()
+			err := p.ScaleN(tc.ratios)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ScaleN got error %v, want error %v", err, tc.wantErr)
+			}
+			if got := p.Sample[0].Value; !reflect.DeepEqual(got, tc.wantValues) {
+				t.Errorf("got values %v, want %v", got, tc.wantValues)
+			}
+		})
+	}
+}
+
 // locationHash constructs a string to use as a hashkey for a sample, based on its locations
 func locationHash(s *Sample) string {
 	var tb string
@@ -1388,3 +1474,335 @@ func TestThreadSafety(t *testing.T) {
 		src.Write(&b)
 	})
 }
+
+func TestForEachFunction(t *testing.T) {
+	p := &Profile{
+		Function: []*Function{
+			{ID: 1, Name: "foo", Filename: "b.c"},
+			{ID: 2, Name: "bar", Filename: "a.c"},
+			{ID: 3, Name: "foo", Filename: "a.c"},
+			{ID: 4, Name: "foo", Filename: "a.c", StartLine: 10},
+		},
+	}
+	var got []uint64
+	p.ForEachFunction(func(f *Function) {
+		got = append(got, f.ID)
+	})
+	if want := []uint64{2, 3, 4, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ForEachFunction visited IDs %v, want %v", got, want)
+	}
+	if p.Function[0].ID != 1 {
+		t.Errorf("ForEachFunction reordered p.Function")
+	}
+}
+
+func TestWalkLocations(t *testing.T) {
+	p := testProfile1.Copy()
+	p.Location = append(p.Location, p.Location[0])
+	var got []uint64
+	p.WalkLocations(func(l *Location) {
+		got = append(got, l.ID)
+	})
+	if want := []uint64{1000, 2000, 3000, 3001, 3002}; !reflect.DeepEqual(got, want) {
+		t.Errorf("WalkLocations visited IDs %v, want %v", got, want)
+	}
+}
+
+func TestRebaseMapping(t *testing.T) {
+	for _, tc := range []struct {
+		desc        string
+		newStart    uint64
+		wantStart   uint64
+		wantLimit   uint64
+		wantAddress uint64
+	}{
+		{
+			desc:        "higher address",
+			newStart:    0x80000,
+			wantStart:   0x80000,
+			wantLimit:   0xa0000,
+			wantAddress: 0x41000,
+		},
+		{
+			desc:        "lower address",
+			newStart:    0x40000,
+			wantStart:   0x40000,
+			wantLimit:   0x60000,
+			wantAddress: 0x1000,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := noInlinesProfile.Copy()
+			p.RebaseMapping(p.Mapping[1], tc.newStart)
+			m := p.Mapping[1]
+			if m.Start != tc.wantStart || m.Limit != tc.wantLimit {
+				t.Errorf("RebaseMapping got mapping [%#x, %#x), want [%#x, %#x)", m.Start, m.Limit, tc.wantStart, tc.wantLimit)
+			}
+			for _, l := range p.Location {
+				want := noInlinesLocs[l.ID-1].Address
+				if l.Mapping == m {
+					want = tc.wantAddress
+				}
+				if l.Address != want {
+					t.Errorf("RebaseMapping got address %#x for location %d, want %#x", l.Address, l.ID, want)
+				}
+			}
+		})
+	}
+}
+
+func TestInvert(t *testing.T) {
+	for _, tc := range []struct {
+		desc         string
+		p            *Profile
+		reverseLines bool
+		want         []string
+	}{
+		{
+			desc: "stacks",
+			p:    noInlinesProfile,
+			want: []string{
+				"fun3 fun2 fun1 fun0: 1",
+				"fun6 fun1 fun5 fun4: 2",
+				"fun8 fun7: 3",
+				"fun7 fun10 fun4 fun9: 4",
+			},
+		},
+		{
+			desc: "inlined lines kept",
+			p:    inlinesProfile,
+			want: []string{
+				"fun2 fun3 fun0 fun1: 1",
+				"fun4 fun5 fun6: 2",
+			},
+		},
+		{
+			desc:         "inlined lines reversed",
+			p:            inlinesProfile,
+			reverseLines: true,
+			want: []string{
+				"fun3 fun2 fun1 fun0: 1",
+				"fun6 fun5 fun4: 2",
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := tc.p.Copy()
+			p.Invert(tc.reverseLines)
+			if err := p.CheckValid(); err != nil {
+				t.Fatalf("Invert produced invalid profile: %v", err)
+			}
+			if got, want := strings.Join(sampleFuncs(p), "\n"), strings.Join(tc.want, "\n"); got != want {
+				t.Errorf("Invert got samples:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestBuildIDsAndFiles(t *testing.T) {
+	p := &Profile{
+		Mapping: []*Mapping{
+			{ID: 1, File: "/bin/main", BuildID: "b2"},
+			{ID: 2, File: "/lib/libc.so", BuildID: "b1"},
+			{ID: 3, File: "/lib/libc.so", BuildID: "b1"},
+			{ID: 4, File: "", BuildID: "b2"},
+			{ID: 5, File: "/lib/libm.so"},
+		},
+	}
+	if got, want := p.BuildIDs(), []string{"b1", "b2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("BuildIDs got %v, want %v", got, want)
+	}
+	if got, want := p.Files(), []string{"/bin/main", "/lib/libc.so", "/lib/libm.so"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Files got %v, want %v", got, want)
+	}
+	if got := (&Profile{}).BuildIDs(); len(got) != 0 {
+		t.Errorf("BuildIDs of profile without mappings got %v, want none", got)
+	}
+}
+
+func TestHeader(t *testing.T) {
+	p := testProfile1.Copy()
+	p.Comments = []string{"comment"}
+	p.DefaultSampleType = "cpu"
+	p.DropFrames = "drop"
+
+	h := p.Header()
+	if err := h.CheckValid(); err != nil {
+		t.Fatalf("Header is invalid: %v", err)
+	}
+	want := p.Copy()
+	want.Sample, want.Location, want.Function, want.Mapping = nil, nil, nil, nil
+	if got, want := h.String(), want.String(); got != want {
+		t.Errorf("Header got\n%s\nwant\n%s", got, want)
+	}
+
+	h.SampleType[0].Type = "changed"
+	h.PeriodType.Unit = "changed"
+	h.Comments[0] = "changed"
+	if p.SampleType[0].Type == "changed" || p.PeriodType.Unit == "changed" || p.Comments[0] == "changed" {
+		t.Errorf("Header shares metadata with the profile")
+	}
+}
+
+func TestRewritePaths(t *testing.T) {
+	prefixed := func(prefix string) *Profile {
+		p := testProfile1.Copy()
+		for _, m := range p.Mapping {
+			m.File = prefix + m.File
+		}
+		for _, f := range p.Function {
+			f.Filename = prefix + f.Filename
+		}
+		return p
+	}
+	p, err := Merge([]*Profile{prefixed("/build/123"), prefixed("/build/456")})
+	if err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	want, err := Merge([]*Profile{prefixed("/build/123"), prefixed("/build/123")})
+	if err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	if len(p.Mapping) == len(want.Mapping) {
+		t.Fatalf("profiles with different paths got %d mappings, want more than %d", len(p.Mapping), len(want.Mapping))
+	}
+
+	p.RewritePaths("/build/456", "/build/123")
+	if got, want := p.String(), want.String(); got != want {
+		diff, err := proftest.Diff([]byte(want), []byte(got))
+		if err != nil {
+			t.Fatalf("failed to get diff: %v", err)
+		}
+		t.Errorf("RewritePaths got diff(want->got):\n%s", diff)
+	}
+}
+
+func TestClusterFunctions(t *testing.T) {
+	p := &Profile{SampleType: []*ValueType{{Type: "samples", Unit: "count"}}}
+	for i, name := range []string{"Foo[int]", "Foo[string]", "Bar", "Foo[int]"} {
+		id := uint64(i + 1)
+		f := &Function{ID: id, Name: name, SystemName: name, Filename: "foo.go", StartLine: 10}
+		l := &Location{ID: id, Line: []Line{{Function: f, Line: 12}}}
+		p.Function = append(p.Function, f)
+		p.Location = append(p.Location, l)
+		p.Sample = append(p.Sample, &Sample{Location: []*Location{l}, Value: []int64{1 << uint(i)}})
+	}
+
+	p.ClusterFunctions(func(name string) string {
+		if i := strings.Index(name, "["); i >= 0 {
+			return name[:i] + "[T]"
+		}
+		return name
+	})
+	if got, want := len(p.Function), 2; got != want {
+		t.Errorf("got %d functions, want %d", got, want)
+	}
+	if got, want := sampleFuncs(p), []string{"Foo[T]: 11", "Bar: 4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %q, want %q", got, want)
+	}
+}
+
+func TestMapValues(t *testing.T) {
+	p := testProfile1.Copy()
+	// Keep the values above 100, in microseconds for the cpu sample type.
+	err := p.MapValues(func(values []int64) []int64 {
+		if values[0] <= 100 {
+			return []int64{0, 0}
+		}
+		values[1] *= 1000
+		return values
+	})
+	if err != nil {
+		t.Fatalf("MapValues: %v", err)
+	}
+	if err := p.CheckValid(); err != nil {
+		t.Fatalf("MapValues left an invalid profile: %v", err)
+	}
+	var got [][]int64
+	for _, s := range p.Sample {
+		got = append(got, s.Value)
+	}
+	if want := [][]int64{{1000, 1000000}, {10000, 10000000}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MapValues got values %v, want %v", got, want)
+	}
+	if got, want := len(p.Location), 2; got != want {
+		t.Errorf("MapValues left %d locations, want %d", got, want)
+	}
+
+	orig := p.String()
+	if err := p.MapValues(func(values []int64) []int64 { return values[:1] }); err == nil {
+		t.Errorf("MapValues with too few values: want error")
+	}
+	if got := p.String(); got != orig {
+		t.Errorf("failed MapValues modified the profile")
+	}
+}
+
+func TestRepair(t *testing.T) {
+	p := testProfile1.Copy()
+	if got := p.Repair(); len(got) != 0 {
+		t.Errorf("Repair of valid profile got repairs %v, want none", got)
+	}
+
+	// Drop a location and a function from the tables, but keep using
+	// them, and list others twice.
+	p.Location = p.Location[1:]
+	p.Function = p.Function[1:]
+	p.Location = append(p.Location, p.Location[0])
+	p.Function = append(p.Function, p.Function[0])
+	p.Location[1].ID = p.Location[0].ID
+	p.Mapping[2].ID = 0
+	p.Sample = append(p.Sample, nil, &Sample{Value: []int64{1}})
+	p.Sample[1].Location = append(p.Sample[1].Location, nil)
+	p.Mapping = append(p.Mapping, nil)
+	if err := p.CheckValid(); err == nil {
+		t.Fatalf("CheckValid of broken profile: want error")
+	}
+
+	want := []string{
+		"removed 1 nil locations, functions and mappings",
+		"removed 2 duplicate locations, functions and mappings",
+		"removed 1 nil samples",
+		"removed 1 samples with the wrong number of values",
+		"removed 1 nil locations from call stacks",
+		"removed 5 references to missing locations, functions and mappings",
+		"renumbered 2 entities with zero or duplicate IDs",
+	}
+	if got := p.Repair(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Repair got repairs %q, want %q", got, want)
+	}
+	if err := p.CheckValid(); err != nil {
+		t.Errorf("repaired profile is invalid: %v", err)
+	}
+	if got, want := len(p.Sample), len(testProfile1.Sample); got != want {
+		t.Errorf("repaired profile got %d samples, want %d", got, want)
+	}
+	if got, want := len(p.Location), len(testProfile1.Location)-1; got != want {
+		t.Errorf("repaired profile got %d locations, want %d", got, want)
+	}
+	if got, want := len(p.Function), len(testProfile1.Function)-1; got != want {
+		t.Errorf("repaired profile got %d functions, want %d", got, want)
+	}
+	if got := p.Repair(); len(got) != 0 {
+		t.Errorf("Repair of repaired profile got repairs %v, want none", got)
+	}
+}
+
+func TestFunctionsByFilename(t *testing.T) {
+	p := testProfile1.Copy()
+	p.Function = append(p.Function, &Function{ID: 4, Name: "anonymous"})
+	got := make(map[string][]string)
+	for file, fs := range p.FunctionsByFilename() {
+		for _, f := range fs {
+			got[file] = append(got[file], f.Name)
+		}
+	}
+	want := map[string][]string{
+		"main.c": {"main"},
+		"foo.c":  {"foo", "foo_caller"},
+		"":       {"anonymous"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FunctionsByFilename got %v, want %v", got, want)
+	}
+}
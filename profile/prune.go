@@ -176,3 +176,207 @@ func (p *Profile) PruneFrom(dropRx *regexp.Regexp) {
 		}
 	}
 }
+
+// CollapseBelow removes from each sample the frames called by the
+// frame closest to its root whose function matches re, including
+// inlined ones, so that their values are attributed to that frame as
+// flat values. Unlike PruneFrom, which cuts stacks at the matching
+// frame closest to the leaf, recursive calls of the matching function
+// are collapsed as well. The profile is compacted afterwards to merge
+// samples whose stacks became identical.
+func (p *Profile) CollapseBelow(re *regexp.Regexp) {
+	collapse := make(map[uint64]bool)
+	for _, loc := range p.Location {
+		for i := len(loc.Line) - 1; i >= 0; i-- {
+			if fn := loc.Line[i].Function; fn != nil && fn.Name != "" && re.MatchString(simplifyFunc(fn.Name)) {
+				collapse[loc.ID] = true
+				loc.Line = loc.Line[i:]
+				break
+			}
+		}
+	}
+	for _, s := range p.Sample {
+		for i := len(s.Location) - 1; i >= 0; i-- {
+			if collapse[s.Location[i].ID] {
+				s.Location = s.Location[i:]
+				break
+			}
+		}
+	}
+	p.compact()
+}
+
+// FoldRecursion collapses runs of consecutive frames of the same
+// functions in each sample into a single frame, so that a stack
+// [A, A, A, B] becomes [A, B]. The leaf-most location of each run is
+// kept, so flat values keep their exact location. Two frames are of the
+// same functions if they are the same location, or if their locations
+// have the same functions at every inlined line. If countKey is not
+// empty, the number of frames removed from a sample is recorded in its
+// numeric label countKey, which keeps samples folded from stacks of
+// different depths apart. Samples that become identical are merged.
+func (p *Profile) FoldRecursion(countKey string) {
+	for _, s := range p.Sample {
+		if len(s.Location) < 2 {
+			continue
+		}
+		locs := s.Location[:1]
+		for _, l := range s.Location[1:] {
+			if !sameFunctions(locs[len(locs)-1], l) {
+				locs = append(locs, l)
+			}
+		}
+		folded := int64(len(s.Location) - len(locs))
+		s.Location = locs
+		if countKey != "" && folded > 0 {
+			if s.NumLabel == nil {
+				s.NumLabel = make(map[string][]int64)
+			}
+			s.NumLabel[countKey] = []int64{folded}
+			if s.NumUnit != nil {
+				delete(s.NumUnit, countKey)
+			}
+		}
+	}
+	p.compact()
+}
+
+// sameFunctions returns whether two locations are the same or have the
+// same functions at every line.
+func sameFunctions(l1, l2 *Location) bool {
+	if l1 == l2 {
+		return true
+	}
+	if len(l1.Line) == 0 || len(l1.Line) != len(l2.Line) {
+		return false
+	}
+	for i := range l1.Line {
+		if l1.Line[i].Function != l2.Line[i].Function {
+			return false
+		}
+	}
+	return true
+}
+
+// externalFrame is the name of the frame standing for the frames removed
+// by TrimToFunctions.
+const externalFrame = "<external>"
+
+// TrimToFunctions keeps only the frames matching allow, replacing each
+// run of consecutive frames that don't match it with a single
+// "<external>" frame, so stacks keep their shape while only showing the
+// allowed code. A location is kept whole if any of its functions, file
+// names or mapping file matches allow. Sample values are unchanged, and
+// the profile is compacted afterwards to merge samples whose stacks
+// became identical.
+func (p *Profile) TrimToFunctions(allow *regexp.Regexp) {
+	external := p.syntheticLocation(externalFrame)
+	allowed := make(map[*Location]bool, len(p.Location))
+	for _, l := range p.Location {
+		allowed[l] = l.matchesName(allow)
+	}
+	used := false
+	for _, s := range p.Sample {
+		var locs []*Location
+		for _, l := range s.Location {
+			if allowed[l] {
+				locs = append(locs, l)
+			} else if len(locs) == 0 || locs[len(locs)-1] != external {
+				locs = append(locs, external)
+				used = true
+			}
+		}
+		s.Location = locs
+	}
+	if used {
+		p.addSyntheticLocation(external)
+	}
+	p.compact()
+}
+
+// syntheticLocation returns a location without mapping or address for a
+// new function named name, with IDs not used in p. It must be added to p
+// with addSyntheticLocation if used by any sample.
+func (p *Profile) syntheticLocation(name string) *Location {
+	var maxFunctionID, maxLocationID uint64
+	for _, f := range p.Function {
+		if f.ID > maxFunctionID {
+			maxFunctionID = f.ID
+		}
+	}
+	for _, l := range p.Location {
+		if l.ID > maxLocationID {
+			maxLocationID = l.ID
+		}
+	}
+	return &Location{
+		ID: maxLocationID + 1,
+		Line: []Line{{Function: &Function{
+			ID:         maxFunctionID + 1,
+			Name:       name,
+			SystemName: name,
+		}}},
+	}
+}
+
+// addSyntheticLocation adds l, returned by syntheticLocation, and its
+// function to p.
+func (p *Profile) addSyntheticLocation(l *Location) {
+	p.Location = append(p.Location, l)
+	p.Function = append(p.Function, l.Line[0].Function)
+}
+
+// TruncateKeep selects the end of the call stacks kept by TruncateDepth.
+type TruncateKeep int
+
+const (
+	// KeepLeaves keeps the frames closest to the leaves of the stacks,
+	// where values are spent.
+	KeepLeaves TruncateKeep = iota
+	// KeepRoots keeps the frames closest to the roots of the stacks.
+	KeepRoots
+)
+
+// truncatedFrame is the name of the frame standing for the frames
+// removed by TruncateDepth.
+const truncatedFrame = "<truncated>"
+
+// TruncateDepth trims the call stacks of all samples deeper than max
+// frames to max frames, keeping those at the end selected by keep. If
+// marker is set, a "<truncated>" frame is added in place of the removed
+// frames. The profile is compacted afterwards to merge samples whose
+// stacks became identical. Returns an error if max is not positive.
+func (p *Profile) TruncateDepth(max int, keep TruncateKeep, marker bool) error {
+	if max <= 0 {
+		return fmt.Errorf("maximum stack depth must be positive, got %d", max)
+	}
+	var truncated *Location
+	if marker {
+		truncated = p.syntheticLocation(truncatedFrame)
+	}
+	used := false
+	for _, s := range p.Sample {
+		if len(s.Location) <= max {
+			continue
+		}
+		locs := make([]*Location, 0, max+1)
+		if keep == KeepLeaves {
+			locs = append(locs, s.Location[:max]...)
+			if truncated != nil {
+				locs = append(locs, truncated)
+			}
+		} else {
+			if truncated != nil {
+				locs = append(locs, truncated)
+			}
+			locs = append(locs, s.Location[len(s.Location)-max:]...)
+		}
+		s.Location = locs
+		used = true
+	}
+	if used && truncated != nil {
+		p.addSyntheticLocation(truncated)
+	}
+	p.compact()
+	return nil
+}
@@ -15,6 +15,8 @@
 package profile
 
 import (
+	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 )
@@ -228,3 +230,267 @@ Locations
      5: 0x0 Foo::operator()(::Bar) fun.c:1 s=0
 Mappings
 `
+
+var recursionLocs = []*Location{
+	{ID: 1, Mapping: mappings[0], Address: 0x1000, Line: []Line{{Function: functions[0], Line: 1}}},
+	{ID: 2, Mapping: mappings[0], Address: 0x1010, Line: []Line{{Function: functions[0], Line: 2}}},
+	{ID: 3, Mapping: mappings[0], Address: 0x1020, Line: []Line{{Function: functions[0], Line: 3}}},
+	{ID: 4, Mapping: mappings[0], Address: 0x2000, Line: []Line{{Function: functions[1], Line: 1}}},
+	{ID: 5, Mapping: mappings[0], Address: 0x3000, Line: []Line{{Function: functions[2], Line: 1}}},
+}
+
+// recursionProfile has samples with recursive calls to fun0.
+var recursionProfile = &Profile{
+	TimeNanos:     10000,
+	PeriodType:    &ValueType{Type: "cpu", Unit: "milliseconds"},
+	Period:        1,
+	DurationNanos: 10e9,
+	SampleType:    []*ValueType{{Type: "samples", Unit: "count"}},
+	Mapping:       mappings,
+	Function:      functions,
+	Location:      recursionLocs,
+	Sample: []*Sample{
+		{Value: []int64{1}, Location: []*Location{recursionLocs[0], recursionLocs[1], recursionLocs[2], recursionLocs[3]}},
+		{Value: []int64{2}, Location: []*Location{recursionLocs[0], recursionLocs[3]}},
+		{Value: []int64{4}, Location: []*Location{recursionLocs[0], recursionLocs[3], recursionLocs[1], recursionLocs[4]}},
+		{Value: []int64{8}, Location: []*Location{recursionLocs[4], recursionLocs[4]}},
+	},
+}
+
+func TestCollapseBelow(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		p         *Profile
+		re        string
+		wantFuncs []string
+	}{
+		{
+			desc:      "leaf anchor",
+			p:         noInlinesProfile,
+			re:        "fun0",
+			wantFuncs: allNoInlinesSampleFuncs,
+		},
+		{
+			desc: "middle anchor",
+			p:    noInlinesProfile,
+			re:   "^fun1$",
+			wantFuncs: []string{
+				"fun1 fun2 fun3: 1",
+				"fun1 fun6: 2",
+				"fun7 fun8: 3",
+				"fun9 fun4 fun10 fun7: 4",
+			},
+		},
+		{
+			desc: "root anchor",
+			p:    noInlinesProfile,
+			re:   "fun3|fun7",
+			wantFuncs: []string{
+				"fun3: 1",
+				"fun4 fun5 fun1 fun6: 2",
+				"fun7 fun8: 3",
+				"fun7: 4",
+			},
+		},
+		{
+			desc: "inlined anchor",
+			p:    inlinesProfile,
+			re:   "fun5",
+			wantFuncs: []string{
+				"fun0 fun1 fun2 fun3: 1",
+				"fun5 fun6: 2",
+			},
+		},
+		{
+			desc: "recursive anchor",
+			p:    recursionProfile,
+			re:   "fun0",
+			wantFuncs: []string{
+				"fun0 fun1: 1",
+				"fun0 fun1: 2",
+				"fun0 fun2: 4",
+				"fun2 fun2: 8",
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := tc.p.Copy()
+			p.CollapseBelow(regexp.MustCompile(tc.re))
+			if err := p.CheckValid(); err != nil {
+				t.Fatalf("CollapseBelow produced an invalid profile: %v", err)
+			}
+			if got := sampleFuncs(p); !reflect.DeepEqual(got, tc.wantFuncs) {
+				t.Errorf("got samples %q, want %q", got, tc.wantFuncs)
+			}
+		})
+	}
+}
+
+func TestFoldRecursion(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		countKey  string
+		wantFuncs []string
+		wantCount []int64
+	}{
+		{
+			desc: "fold recursion",
+			wantFuncs: []string{
+				"fun0 fun1: 3",
+				"fun0 fun1 fun0 fun2: 4",
+				"fun2: 8",
+			},
+		},
+		{
+			desc:     "fold recursion with count",
+			countKey: "folded",
+			wantFuncs: []string{
+				"fun0 fun1: 1",
+				"fun0 fun1: 2",
+				"fun0 fun1 fun0 fun2: 4",
+				"fun2: 8",
+			},
+			wantCount: []int64{2, 0, 0, 1},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := recursionProfile.Copy()
+			p.FoldRecursion(tc.countKey)
+			if err := p.CheckValid(); err != nil {
+				t.Fatalf("FoldRecursion produced invalid profile: %v", err)
+			}
+			if got, want := strings.Join(sampleFuncs(p), "\n"), strings.Join(tc.wantFuncs, "\n"); got != want {
+				t.Errorf("FoldRecursion got samples:\n%s\nwant:\n%s", got, want)
+			}
+			for i, want := range tc.wantCount {
+				var got int64
+				if v := p.Sample[i].NumLabel[tc.countKey]; len(v) > 0 {
+					got = v[0]
+				}
+				if got != want {
+					t.Errorf("sample %d got folded count %d, want %d", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTrimToFunctions(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		allow     *regexp.Regexp
+		wantFuncs []string
+	}{
+		{
+			desc:  "runs of external frames",
+			allow: regexp.MustCompile("^fun[0-3]$"),
+			wantFuncs: []string{
+				"fun0 fun1 fun2 fun3: 1",
+				"<external> fun1 <external>: 2",
+				"<external>: 7",
+			},
+		},
+		{
+			desc:      "all allowed",
+			allow:     regexp.MustCompile("fun"),
+			wantFuncs: allNoInlinesSampleFuncs,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := noInlinesProfile.Copy()
+			p.TrimToFunctions(tc.allow)
+			if err := p.CheckValid(); err != nil {
+				t.Fatalf("TrimToFunctions produced invalid profile: %v", err)
+			}
+			if got, want := strings.Join(sampleFuncs(p), "\n"), strings.Join(tc.wantFuncs, "\n"); got != want {
+				t.Errorf("TrimToFunctions got samples:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestTruncateDepth(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		max       int
+		keep      TruncateKeep
+		marker    bool
+		wantFuncs []string
+		wantErr   bool
+	}{
+		{
+			desc: "keep leaves",
+			max:  2,
+			keep: KeepLeaves,
+			wantFuncs: []string{
+				"fun0 fun1: 1",
+				"fun4 fun5: 2",
+				"fun7 fun8: 3",
+				"fun9 fun4: 4",
+			},
+		},
+		{
+			desc: "keep roots",
+			max:  2,
+			keep: KeepRoots,
+			wantFuncs: []string{
+				"fun2 fun3: 1",
+				"fun1 fun6: 2",
+				"fun7 fun8: 3",
+				"fun10 fun7: 4",
+			},
+		},
+		{
+			desc:   "keep leaves with marker",
+			max:    3,
+			keep:   KeepLeaves,
+			marker: true,
+			wantFuncs: []string{
+				"fun0 fun1 fun2 <truncated>: 1",
+				"fun4 fun5 fun1 <truncated>: 2",
+				"fun7 fun8: 3",
+				"fun9 fun4 fun10 <truncated>: 4",
+			},
+		},
+		{
+			desc:   "keep roots with marker",
+			max:    1,
+			keep:   KeepRoots,
+			marker: true,
+			wantFuncs: []string{
+				"<truncated> fun3: 1",
+				"<truncated> fun6: 2",
+				"<truncated> fun8: 3",
+				"<truncated> fun7: 4",
+			},
+		},
+		{
+			desc:      "shallow stacks",
+			max:       4,
+			marker:    true,
+			wantFuncs: allNoInlinesSampleFuncs,
+		},
+		{
+			desc:    "invalid depth",
+			max:     0,
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := noInlinesProfile.Copy()
+			err := p.TruncateDepth(tc.max, tc.keep, tc.marker)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("TruncateDepth got error %v, want error %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if err := p.CheckValid(); err != nil {
+				t.Fatalf("TruncateDepth produced invalid profile: %v", err)
+			}
+			if got, want := strings.Join(sampleFuncs(p), "\n"), strings.Join(tc.wantFuncs, "\n"); got != want {
+				t.Errorf("TruncateDepth got samples:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
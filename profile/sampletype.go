@@ -0,0 +1,320 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+// Implements methods to manipulate the sample types of profiles.
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// SetSampleType sets the type and unit of the sample type at idx. If
+// that sample type is the default one, DefaultSampleType is updated to
+// the new type. Sample values are not rescaled.
+func (p *Profile) SetSampleType(idx int, typ, unit string) error {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return err
+	}
+	st := p.SampleType[idx]
+	if p.DefaultSampleType != "" && st.Type == p.DefaultSampleType {
+		p.DefaultSampleType = typ
+	}
+	// Merged profiles share their ValueTypes with the sources, so
+	// replace rather than modify it.
+	p.SampleType[idx] = &ValueType{Type: typ, Unit: unit}
+	return nil
+}
+
+// RemoveSampleType removes the sample type at idx and its values from
+// all samples. If DefaultSampleType is empty, it is first set to the
+// type of the last sample type, which is the default one, so that
+// removing another sample type doesn't change the default.
+// DefaultSampleType is cleared if it refers to the removed sample type,
+// making the new last sample type the default. Samples left with only
+// zero values are removed.
+func (p *Profile) RemoveSampleType(idx int) error {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return err
+	}
+	if p.DefaultSampleType == "" {
+		p.DefaultSampleType = p.SampleType[len(p.SampleType)-1].Type
+	}
+	if p.SampleType[idx].Type == p.DefaultSampleType {
+		p.DefaultSampleType = ""
+	}
+	p.SampleType = append(p.SampleType[:idx:idx], p.SampleType[idx+1:]...)
+	for _, s := range p.Sample {
+		s.Value = append(s.Value[:idx], s.Value[idx+1:]...)
+	}
+	p.dropZeroSamples()
+	return nil
+}
+
+// ReorderSampleTypes permutes the sample types of p and the values of
+// all samples so that the sample types are in the order of the type
+// names in order. If DefaultSampleType is empty, it is set to the type
+// of the last sample type before reordering, which is the default one,
+// so that the default doesn't change. Returns an error if order isn't
+// a permutation of the sample type names of p.
+func (p *Profile) ReorderSampleTypes(order []string) error {
+	if len(order) != len(p.SampleType) {
+		return fmt.Errorf("order has %d sample types, profile has %d", len(order), len(p.SampleType))
+	}
+	index := make(map[string]int, len(p.SampleType))
+	for i, st := range p.SampleType {
+		if _, ok := index[st.Type]; ok {
+			return fmt.Errorf("duplicate sample type %q", st.Type)
+		}
+		index[st.Type] = i
+	}
+	perm := make([]int, len(order))
+	for i, typ := range order {
+		j, ok := index[typ]
+		if !ok {
+			return fmt.Errorf("sample type %q not found or duplicated in order", typ)
+		}
+		delete(index, typ)
+		perm[i] = j
+	}
+	if p.DefaultSampleType == "" && len(p.SampleType) > 0 {
+		p.DefaultSampleType = p.SampleType[len(p.SampleType)-1].Type
+	}
+	types := make([]*ValueType, len(perm))
+	for i, j := range perm {
+		types[i] = p.SampleType[j]
+	}
+	p.SampleType = types
+	for _, s := range p.Sample {
+		values := make([]int64, len(perm))
+		for i, j := range perm {
+			values[i] = s.Value[j]
+		}
+		s.Value = values
+	}
+	return nil
+}
+
+// ToRate converts the values of the sample type at idx into per second
+// rates over the duration of the profile, and appends "/sec" to its
+// unit. Rates are truncated to integers. Returns an error if the profile
+// has no duration.
+func (p *Profile) ToRate(idx int) error {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return err
+	}
+	if p.DurationNanos <= 0 {
+		return fmt.Errorf("cannot compute rates for a profile without duration")
+	}
+	ratios := make([]float64, len(p.SampleType))
+	for i := range ratios {
+		ratios[i] = 1
+	}
+	ratios[idx] = 1e9 / float64(p.DurationNanos)
+	if err := p.ScaleN(ratios); err != nil {
+		return err
+	}
+	st := p.SampleType[idx]
+	return p.SetSampleType(idx, st.Type, st.Unit+"/sec")
+}
+
+// RoundValues rounds the values of the sample type at idx to the
+// nearest multiple of granularity, rounding halves away from zero.
+// Values whose nearest multiple overflows an int64 are clamped to the
+// largest or smallest int64. Samples left with only zero values are
+// removed.
+func (p *Profile) RoundValues(idx int, granularity int64) error {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return err
+	}
+	if granularity <= 0 {
+		return fmt.Errorf("rounding granularity must be positive, got %d", granularity)
+	}
+	for _, s := range p.Sample {
+		s.Value[idx] = roundToMultiple(s.Value[idx], granularity)
+	}
+	p.dropZeroSamples()
+	return nil
+}
+
+// ClampNonNegative sets the negative values of the sample type at idx to
+// zero, for consumers that can't handle negative values such as those
+// left by subtracting profiles. Samples left with only zero values are
+// removed.
+func (p *Profile) ClampNonNegative(idx int) error {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return err
+	}
+	for _, s := range p.Sample {
+		if s.Value[idx] < 0 {
+			s.Value[idx] = 0
+		}
+	}
+	p.dropZeroSamples()
+	return nil
+}
+
+// Sanitize sets all negative sample values to zero, as ClampNonNegative
+// does for every sample type.
+func (p *Profile) Sanitize() {
+	for _, s := range p.Sample {
+		for i, v := range s.Value {
+			if v < 0 {
+				s.Value[i] = 0
+			}
+		}
+	}
+	p.dropZeroSamples()
+}
+
+// RecomputeCountColumn sets the values of the sample type at countIdx
+// to the number of objects making up the values of the sample type at
+// sizeIdx, as in heap profiles counting both objects and bytes. Merging
+// and pruning can leave these inconsistent. The size of the objects of
+// a sample is taken from its "bytes" numeric label, which Go heap
+// profiles set, or is avgObjSize if the sample has none. Counts are
+// rounded to the nearest integer, halves away from zero. Samples left
+// with only zero values are removed.
+func (p *Profile) RecomputeCountColumn(countIdx, sizeIdx int, avgObjSize int64) error {
+	if err := p.checkSampleIndex(countIdx); err != nil {
+		return err
+	}
+	if err := p.checkSampleIndex(sizeIdx); err != nil {
+		return err
+	}
+	if countIdx == sizeIdx {
+		return fmt.Errorf("count and size sample types must differ, both are %d", countIdx)
+	}
+	if avgObjSize <= 0 {
+		return fmt.Errorf("average object size must be positive, got %d", avgObjSize)
+	}
+	for _, s := range p.Sample {
+		objSize := avgObjSize
+		if vs := s.NumLabel["bytes"]; len(vs) > 0 && vs[0] > 0 {
+			objSize = vs[0]
+		}
+		s.Value[countIdx] = roundDiv(s.Value[sizeIdx], objSize)
+	}
+	p.dropZeroSamples()
+	return nil
+}
+
+// roundToMultiple returns the multiple of the positive g nearest to v,
+// rounding halves away from zero, or the largest or smallest int64 if
+// it overflows.
+func roundToMultiple(v, g int64) int64 {
+	// v-r, 0 <= r < g and g-r don't overflow, unlike 2*r and v+g-r.
+	r := v % g
+	q := v - r
+	switch {
+	case r >= 0 && r >= g-r:
+		if q > math.MaxInt64-g {
+			return math.MaxInt64
+		}
+		return q + g
+	case r < 0 && -r >= g+r:
+		if q < math.MinInt64+g {
+			return math.MinInt64
+		}
+		return q - g
+	}
+	return q
+}
+
+// roundDiv returns a divided by the positive d, rounding halves away
+// from zero.
+func roundDiv(a, d int64) int64 {
+	q, r := a/d, a%d
+	switch {
+	case r > 0 && 2*r >= d:
+		q++
+	case r < 0 && -2*r >= d:
+		q--
+	}
+	return q
+}
+
+// SampleUnit returns the unit of the sample type at idx, or "" if idx is
+// out of range.
+func (p *Profile) SampleUnit(idx int) string {
+	if p.checkSampleIndex(idx) != nil {
+		return ""
+	}
+	return p.SampleType[idx].Unit
+}
+
+// unitFamilies lists the units ConvertUnit converts between, grouped by
+// the quantity they measure, with their size in the smallest unit of
+// their group.
+var unitFamilies = []map[string]float64{
+	{
+		"nanoseconds": 1, "nanosecond": 1, "ns": 1,
+		"microseconds": 1e3, "microsecond": 1e3, "us": 1e3,
+		"milliseconds": 1e6, "millisecond": 1e6, "ms": 1e6,
+		"seconds": 1e9, "second": 1e9, "s": 1e9,
+		"minutes": 60e9, "minute": 60e9,
+		"hours": 3600e9, "hour": 3600e9,
+	},
+	{
+		"bytes": 1, "byte": 1, "b": 1,
+		"kilobytes": 1 << 10, "kilobyte": 1 << 10, "kb": 1 << 10,
+		"megabytes": 1 << 20, "megabyte": 1 << 20, "mb": 1 << 20,
+		"gigabytes": 1 << 30, "gigabyte": 1 << 30, "gb": 1 << 30,
+		"terabytes": 1 << 40, "terabyte": 1 << 40, "tb": 1 << 40,
+	},
+}
+
+// ConvertUnit rescales the values of the sample type at idx from its
+// unit to toUnit, and sets its unit to toUnit. Time units from
+// nanoseconds to hours and byte units from bytes to terabytes are
+// supported, in powers of 1024 for the latter. Converted values are
+// truncated to integers. Returns an error if either unit is unknown or
+// they measure different quantities.
+func (p *Profile) ConvertUnit(idx int, toUnit string) error {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return err
+	}
+	st := p.SampleType[idx]
+	for _, family := range unitFamilies {
+		from, ok := family[strings.ToLower(st.Unit)]
+		if !ok {
+			continue
+		}
+		to, ok := family[strings.ToLower(toUnit)]
+		if !ok {
+			return fmt.Errorf("cannot convert %s from %s to %s", st.Type, st.Unit, toUnit)
+		}
+		ratios := make([]float64, len(p.SampleType))
+		for i := range ratios {
+			ratios[i] = 1
+		}
+		ratios[idx] = from / to
+		if err := p.ScaleN(ratios); err != nil {
+			return err
+		}
+		return p.SetSampleType(idx, st.Type, toUnit)
+	}
+	return fmt.Errorf("cannot convert %s from unknown unit %s", st.Type, st.Unit)
+}
+
+// checkSampleIndex returns an error if idx is not a valid index into
+// p.SampleType.
+func (p *Profile) checkSampleIndex(idx int) error {
+	if idx < 0 || idx >= len(p.SampleType) {
+		return fmt.Errorf("sample index %d is outside the range [0..%d]", idx, len(p.SampleType)-1)
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSetSampleType(t *testing.T) {
+	for _, tc := range []struct {
+		desc        string
+		dflt        string
+		idx         int
+		wantDefault string
+		wantErr     bool
+	}{
+		{
+			desc: "no default",
+			idx:  1,
+		},
+		{
+			desc:        "default updated",
+			dflt:        "cpu",
+			idx:         1,
+			wantDefault: "cpu_time",
+		},
+		{
+			desc:        "other default kept",
+			dflt:        "samples",
+			idx:         1,
+			wantDefault: "samples",
+		},
+		{
+			desc:    "negative index",
+			idx:     -1,
+			wantErr: true,
+		},
+		{
+			desc:    "index out of range",
+			idx:     2,
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := testProfile1.Copy()
+			p.DefaultSampleType = tc.dflt
+			err := p.SetSampleType(tc.idx, "cpu_time", "nanoseconds")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("SetSampleType got error %v, want error %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if got := p.SampleType[tc.idx]; got.Type != "cpu_time" || got.Unit != "nanoseconds" {
+				t.Errorf("got sample type %s/%s, want cpu_time/nanoseconds", got.Type, got.Unit)
+			}
+			if p.DefaultSampleType != tc.wantDefault {
+				t.Errorf("got default sample type %q, want %q", p.DefaultSampleType, tc.wantDefault)
+			}
+			if got, want := p.Sample[0].Value[tc.idx], testProfile1.Sample[0].Value[tc.idx]; got != want {
+				t.Errorf("got value %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestRemoveSampleType(t *testing.T) {
+	p := testProfile2.Copy()
+	p.DefaultSampleType = "samples"
+	p.Sample[0].Value[1] = 0
+	if err := p.RemoveSampleType(0); err != nil {
+		t.Fatalf("RemoveSampleType: %v", err)
+	}
+	if got, want := sampleTypes(p), []string{"cpu"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got sample types %v, want %v", got, want)
+	}
+	if p.DefaultSampleType != "" {
+		t.Errorf("got default sample type %q, want none", p.DefaultSampleType)
+	}
+	var got [][]int64
+	for _, s := range p.Sample {
+		got = append(got, s.Value)
+	}
+	if want := [][]int64{{100}, {10}, {10000}, {1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got values %v, want %v", got, want)
+	}
+	if err := p.CheckValid(); err != nil {
+		t.Errorf("RemoveSampleType produced invalid profile: %v", err)
+	}
+	if err := p.RemoveSampleType(1); err == nil {
+		t.Errorf("RemoveSampleType with invalid index: want error")
+	}
+
+	// Without DefaultSampleType, the last sample type is the default.
+	for _, tc := range []struct {
+		idx         int
+		wantDefault string
+	}{
+		{0, "cpu"},
+		{1, ""},
+	} {
+		p := testProfile2.Copy()
+		p.DefaultSampleType = ""
+		if err := p.RemoveSampleType(tc.idx); err != nil {
+			t.Fatalf("RemoveSampleType: %v", err)
+		}
+		if got := p.DefaultSampleType; got != tc.wantDefault {
+			t.Errorf("RemoveSampleType(%d) got default sample type %q, want %q", tc.idx, got, tc.wantDefault)
+		}
+	}
+}
+
+func TestReorderSampleTypes(t *testing.T) {
+	p := testProfile2.Copy()
+	want := make([][]int64, len(p.Sample))
+	for i, s := range p.Sample {
+		want[i] = []int64{s.Value[1], s.Value[0]}
+	}
+	if err := p.ReorderSampleTypes([]string{"cpu", "samples"}); err != nil {
+		t.Fatalf("ReorderSampleTypes: %v", err)
+	}
+	if got, want := sampleTypes(p), []string{"cpu", "samples"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got sample types %v, want %v", got, want)
+	}
+	if got, want := p.DefaultSampleType, "cpu"; got != want {
+		t.Errorf("got default sample type %q, want %q", got, want)
+	}
+	var got [][]int64
+	for _, s := range p.Sample {
+		got = append(got, s.Value)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got values %v, want %v", got, want)
+	}
+	if err := p.CheckValid(); err != nil {
+		t.Errorf("ReorderSampleTypes produced invalid profile: %v", err)
+	}
+
+	for _, order := range [][]string{
+		{"cpu"},
+		{"cpu", "cpu"},
+		{"cpu", "wall"},
+	} {
+		if err := p.ReorderSampleTypes(order); err == nil {
+			t.Errorf("ReorderSampleTypes(%q): want error", order)
+		}
+	}
+}
+
+func TestToRate(t *testing.T) {
+	p := testProfile1.Copy()
+	if err := p.ToRate(0); err != nil {
+		t.Fatalf("ToRate: %v", err)
+	}
+	if got, want := p.SampleType[0].Unit, "count/sec"; got != want {
+		t.Errorf("got unit %q, want %q", got, want)
+	}
+	var got []int64
+	for _, s := range p.Sample {
+		got = append(got, s.Value...)
+	}
+	// testProfile1 lasts 10 seconds.
+	if want := []int64{100, 1000, 10, 100, 1, 10, 1000, 10000, 0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got values %v, want %v", got, want)
+	}
+
+	p.DurationNanos = 0
+	if err := p.ToRate(0); err == nil {
+		t.Errorf("ToRate without duration: want error")
+	}
+	if err := p.ToRate(2); err == nil {
+		t.Errorf("ToRate with invalid index: want error")
+	}
+}
+
+func TestConvertUnit(t *testing.T) {
+	for _, tc := range []struct {
+		desc       string
+		idx        int
+		toUnit     string
+		wantValues []int64
+		wantErr    bool
+	}{
+		{
+			desc:       "milliseconds to microseconds",
+			idx:        1,
+			toUnit:     "us",
+			wantValues: []int64{1000000, 100000, 10000, 10000000, 1000},
+		},
+		{
+			desc:       "milliseconds to seconds",
+			idx:        1,
+			toUnit:     "seconds",
+			wantValues: []int64{1, 0, 0, 10, 0},
+		},
+		{
+			desc:    "milliseconds to bytes",
+			idx:     1,
+			toUnit:  "bytes",
+			wantErr: true,
+		},
+		{
+			desc:    "unknown unit",
+			idx:     0,
+			toUnit:  "bytes",
+			wantErr: true,
+		},
+		{
+			desc:    "invalid index",
+			idx:     2,
+			toUnit:  "seconds",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := testProfile1.Copy()
+			err := p.ConvertUnit(tc.idx, tc.toUnit)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ConvertUnit got error %v, want error %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if got, want := p.SampleUnit(tc.idx), tc.toUnit; got != want {
+				t.Errorf("SampleUnit got %q, want %q", got, want)
+			}
+			var got []int64
+			for _, s := range p.Sample {
+				got = append(got, s.Value[tc.idx])
+			}
+			if !reflect.DeepEqual(got, tc.wantValues) {
+				t.Errorf("ConvertUnit got values %v, want %v", got, tc.wantValues)
+			}
+		})
+	}
+	if got := testProfile1.SampleUnit(2); got != "" {
+		t.Errorf("SampleUnit with invalid index got %q, want \"\"", got)
+	}
+}
+
+func TestRoundValues(t *testing.T) {
+	p := noInlinesProfile.Copy()
+	for i, v := range []int64{1023, 512, 511, -1536} {
+		p.Sample[i].Value[0] = v
+	}
+	if err := p.RoundValues(0, 1024); err != nil {
+		t.Fatalf("RoundValues: %v", err)
+	}
+	var got []int64
+	for _, s := range p.Sample {
+		got = append(got, s.Value[0])
+	}
+	if want := []int64{1024, 1024, -2048}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got values %v, want %v", got, want)
+	}
+
+	if err := p.RoundValues(0, 0); err == nil {
+		t.Errorf("RoundValues with zero granularity: want error")
+	}
+	if err := p.RoundValues(1, 10); err == nil {
+		t.Errorf("RoundValues with invalid index: want error")
+	}
+}
+
+func TestRoundToMultiple(t *testing.T) {
+	for _, tc := range []struct {
+		v, g, want int64
+	}{
+		{1535, 1024, 1024},
+		{1536, 1024, 2048},
+		{-1536, 1024, -2048},
+		{math.MaxInt64, 1024, math.MaxInt64},
+		{math.MaxInt64 - 1024, 1024, math.MaxInt64 - 1023},
+		{math.MaxInt64 - 1600, 1024, math.MaxInt64 - 2047},
+		{math.MinInt64, 1024, math.MinInt64},
+		{math.MinInt64 + 1, 1024, math.MinInt64},
+		{math.MinInt64 + 600, 1024, math.MinInt64 + 1024},
+		{math.MaxInt64, math.MaxInt64, math.MaxInt64},
+		{math.MaxInt64/2 + 1, math.MaxInt64, math.MaxInt64},
+		{math.MinInt64, math.MaxInt64, -math.MaxInt64},
+	} {
+		if got := roundToMultiple(tc.v, tc.g); got != tc.want {
+			t.Errorf("roundToMultiple(%d, %d) got %d, want %d", tc.v, tc.g, got, tc.want)
+		}
+	}
+}
+
+func TestClampNonNegative(t *testing.T) {
+	values := [][]int64{{-1, 5}, {3, -2}, {-4, 0}, {0, 0}, {-1, -1}}
+	newProfile := func() *Profile {
+		p := testProfile1.Copy()
+		for i, v := range values {
+			copy(p.Sample[i].Value, v)
+		}
+		return p
+	}
+	sampleValues := func(p *Profile) [][]int64 {
+		var got [][]int64
+		for _, s := range p.Sample {
+			got = append(got, s.Value)
+		}
+		return got
+	}
+
+	p := newProfile()
+	if err := p.ClampNonNegative(0); err != nil {
+		t.Fatalf("ClampNonNegative: %v", err)
+	}
+	if got, want := sampleValues(p), [][]int64{{0, 5}, {3, -2}, {0, -1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ClampNonNegative got values %v, want %v", got, want)
+	}
+	if err := p.ClampNonNegative(2); err == nil {
+		t.Errorf("ClampNonNegative with invalid index: want error")
+	}
+
+	p = newProfile()
+	p.Sanitize()
+	if got, want := sampleValues(p), [][]int64{{0, 5}, {3, 0}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Sanitize got values %v, want %v", got, want)
+	}
+}
+
+func TestRecomputeCountColumn(t *testing.T) {
+	p := testProfile1.Copy()
+	for i, v := range [][]int64{{0, 1000}, {0, 96}, {0, -150}, {5, 40}, {7, 0}} {
+		copy(p.Sample[i].Value, v)
+	}
+	p.Sample[1].NumLabel = map[string][]int64{"bytes": {32}}
+	if err := p.RecomputeCountColumn(0, 1, 100); err != nil {
+		t.Fatalf("RecomputeCountColumn: %v", err)
+	}
+	var got [][]int64
+	for _, s := range p.Sample {
+		got = append(got, s.Value)
+	}
+	if want := [][]int64{{10, 1000}, {3, 96}, {-2, -150}, {0, 40}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("RecomputeCountColumn got values %v, want %v", got, want)
+	}
+
+	for _, tc := range []struct {
+		desc              string
+		countIdx, sizeIdx int
+		avgObjSize        int64
+	}{
+		{desc: "invalid count index", countIdx: 2, sizeIdx: 1, avgObjSize: 1},
+		{desc: "invalid size index", countIdx: 0, sizeIdx: -1, avgObjSize: 1},
+		{desc: "same index", countIdx: 1, sizeIdx: 1, avgObjSize: 1},
+		{desc: "zero object size", countIdx: 0, sizeIdx: 1},
+	} {
+		if err := p.RecomputeCountColumn(tc.countIdx, tc.sizeIdx, tc.avgObjSize); err == nil {
+			t.Errorf("RecomputeCountColumn with %s: want error", tc.desc)
+		}
+	}
+}
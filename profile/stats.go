@@ -0,0 +1,471 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+// Implements methods to summarize the values of profiles.
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// TotalsByLabel returns the sum of the values of the sample type at idx
+// for each value of the label key. Samples are attributed to the first
+// value of their label key, or to "" if they don't have one.
+func (p *Profile) TotalsByLabel(key string, idx int) (map[string]int64, error) {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return nil, err
+	}
+	totals := make(map[string]int64)
+	for _, s := range p.Sample {
+		var value string
+		if vs := s.Label[key]; len(vs) > 0 {
+			value = vs[0]
+		}
+		totals[value] += s.Value[idx]
+	}
+	return totals, nil
+}
+
+// TotalsByMapping returns the sum of the values of the sample type at
+// idx for each mapping. Each sample is attributed to the mapping of its
+// leaf location, where its value was spent; callers in other mappings
+// are not credited. Samples without locations or whose leaf location has
+// no mapping are attributed to a nil mapping.
+func (p *Profile) TotalsByMapping(idx int) (map[*Mapping]int64, error) {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return nil, err
+	}
+	totals := make(map[*Mapping]int64)
+	for _, s := range p.Sample {
+		var m *Mapping
+		if len(s.Location) > 0 {
+			m = s.Location[0].Mapping
+		}
+		totals[m] += s.Value[idx]
+	}
+	return totals, nil
+}
+
+// Rate returns the sum of the values of the sample type at idx per
+// second of the duration of the profile. It returns zero rather than an
+// infinite or NaN rate for a profile without a duration.
+func (p *Profile) Rate(idx int) (float64, error) {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return 0, err
+	}
+	d := p.DurationSeconds()
+	if d == 0 {
+		return 0, nil
+	}
+	var total int64
+	for _, s := range p.Sample {
+		total += s.Value[idx]
+	}
+	return float64(total) / d, nil
+}
+
+// AttributionMode selects how MappingAttribution splits the value of a
+// sample among the mappings of its frames.
+type AttributionMode int
+
+const (
+	// AttributeLeaf attributes the whole value of a sample to the
+	// mapping of its leaf frame, like TotalsByMapping.
+	AttributeLeaf AttributionMode = iota
+	// AttributeEven splits the value of a sample evenly among its
+	// frames, so each mapping gets a share proportional to the number
+	// of frames it has in the stack.
+	AttributeEven
+	// AttributeWeighted splits the value of a sample among its frames
+	// in proportion to 1/(d+1), where d is the depth of the frame from
+	// the leaf, so frames closer to the leaf get a larger share.
+	AttributeWeighted
+)
+
+// MappingAttribution returns the value of the sample type at idx
+// attributed to each mapping, with the value of each sample split among
+// the mappings of its frames according to mode. Each location is one
+// frame, and its inlined functions aren't counted separately. Values
+// attributed to frames without a mapping, and the values of samples
+// without locations, are attributed to a nil mapping. The attributed
+// values of each sample add up to its value.
+func (p *Profile) MappingAttribution(idx int, mode AttributionMode) (map[*Mapping]float64, error) {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return nil, err
+	}
+	if mode < AttributeLeaf || mode > AttributeWeighted {
+		return nil, fmt.Errorf("invalid attribution mode %d", mode)
+	}
+	totals := make(map[*Mapping]float64)
+	var weights []float64
+	for _, s := range p.Sample {
+		v := float64(s.Value[idx])
+		if len(s.Location) == 0 {
+			totals[nil] += v
+			continue
+		}
+		if mode == AttributeLeaf {
+			totals[s.Location[0].Mapping] += v
+			continue
+		}
+		weights = weights[:0]
+		var sum float64
+		for d := range s.Location {
+			w := 1.0
+			if mode == AttributeWeighted {
+				w = 1 / float64(d+1)
+			}
+			weights = append(weights, w)
+			sum += w
+		}
+		for d, l := range s.Location {
+			totals[l.Mapping] += v * weights[d] / sum
+		}
+	}
+	return totals, nil
+}
+
+// Histogram reconstructs a histogram from samples that share call
+// stacks but differ in the numeric label bucketKey, as used to encode
+// latency distributions. It returns the distinct values of bucketKey in
+// increasing order, and for each of them the sum of the values of the
+// default sample type of the samples in that bucket. Only samples with a
+// frame matching stackFilter are included, or all of them if it is nil.
+// Samples are bucketed on the first value of bucketKey, and samples
+// without it are skipped.
+func (p *Profile) Histogram(stackFilter *regexp.Regexp, bucketKey string) (buckets, counts []int64) {
+	idx, err := p.SampleIndexByName("")
+	if err != nil || idx < 0 {
+		return nil, nil
+	}
+	totals := make(map[int64]int64)
+	for _, s := range p.Sample {
+		vs := s.NumLabel[bucketKey]
+		if len(vs) == 0 || !matchesStack(s, stackFilter) {
+			continue
+		}
+		if _, ok := totals[vs[0]]; !ok {
+			buckets = append(buckets, vs[0])
+		}
+		totals[vs[0]] += s.Value[idx]
+	}
+	if len(buckets) == 0 {
+		return nil, nil
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	counts = make([]int64, len(buckets))
+	for i, b := range buckets {
+		counts[i] = totals[b]
+	}
+	return buckets, counts
+}
+
+// matchesStack returns whether any location of s matches re, or true if
+// re is nil.
+func matchesStack(s *Sample, re *regexp.Regexp) bool {
+	if re == nil {
+		return true
+	}
+	for _, l := range s.Location {
+		if l.matchesName(re) {
+			return true
+		}
+	}
+	return false
+}
+
+// CumulativeByFunction returns the cumulative value of the sample type
+// at idx for each function: the sum of the values of the samples with
+// the function anywhere in their call stack, including inlined frames.
+// Each sample counts once for each function, even if the function
+// appears several times in its stack through recursion or inlining.
+func (p *Profile) CumulativeByFunction(idx int) (map[*Function]int64, error) {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return nil, err
+	}
+	cum := make(map[*Function]int64)
+	seen := make(map[*Function]bool)
+	for _, s := range p.Sample {
+		for f := range seen {
+			delete(seen, f)
+		}
+		for _, l := range s.Location {
+			for _, ln := range l.Line {
+				if f := ln.Function; f != nil && !seen[f] {
+					seen[f] = true
+					cum[f] += s.Value[idx]
+				}
+			}
+		}
+	}
+	return cum, nil
+}
+
+// LeafHistogram returns the value of the sample type at idx spent in
+// each leaf function: the innermost function of the leaf location of
+// each sample, ignoring its callers and the functions it was inlined
+// into. A folded leaf location is attributed to the function recorded
+// for it, although it may stand for other functions folded into the
+// same code. The values of samples without locations, or whose leaf
+// location has no function, are attributed to a nil function.
+func (p *Profile) LeafHistogram(idx int) (map[*Function]int64, error) {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return nil, err
+	}
+	leaves := make(map[*Function]int64)
+	for _, s := range p.Sample {
+		var f *Function
+		if len(s.Location) > 0 && len(s.Location[0].Line) > 0 {
+			f = s.Location[0].Line[0].Function
+		}
+		leaves[f] += s.Value[idx]
+	}
+	return leaves, nil
+}
+
+// DepthHistogram returns the number of samples with each stack depth.
+// The depth of a stack is its number of locations or, if inlined is
+// set, its number of frames, counting each inlined line of a location
+// and locations without lines as one frame.
+func (p *Profile) DepthHistogram(inlined bool) map[int]int {
+	depths := make(map[int]int)
+	for _, s := range p.Sample {
+		depth := len(s.Location)
+		if inlined {
+			for _, l := range s.Location {
+				if len(l.Line) > 1 {
+					depth += len(l.Line) - 1
+				}
+			}
+		}
+		depths[depth]++
+	}
+	return depths
+}
+
+// FunctionStat holds the values of a function for a sample type.
+type FunctionStat struct {
+	Function *Function
+	// Flat is the value of the samples with the function as their leaf
+	// function, as computed by LeafHistogram.
+	Flat int64
+	// Cum is the value of the samples with the function anywhere in
+	// their call stack, as computed by CumulativeByFunction.
+	Cum int64
+}
+
+// FunctionStats returns the flat and cumulative values of the sample
+// type at idx for each function in the call stacks of the samples of p,
+// computed in a single pass, as needed for a top functions report. They
+// are sorted by decreasing flat value, then by decreasing cumulative
+// value, then by name.
+func (p *Profile) FunctionStats(idx int) ([]FunctionStat, error) {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return nil, err
+	}
+	byFunction := make(map[*Function]*FunctionStat)
+	var stats []*FunctionStat
+	seen := make(map[*Function]bool)
+	for _, s := range p.Sample {
+		v := s.Value[idx]
+		for f := range seen {
+			delete(seen, f)
+		}
+		for i, l := range s.Location {
+			for j, ln := range l.Line {
+				f := ln.Function
+				if f == nil {
+					continue
+				}
+				fs := byFunction[f]
+				if fs == nil {
+					fs = &FunctionStat{Function: f}
+					byFunction[f] = fs
+					stats = append(stats, fs)
+				}
+				if i == 0 && j == 0 {
+					fs.Flat += v
+				}
+				if !seen[f] {
+					seen[f] = true
+					fs.Cum += v
+				}
+			}
+		}
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		switch {
+		case a.Flat != b.Flat:
+			return a.Flat > b.Flat
+		case a.Cum != b.Cum:
+			return a.Cum > b.Cum
+		}
+		return a.Function.Name < b.Function.Name
+	})
+	result := make([]FunctionStat, len(stats))
+	for i, fs := range stats {
+		result[i] = *fs
+	}
+	return result, nil
+}
+
+// HotPath returns the call stack of functions carrying the most value
+// of the sample type at idx, leaf first, and that value. Inlined
+// functions are listed as separate frames, and the values of samples
+// with the same stack of functions, such as samples only differing in
+// their labels or line numbers, are added up. Ties are broken by
+// picking the stack whose functions come first lexicographically, leaf
+// first, comparing functions by name, then file name, then ID. Frames
+// without a function are skipped, so the samples with only unsymbolized
+// frames add up to an empty stack, returned as a nil stack with their
+// value if it is the hottest. Returns a nil stack and a zero value for
+// a profile without samples.
+func (p *Profile) HotPath(idx int) ([]*Function, int64, error) {
+	if err := p.checkSampleIndex(idx); err != nil {
+		return nil, 0, err
+	}
+	type path struct {
+		funcs []*Function
+		value int64
+	}
+	paths := make(map[string]*path)
+	var hot *path
+	for _, s := range p.Sample {
+		var funcs []*Function
+		var key []byte
+		for _, l := range s.Location {
+			for _, ln := range l.Line {
+				if ln.Function != nil {
+					funcs = append(funcs, ln.Function)
+					key = strconv.AppendUint(append(key, ' '), ln.Function.ID, 10)
+				}
+			}
+		}
+		pt := paths[string(key)]
+		if pt == nil {
+			pt = &path{funcs: funcs}
+			paths[string(key)] = pt
+		}
+		pt.value += s.Value[idx]
+	}
+	for _, pt := range paths {
+		if hot == nil || pt.value > hot.value || (pt.value == hot.value && functionsLess(pt.funcs, hot.funcs)) {
+			hot = pt
+		}
+	}
+	if hot == nil {
+		return nil, 0, nil
+	}
+	return hot.funcs, hot.value, nil
+}
+
+// functionsLess returns whether the functions in a come
+// lexicographically before those in b, comparing functions by name,
+// then file name, then ID.
+func functionsLess(a, b []*Function) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		fa, fb := a[i], b[i]
+		switch {
+		case fa.Name != fb.Name:
+			return fa.Name < fb.Name
+		case fa.Filename != fb.Filename:
+			return fa.Filename < fb.Filename
+		case fa.ID != fb.ID:
+			return fa.ID < fb.ID
+		}
+	}
+	return len(a) < len(b)
+}
+
+// LabelStat describes the use of a label key by the samples of a
+// profile.
+type LabelStat struct {
+	// Key is the label key, of string or numeric labels.
+	Key string
+	// Samples is the number of samples with a value for Key.
+	Samples int
+	// Values is the number of distinct values of Key.
+	Values int
+	// Bytes approximates the memory used by the labels with Key: the
+	// length of the key and of each string value or unit, and 8 bytes
+	// for each numeric value, for every sample.
+	Bytes int64
+}
+
+// LabelStats are the statistics of the label keys of a profile.
+type LabelStats []LabelStat
+
+// LabelSizeStats returns the statistics of the string and numeric
+// labels of the samples of p, by decreasing size, or by key for equal
+// sizes. It helps to find the labels to remove with RemoveLabel to
+// shrink a profile.
+func (p *Profile) LabelSizeStats() LabelStats {
+	type keyStats struct {
+		LabelStat
+		values map[string]bool
+	}
+	byKey := make(map[string]*keyStats)
+	get := func(k string) *keyStats {
+		ks := byKey[k]
+		if ks == nil {
+			ks = &keyStats{LabelStat: LabelStat{Key: k}, values: make(map[string]bool)}
+			byKey[k] = ks
+		}
+		ks.Samples++
+		return ks
+	}
+	for _, s := range p.Sample {
+		for k, vs := range s.Label {
+			ks := get(k)
+			for _, v := range vs {
+				ks.Bytes += int64(len(k) + len(v))
+				ks.values[v] = true
+			}
+		}
+		for k, vs := range s.NumLabel {
+			ks := get(k)
+			if _, ok := s.Label[k]; ok {
+				// Count samples with both kinds of labels once.
+				ks.Samples--
+			}
+			units := s.NumUnit[k]
+			for i, v := range vs {
+				var unit string
+				if i < len(units) {
+					unit = units[i]
+				}
+				ks.Bytes += int64(len(k) + 8 + len(unit))
+				ks.values[strconv.FormatInt(v, 10)+" "+unit] = true
+			}
+		}
+	}
+
+	stats := make(LabelStats, 0, len(byKey))
+	for _, ks := range byKey {
+		ks.Values = len(ks.values)
+		stats = append(stats, ks.LabelStat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Bytes != stats[j].Bytes {
+			return stats[i].Bytes > stats[j].Bytes
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	return stats
+}
@@ -0,0 +1,486 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestTotalsByLabel(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		key     string
+		idx     int
+		want    map[string]int64
+		wantErr bool
+	}{
+		{
+			desc: "label on all samples",
+			key:  "key1",
+			idx:  1,
+			want: map[string]int64{"tag1": 1000, "tag2": 100, "tag3": 10, "tag4": 10001},
+		},
+		{
+			desc: "label missing from some samples",
+			key:  "key2",
+			want: map[string]int64{"tag1": 11001, "tag2": 10, "": 100},
+		},
+		{
+			desc:    "invalid index",
+			key:     "key1",
+			idx:     2,
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := testProfile1.TotalsByLabel(tc.key, tc.idx)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("TotalsByLabel got error %v, want error %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("TotalsByLabel got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTotalsByMapping(t *testing.T) {
+	p := testProfile1.Copy()
+	p.Sample = append(p.Sample, &Sample{Value: []int64{5, 5}})
+	got, err := p.TotalsByMapping(1)
+	if err != nil {
+		t.Fatalf("TotalsByMapping: %v", err)
+	}
+	want := map[*Mapping]int64{
+		p.Mapping[0]: 10111,
+		p.Mapping[1]: 1000,
+		nil:          5,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TotalsByMapping got %v, want %v", got, want)
+	}
+	if _, err := p.TotalsByMapping(-1); err == nil {
+		t.Errorf("TotalsByMapping with invalid index: want error")
+	}
+}
+
+func TestRate(t *testing.T) {
+	p := testProfile1.Copy()
+	p.DurationNanos = 2e9
+	if got, want := p.DurationSeconds(), 2.0; got != want {
+		t.Errorf("DurationSeconds got %v, want %v", got, want)
+	}
+	rate, err := p.Rate(1)
+	if err != nil {
+		t.Fatalf("Rate: %v", err)
+	}
+	if want := 5555.5; rate != want {
+		t.Errorf("Rate got %v, want %v", rate, want)
+	}
+
+	p.DurationNanos = 0
+	if rate, err := p.Rate(1); err != nil || rate != 0 {
+		t.Errorf("Rate without duration got %v, %v, want 0, nil", rate, err)
+	}
+	if _, err := p.Rate(2); err == nil {
+		t.Errorf("Rate with invalid index: want error")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	locs := noInlinesLocs
+	bucket := func(b int64, v int64, stack ...*Location) *Sample {
+		return &Sample{
+			Location: stack,
+			Value:    []int64{v},
+			NumLabel: map[string][]int64{"bucket": {b}},
+		}
+	}
+	p := &Profile{
+		PeriodType: &ValueType{Type: "cpu", Unit: "milliseconds"},
+		SampleType: []*ValueType{{Type: "samples", Unit: "count"}},
+		Mapping:    mappings,
+		Function:   functions,
+		Location:   locs,
+		Sample: []*Sample{
+			bucket(100, 3, locs[0], locs[1]),
+			bucket(10, 1, locs[0], locs[1]),
+			bucket(1000, 2, locs[0], locs[1]),
+			bucket(10, 4, locs[2]),
+			bucket(100, 5, locs[2], locs[1]),
+			{Location: []*Location{locs[0]}, Value: []int64{7}},
+		},
+	}
+	for _, tc := range []struct {
+		desc        string
+		filter      *regexp.Regexp
+		wantBuckets []int64
+		wantCounts  []int64
+	}{
+		{
+			desc:        "all stacks",
+			wantBuckets: []int64{10, 100, 1000},
+			wantCounts:  []int64{5, 8, 2},
+		},
+		{
+			desc:        "filtered stacks",
+			filter:      regexp.MustCompile("fun1"),
+			wantBuckets: []int64{10, 100, 1000},
+			wantCounts:  []int64{1, 8, 2},
+		},
+		{
+			desc:        "no match",
+			filter:      regexp.MustCompile("nomatch"),
+			wantBuckets: nil,
+			wantCounts:  nil,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			buckets, counts := p.Histogram(tc.filter, "bucket")
+			if !reflect.DeepEqual(buckets, tc.wantBuckets) || !reflect.DeepEqual(counts, tc.wantCounts) {
+				t.Errorf("Histogram got %v, %v, want %v, %v", buckets, counts, tc.wantBuckets, tc.wantCounts)
+			}
+		})
+	}
+}
+
+func TestCumulativeByFunction(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		p    *Profile
+		want map[string]int64
+	}{
+		{
+			desc: "recursive stacks",
+			p:    recursionProfile,
+			want: map[string]int64{"fun0": 7, "fun1": 7, "fun2": 12},
+		},
+		{
+			desc: "inlined frames",
+			p: &Profile{
+				SampleType: []*ValueType{{Type: "samples", Unit: "count"}},
+				Sample: []*Sample{
+					{Value: []int64{1}, Location: []*Location{inlinesLocs[0], inlinesLocs[1]}},
+					{Value: []int64{2}, Location: []*Location{inlinesLocs[2]}},
+					{Value: []int64{4}, Location: []*Location{inlinesLocs[0], inlinesLocs[0]}},
+					{Value: []int64{8}, Location: []*Location{{Line: []Line{
+						{Function: functions[0]}, {Function: functions[0]}, {Function: functions[1]},
+					}}}},
+				},
+			},
+			want: map[string]int64{
+				"fun0": 13, "fun1": 13, "fun2": 1, "fun3": 1,
+				"fun4": 2, "fun5": 2, "fun6": 2,
+			},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			cum, err := tc.p.CumulativeByFunction(0)
+			if err != nil {
+				t.Fatalf("CumulativeByFunction: %v", err)
+			}
+			got := make(map[string]int64)
+			for f, v := range cum {
+				got[f.Name] = v
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("CumulativeByFunction got %v, want %v", got, tc.want)
+			}
+		})
+	}
+	if _, err := recursionProfile.CumulativeByFunction(1); err == nil {
+		t.Errorf("CumulativeByFunction with invalid index: want error")
+	}
+}
+
+func TestLabelSizeStats(t *testing.T) {
+	p := testProfile1.Copy()
+	p.Sample[0].NumLabel = map[string][]int64{"bytes": {1024}, "key3": {1}}
+	p.Sample[0].NumUnit = map[string][]string{"bytes": {"bytes"}}
+	p.Sample[1].NumLabel = map[string][]int64{"bytes": {1024}, "key3": {2}}
+	want := LabelStats{
+		{Key: "key1", Samples: 5, Values: 4, Bytes: 40},
+		{Key: "key2", Samples: 4, Values: 2, Bytes: 32},
+		{Key: "key3", Samples: 2, Values: 3, Bytes: 32},
+		{Key: "bytes", Samples: 2, Values: 2, Bytes: 31},
+	}
+	if got := p.LabelSizeStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("LabelSizeStats got %+v, want %+v", got, want)
+	}
+}
+
+func TestMappingAttribution(t *testing.T) {
+	p := testProfile1.Copy()
+	p.Sample = append(p.Sample, &Sample{Value: []int64{5, 5}})
+	// All samples but the first one have a leaf in mapping 0 called
+	// from mapping 1, with a total value of 10111.
+	for _, tc := range []struct {
+		desc string
+		mode AttributionMode
+		want map[*Mapping]float64
+	}{
+		{
+			desc: "leaf",
+			mode: AttributeLeaf,
+			want: map[*Mapping]float64{p.Mapping[0]: 10111, p.Mapping[1]: 1000, nil: 5},
+		},
+		{
+			desc: "even",
+			mode: AttributeEven,
+			want: map[*Mapping]float64{p.Mapping[0]: 5055.5, p.Mapping[1]: 6055.5, nil: 5},
+		},
+		{
+			desc: "weighted",
+			mode: AttributeWeighted,
+			want: map[*Mapping]float64{p.Mapping[0]: 10111 * 2.0 / 3, p.Mapping[1]: 1000 + 10111/3.0, nil: 5},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := p.MappingAttribution(1, tc.mode)
+			if err != nil {
+				t.Fatalf("MappingAttribution: %v", err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("MappingAttribution got %v, want %v", got, tc.want)
+			}
+			for m, want := range tc.want {
+				if v, ok := got[m]; !ok || math.Abs(v-want) > 1e-6 {
+					t.Errorf("MappingAttribution got %v, want %v", got, tc.want)
+					break
+				}
+			}
+		})
+	}
+	if _, err := p.MappingAttribution(2, AttributeLeaf); err == nil {
+		t.Errorf("MappingAttribution with invalid index: want error")
+	}
+	if _, err := p.MappingAttribution(0, AttributionMode(-1)); err == nil {
+		t.Errorf("MappingAttribution with invalid mode: want error")
+	}
+}
+
+func TestDepthHistogram(t *testing.T) {
+	p := inlinesProfile.Copy()
+	noLines := &Location{ID: 4, Mapping: p.Mapping[0], Address: 0x4000}
+	p.Location = append(p.Location, noLines)
+	p.Sample = append(p.Sample,
+		&Sample{Value: []int64{3}},
+		&Sample{Value: []int64{5}, Location: []*Location{noLines, p.Location[0]}},
+	)
+
+	for _, tc := range []struct {
+		desc    string
+		inlined bool
+		want    map[int]int
+	}{
+		{
+			desc: "locations",
+			want: map[int]int{0: 1, 1: 1, 2: 2},
+		},
+		{
+			desc:    "inlined frames",
+			inlined: true,
+			want:    map[int]int{0: 1, 3: 2, 4: 1},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := p.DepthHistogram(tc.inlined); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("DepthHistogram got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLeafHistogram(t *testing.T) {
+	p := inlinesProfile.Copy()
+	p.Location[2].IsFolded = true
+	noLines := &Location{ID: 4, Mapping: p.Mapping[0], Address: 0x4000}
+	p.Location = append(p.Location, noLines)
+	p.Sample = append(p.Sample,
+		&Sample{Value: []int64{3}},
+		&Sample{Value: []int64{5}, Location: []*Location{noLines, p.Location[0]}},
+	)
+
+	leaves, err := p.LeafHistogram(0)
+	if err != nil {
+		t.Fatalf("LeafHistogram: %v", err)
+	}
+	got := make(map[string]int64)
+	for f, v := range leaves {
+		var name string
+		if f != nil {
+			name = f.Name
+		}
+		got[name] = v
+	}
+	if want := map[string]int64{"fun0": 1, "fun4": 2, "": 8}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LeafHistogram got %v, want %v", got, want)
+	}
+	if _, err := p.LeafHistogram(1); err == nil {
+		t.Errorf("LeafHistogram with invalid index: want error")
+	}
+}
+
+func TestFunctionStats(t *testing.T) {
+	p := recursionProfile.Copy()
+	stats, err := p.FunctionStats(0)
+	if err != nil {
+		t.Fatalf("FunctionStats: %v", err)
+	}
+	var got []string
+	for _, fs := range stats {
+		got = append(got, fmt.Sprintf("%s %d %d", fs.Function.Name, fs.Flat, fs.Cum))
+	}
+	if want := []string{"fun2 8 12", "fun0 7 7", "fun1 0 7"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FunctionStats got %q, want %q", got, want)
+	}
+
+	// The stats must agree with LeafHistogram and CumulativeByFunction.
+	flat, err := p.LeafHistogram(0)
+	if err != nil {
+		t.Fatalf("LeafHistogram: %v", err)
+	}
+	cum, err := p.CumulativeByFunction(0)
+	if err != nil {
+		t.Fatalf("CumulativeByFunction: %v", err)
+	}
+	if len(stats) != len(cum) {
+		t.Errorf("FunctionStats got %d functions, want %d", len(stats), len(cum))
+	}
+	for _, fs := range stats {
+		if fs.Flat != flat[fs.Function] || fs.Cum != cum[fs.Function] {
+			t.Errorf("FunctionStats got %s flat %d cum %d, want flat %d cum %d", fs.Function.Name, fs.Flat, fs.Cum, flat[fs.Function], cum[fs.Function])
+		}
+	}
+
+	if _, err := p.FunctionStats(1); err == nil {
+		t.Errorf("FunctionStats with invalid index: want error")
+	}
+}
+
+func TestHotPath(t *testing.T) {
+	withValues := func(values ...int64) *Profile {
+		p := noInlinesProfile.Copy()
+		for i, s := range p.Sample {
+			s.Value[0] = values[i]
+		}
+		return p
+	}
+	merged := noInlinesProfile.Copy()
+	merged.Sample = append(merged.Sample, &Sample{
+		Location: merged.Sample[0].Location,
+		Value:    []int64{4},
+		Label:    map[string][]string{"key": {"value"}},
+	})
+
+	// Two tied stacks of distinct functions with the same name, listed
+	// in the order that doesn't match the tiebreak.
+	sameNames := &Profile{SampleType: []*ValueType{{Type: "samples", Unit: "count"}}}
+	for _, f := range []*Function{
+		{ID: 1, Name: "init", Filename: "b.go"},
+		{ID: 2, Name: "init", Filename: "a.go"},
+		{ID: 3, Name: "init", Filename: "a.go"},
+	} {
+		l := &Location{ID: f.ID, Line: []Line{{Function: f}}}
+		sameNames.Function = append(sameNames.Function, f)
+		sameNames.Location = append(sameNames.Location, l)
+		sameNames.Sample = append(sameNames.Sample, &Sample{Location: []*Location{l}, Value: []int64{1}})
+	}
+
+	addr := &Location{ID: 1, Address: 0x1000}
+	unsymbolized := &Profile{
+		SampleType: []*ValueType{{Type: "samples", Unit: "count"}},
+		Location:   []*Location{addr},
+		Sample:     []*Sample{{Location: []*Location{addr}, Value: []int64{7}}},
+	}
+
+	for _, tc := range []struct {
+		desc      string
+		p         *Profile
+		wantFuncs string
+		wantValue int64
+		wantIDs   []uint64
+	}{
+		{
+			desc:      "heaviest sample",
+			p:         noInlinesProfile,
+			wantFuncs: "[fun9 fun4 fun10 fun7]",
+			wantValue: 4,
+		},
+		{
+			desc:      "inlined frames",
+			p:         inlinesProfile,
+			wantFuncs: "[fun4 fun5 fun6]",
+			wantValue: 2,
+		},
+		{
+			desc:      "samples with the same stack",
+			p:         merged,
+			wantFuncs: "[fun0 fun1 fun2 fun3]",
+			wantValue: 5,
+		},
+		{
+			desc:      "ties",
+			p:         withValues(1, 3, 3, 2),
+			wantFuncs: "[fun4 fun5 fun1 fun6]",
+			wantValue: 3,
+		},
+		{
+			desc:      "ties between functions with the same name",
+			p:         sameNames,
+			wantFuncs: "[init]",
+			wantValue: 1,
+			wantIDs:   []uint64{2},
+		},
+		{
+			desc:      "unsymbolized frames",
+			p:         unsymbolized,
+			wantFuncs: "[]",
+			wantValue: 7,
+		},
+		{
+			desc:      "no samples",
+			p:         &Profile{SampleType: []*ValueType{{Type: "samples", Unit: "count"}}},
+			wantFuncs: "[]",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			funcs, value, err := tc.p.HotPath(0)
+			if err != nil {
+				t.Fatalf("HotPath: %v", err)
+			}
+			var names []string
+			var ids []uint64
+			for _, f := range funcs {
+				names = append(names, f.Name)
+				ids = append(ids, f.ID)
+			}
+			if got := fmt.Sprint(names); got != tc.wantFuncs || value != tc.wantValue {
+				t.Errorf("HotPath got %s %d, want %s %d", got, value, tc.wantFuncs, tc.wantValue)
+			}
+			if tc.wantIDs != nil && !reflect.DeepEqual(ids, tc.wantIDs) {
+				t.Errorf("HotPath got function IDs %v, want %v", ids, tc.wantIDs)
+			}
+		})
+	}
+
+	if _, _, err := noInlinesProfile.HotPath(1); err == nil {
+		t.Errorf("HotPath with invalid index: want error")
+	}
+}
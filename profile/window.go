@@ -0,0 +1,148 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+// Implements a merge of the profiles within a sliding time window.
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// WindowedMerger maintains the merge of the most recent profiles added
+// to it, such as a live aggregate of the last few minutes of a stream
+// of profiles. Once the durations of the profiles added exceed Window,
+// the oldest ones are evicted by subtracting them from the merge. The
+// most recent profile is never evicted, so a zero Window keeps only the
+// last profile.
+type WindowedMerger struct {
+	// Window is the maximum total duration of the profiles merged.
+	Window time.Duration
+
+	srcs     []*Profile
+	current  *Profile
+	duration int64
+}
+
+// Add merges p into the current profile and evicts the oldest profiles
+// if the window is exceeded, along with their comments. p is retained
+// until evicted, so it must not be modified after being added. Returns
+// an error, leaving the current profile unchanged, if p can't be merged
+// with it.
+func (w *WindowedMerger) Add(p *Profile) error {
+	var current *Profile
+	if w.current == nil {
+		current = p.Copy()
+	} else {
+		var err error
+		if current, err = Merge([]*Profile{w.current, p}); err != nil {
+			return err
+		}
+	}
+	srcs := append(w.srcs, p)
+	duration := w.duration + p.DurationNanos
+
+	evicted := 0
+	for duration > int64(w.Window) && len(srcs)-evicted > 1 {
+		old := srcs[evicted].Copy()
+		old.Scale(-1)
+		var err error
+		if current, err = Merge([]*Profile{current, old}); err != nil {
+			return err
+		}
+		duration -= srcs[evicted].DurationNanos
+		evicted++
+	}
+	for i := 0; i < evicted; i++ {
+		srcs[i] = nil
+	}
+	srcs = srcs[evicted:]
+
+	// The header only reflects the profiles left in the window.
+	current.DurationNanos = duration
+	current.TimeNanos = 0
+	current.Comments = nil
+	seenComments := make(map[string]bool)
+	for _, src := range srcs {
+		if t := src.TimeNanos; t != 0 && (current.TimeNanos == 0 || t < current.TimeNanos) {
+			current.TimeNanos = t
+		}
+		for _, c := range src.Comments {
+			if !seenComments[c] {
+				seenComments[c] = true
+				current.Comments = append(current.Comments, c)
+			}
+		}
+	}
+	w.current, w.srcs, w.duration = current, srcs, duration
+	return nil
+}
+
+// Current returns a copy of the merge of the profiles in the window, or
+// nil if no profile was added.
+func (w *WindowedMerger) Current() *Profile {
+	if w.current == nil {
+		return nil
+	}
+	return w.current.Copy()
+}
+
+// MergeTimeline buckets srcs into consecutive windows of the given
+// length by their TimeNanos, and merges the profiles of each window. The
+// first window starts at the earliest TimeNanos. Merged profiles are
+// returned in time order, skipping windows without profiles, with the
+// TimeNanos and DurationNanos computed by Merge. A profile is assigned to
+// the window including its start, even if it lasts past the end of that
+// window: its samples aren't split across windows. Returns an error if
+// window isn't positive, if a profile has no TimeNanos, or if the
+// profiles of a window can't be merged.
+func MergeTimeline(srcs []*Profile, window time.Duration) ([]*Profile, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("window must be positive, got %v", window)
+	}
+	if len(srcs) == 0 {
+		return nil, nil
+	}
+	start := srcs[0].TimeNanos
+	for i, src := range srcs {
+		if src.TimeNanos == 0 {
+			return nil, fmt.Errorf("profile %d has no time", i)
+		}
+		if src.TimeNanos < start {
+			start = src.TimeNanos
+		}
+	}
+	buckets := make(map[int64][]*Profile)
+	for _, src := range srcs {
+		b := (src.TimeNanos - start) / int64(window)
+		buckets[b] = append(buckets[b], src)
+	}
+	keys := make([]int64, 0, len(buckets))
+	for b := range buckets {
+		keys = append(keys, b)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	merged := make([]*Profile, len(keys))
+	for i, b := range keys {
+		p, err := Merge(buckets[b])
+		if err != nil {
+			return nil, fmt.Errorf("window %d: %v", b, err)
+		}
+		merged[i] = p
+	}
+	return merged, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWindowedMerger(t *testing.T) {
+	// Each profile lasts 10 seconds, and has the values of
+	// noInlinesProfile multiplied by 10^i.
+	var profs []*Profile
+	for i := 0; i < 4; i++ {
+		p := noInlinesProfile.Copy()
+		p.TimeNanos = int64(i+1) * 10e9
+		p.Comments = []string{fmt.Sprintf("profile %d", i), "shared"}
+		for j := 0; j < i; j++ {
+			p.Scale(10)
+		}
+		profs = append(profs, p)
+	}
+	w := &WindowedMerger{Window: 25 * time.Second}
+	if got := w.Current(); got != nil {
+		t.Errorf("Current without profiles got %v, want nil", got)
+	}
+	for _, tc := range []struct {
+		add          *Profile
+		wantFuncs    []string
+		wantTime     int64
+		wantDuration int64
+		wantComments []string
+	}{
+		{
+			add:          profs[0],
+			wantFuncs:    allNoInlinesSampleFuncs,
+			wantTime:     10e9,
+			wantDuration: 10e9,
+			wantComments: []string{"profile 0", "shared"},
+		},
+		{
+			add: profs[1],
+			wantFuncs: []string{
+				"fun0 fun1 fun2 fun3: 11",
+				"fun4 fun5 fun1 fun6: 22",
+				"fun7 fun8: 33",
+				"fun9 fun4 fun10 fun7: 44",
+			},
+			wantTime:     10e9,
+			wantDuration: 20e9,
+			wantComments: []string{"profile 0", "shared", "profile 1"},
+		},
+		{
+			add: profs[2],
+			wantFuncs: []string{
+				"fun0 fun1 fun2 fun3: 110",
+				"fun4 fun5 fun1 fun6: 220",
+				"fun7 fun8: 330",
+				"fun9 fun4 fun10 fun7: 440",
+			},
+			wantTime:     20e9,
+			wantDuration: 20e9,
+			wantComments: []string{"profile 1", "shared", "profile 2"},
+		},
+		{
+			add: profs[3],
+			wantFuncs: []string{
+				"fun0 fun1 fun2 fun3: 1100",
+				"fun4 fun5 fun1 fun6: 2200",
+				"fun7 fun8: 3300",
+				"fun9 fun4 fun10 fun7: 4400",
+			},
+			wantTime:     30e9,
+			wantDuration: 20e9,
+			wantComments: []string{"profile 2", "shared", "profile 3"},
+		},
+	} {
+		if err := w.Add(tc.add); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+		p := w.Current()
+		if err := p.CheckValid(); err != nil {
+			t.Fatalf("Current is invalid: %v", err)
+		}
+		if got, want := strings.Join(sampleFuncs(p), "\n"), strings.Join(tc.wantFuncs, "\n"); got != want {
+			t.Errorf("Current got samples:\n%s\nwant:\n%s", got, want)
+		}
+		if p.TimeNanos != tc.wantTime || p.DurationNanos != tc.wantDuration {
+			t.Errorf("Current got time %d and duration %d, want %d and %d", p.TimeNanos, p.DurationNanos, tc.wantTime, tc.wantDuration)
+		}
+		if !reflect.DeepEqual(p.Comments, tc.wantComments) {
+			t.Errorf("Current got comments %q, want %q", p.Comments, tc.wantComments)
+		}
+	}
+
+	incompatible := noInlinesProfile.Copy()
+	incompatible.SampleType = append(incompatible.SampleType, &ValueType{Type: "cpu", Unit: "milliseconds"})
+	for _, s := range incompatible.Sample {
+		s.Value = append(s.Value, 0)
+	}
+	before, srcs := w.Current().String(), len(w.srcs)
+	if err := w.Add(incompatible); err == nil {
+		t.Errorf("Add with incompatible profile: want error")
+	}
+	if w.Current().String() != before || len(w.srcs) != srcs {
+		t.Errorf("failed Add modified the window")
+	}
+}
+
+func TestMergeTimeline(t *testing.T) {
+	at := func(timeNanos int64) *Profile {
+		p := noInlinesProfile.Copy()
+		p.TimeNanos = timeNanos
+		return p
+	}
+	// Profiles at 0s, 5s and 12s from the first one; none in [20s, 30s).
+	const base = 1e9
+	srcs := []*Profile{at(base + 12e9), at(base), at(base + 31e9), at(base + 5e9)}
+	got, err := MergeTimeline(srcs, 10*time.Second)
+	if err != nil {
+		t.Fatalf("MergeTimeline: %v", err)
+	}
+	want := []struct {
+		time  int64
+		value int64
+	}{{base, 2}, {base + 12e9, 1}, {base + 31e9, 1}}
+	if len(got) != len(want) {
+		t.Fatalf("MergeTimeline got %d profiles, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		p := got[i]
+		if p.TimeNanos != w.time {
+			t.Errorf("profile %d got time %d, want %d", i, p.TimeNanos, w.time)
+		}
+		if v := p.Sample[0].Value[0]; v != w.value {
+			t.Errorf("profile %d got first value %d, want %d", i, v, w.value)
+		}
+	}
+
+	if _, err := MergeTimeline(srcs, 0); err == nil {
+		t.Errorf("MergeTimeline with zero window: want error")
+	}
+	if _, err := MergeTimeline([]*Profile{at(base), at(0)}, time.Second); err == nil {
+		t.Errorf("MergeTimeline with profile without time: want error")
+	}
+}